@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JSON structure must match the one written by the server
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	ConnID      string    `json:"conn_id"`
+	RequestID   string    `json:"request_id"`
+	Remote      string    `json:"remote"`
+	ClientID    int       `json:"client_id"`
+	Task        int       `json:"task"`
+	InputSHA256 string    `json:"input_sha256"`
+	DurationMs  float64   `json:"duration_ms"`
+	Status      string    `json:"status"`
+	ErrorCode   string    `json:"error_code,omitempty"`
+	Replayed    bool      `json:"replayed,omitempty"` // answered with the stored response of an idempotent request
+}
+
+// filters given on the command line, zero values match everything
+type filter struct {
+	clientID int
+	task     int
+	status   string
+	since    time.Time
+	until    time.Time
+}
+
+func (f filter) matches(record auditRecord) bool {
+	if f.clientID >= 0 && record.ClientID != f.clientID {
+		return false
+	}
+	if f.task > 0 && record.Task != f.task {
+		return false
+	}
+	if f.status != "" && record.Status != f.status {
+		return false
+	}
+	if !f.since.IsZero() && record.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !record.Time.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// parseTime accepts RFC 3339 timestamps or durations relative to now, e.g. "2h"
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// logFiles returns the rotated files followed by the current one, oldest first
+func logFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	files := make([]string, 0, len(matches)+1)
+	for _, match := range matches {
+		// skipping a file that is being compressed, its .gz copy is read instead
+		if !strings.HasSuffix(match, ".gz") {
+			if _, err := os.Stat(match + ".gz"); err == nil {
+				continue
+			}
+		}
+		files = append(files, match)
+	}
+	sort.Strings(files)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files
+}
+
+// scanFile calls visit for every record in a (possibly gzipped) audit file
+func scanFile(path string, visit func(auditRecord)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Skipping invalid line %s:%d: %v", path, lineNumber, err)
+			continue
+		}
+		visit(record)
+	}
+	return scanner.Err()
+}
+
+func main() {
+	path := flag.String("file", "audit/audit.log", "audit log path, rotated files next to it are read too")
+	clientID := flag.Int("client", -1, "only records of this client id")
+	task := flag.Int("task", 0, "only records of this task number")
+	status := flag.String("status", "", "only records with this status (success or error)")
+	since := flag.String("since", "", "only records at or after this time (RFC 3339 or a duration like 2h)")
+	until := flag.String("until", "", "only records before this time (RFC 3339 or a duration like 30m)")
+	summary := flag.Bool("summary", false, "print counts per task and status instead of the records")
+	flag.Parse()
+
+	f := filter{clientID: *clientID, task: *task, status: *status}
+	var err error
+	if f.since, err = parseTime(*since); err != nil {
+		log.Fatalf("Invalid -since: %v", err)
+	}
+	if f.until, err = parseTime(*until); err != nil {
+		log.Fatalf("Invalid -until: %v", err)
+	}
+
+	files := logFiles(*path)
+	if len(files) == 0 {
+		log.Fatalf("No audit files found at %s", *path)
+	}
+
+	// counts per "task/status" for the summary
+	counts := make(map[string]int)
+	encoder := json.NewEncoder(os.Stdout)
+	for _, file := range files {
+		err := scanFile(file, func(record auditRecord) {
+			if !f.matches(record) {
+				return
+			}
+			if *summary {
+				counts[fmt.Sprintf("task %d %s", record.Task, record.Status)]++
+				return
+			}
+			encoder.Encode(record)
+		})
+		if err != nil {
+			log.Printf("Error reading %s: %v", file, err)
+		}
+	}
+
+	if *summary {
+		keys := make([]string, 0, len(counts))
+		for key := range counts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s: %d\n", key, counts[key])
+		}
+	}
+}
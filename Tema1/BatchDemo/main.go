@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/taskserver"
+)
+
+// BatchDemo runs a coordinator and several workers in this process and submits
+// batches of tasks committed with two-phase commit: a batch that commits, one a worker
+// refuses, one a worker is too slow for, and batches interrupted by a worker crash and
+// by a coordinator crash; after every batch it checks that the workers agree with the
+// decision of the coordinator. It exits with status 1 if a check fails.
+
+var (
+	numWorkers = flag.Int("workers", 3, "number of workers")
+	basePort   = flag.Int("base-port", 8700, "the coordinator listens on base-port, its cluster listener on base-port+10, worker i on base-port+i and its admin interface on base-port+20+i")
+	verbose    = flag.Bool("v", false, "show the logs of the servers")
+)
+
+// the task of the batches, it echoes its input after sleeping sleep_ms and fails when fail is set
+const demoTask = 100
+
+const adminToken = "demo"
+
+type demoInput struct {
+	Value   int  `json:"value"`
+	SleepMs int  `json:"sleep_ms,omitempty"`
+	Fail    bool `json:"fail,omitempty"`
+}
+
+// cluster holds the running servers, a stopped server is nil; dir keeps their logs
+type cluster struct {
+	dir         string
+	coordinator *taskserver.Server
+	workers     map[int]*taskserver.Server
+}
+
+func (c *cluster) logger() *slog.Logger {
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+func serve(name string, server *taskserver.Server) {
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != taskserver.ErrServerClosed {
+			log.Fatalf("Error serving %s: %v", name, err)
+		}
+	}()
+}
+
+func (c *cluster) startCoordinator() {
+	server, err := taskserver.New(taskserver.Config{
+		Host:           "localhost",
+		Port:           strconv.Itoa(*basePort),
+		MaxMessageSize: 65536,
+		Cluster: taskserver.ClusterConfig{
+			Role:    taskserver.RoleCoordinator,
+			Address: fmt.Sprintf("localhost:%d", *basePort+10),
+		},
+		Batches: taskserver.BatchConfig{
+			Dir:                       filepath.Join(c.dir, "coordinator"),
+			PrepareTimeoutSeconds:     2,
+			RetryIntervalMilliseconds: 200,
+		},
+	}, taskserver.WithLogger(c.logger()))
+	if err != nil {
+		log.Fatalf("Error creating the coordinator: %v", err)
+	}
+	serve("the coordinator", server)
+	c.coordinator = server
+}
+
+func (c *cluster) startWorker(id int) {
+	server, err := taskserver.New(taskserver.Config{
+		Host:           "localhost",
+		Port:           strconv.Itoa(*basePort + id),
+		MaxMessageSize: 65536,
+		Admin:          taskserver.AdminConfig{Address: fmt.Sprintf("localhost:%d", *basePort+20+id), Token: adminToken},
+		Cluster: taskserver.ClusterConfig{
+			Role:                     taskserver.RoleWorker,
+			NodeID:                   fmt.Sprintf("worker%d", id),
+			CoordinatorAddress:       fmt.Sprintf("localhost:%d", *basePort+10),
+			HeartbeatIntervalSeconds: 1,
+		},
+		Batches: taskserver.BatchConfig{
+			Dir:                       filepath.Join(c.dir, fmt.Sprintf("worker%d", id)),
+			RetryIntervalMilliseconds: 200,
+		},
+	}, taskserver.WithLogger(c.logger()), taskserver.WithTask(demoTask, func(raw json.RawMessage) (any, error) {
+		var input demoInput
+		if err := json.Unmarshal(raw, &input); err != nil {
+			return nil, err
+		}
+		time.Sleep(time.Duration(input.SleepMs) * time.Millisecond)
+		if input.Fail {
+			return nil, fmt.Errorf("value %d refused", input.Value)
+		}
+		return input.Value, nil
+	}))
+	if err != nil {
+		log.Fatalf("Error creating worker %d: %v", id, err)
+	}
+	serve(fmt.Sprintf("worker %d", id), server)
+	c.workers[id] = server
+}
+
+// stop shuts a server down without waiting for its connections, as close to a crash
+// as an in-process server gets
+func stop(server *taskserver.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+type response struct {
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+	Code   string          `json:"code"`
+}
+
+type batchStatus struct {
+	BatchID string `json:"batch_id"`
+	Status  string `json:"status"`
+	Items   []struct {
+		Index  int             `json:"index"`
+		Result json.RawMessage `json:"result"`
+	} `json:"items"`
+	Reason string `json:"reason"`
+}
+
+// call sends one request on a new connection, skipping the welcome line of task listeners
+func call(address string, request any, welcome bool, timeout time.Duration) (response, error) {
+	var resp response
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	if welcome {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return resp, err
+		}
+	}
+	encoded, _ := json.Marshal(request)
+	if _, err := conn.Write(append(encoded, '\n')); err != nil {
+		return resp, err
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(line, &resp)
+	return resp, err
+}
+
+// submit sends a batch to the coordinator and returns its status
+func submit(inputs ...demoInput) (batchStatus, error) {
+	var tasks []map[string]any
+	for _, input := range inputs {
+		tasks = append(tasks, map[string]any{"task": demoTask, "input": input})
+	}
+	payload, _ := json.Marshal(map[string]any{"tasks": tasks})
+	resp, err := call(fmt.Sprintf("localhost:%d", *basePort), map[string]any{"op": "submit_batch", "input": json.RawMessage(payload)}, true, 10*time.Second)
+	var status batchStatus
+	if err != nil {
+		return status, err
+	}
+	if resp.Result == nil {
+		return status, fmt.Errorf("%s: %s", resp.Code, resp.Error)
+	}
+	err = json.Unmarshal(resp.Result, &status)
+	return status, err
+}
+
+// status reads the state of a batch on a coordinator or worker, empty if it does not know it
+func status(port int, id string) string {
+	input, _ := json.Marshal(map[string]string{"batch_id": id})
+	resp, err := call(fmt.Sprintf("localhost:%d", port), map[string]any{"op": "batch_status", "input": json.RawMessage(input)}, true, 5*time.Second)
+	if err != nil || resp.Status != "success" {
+		return ""
+	}
+	var s batchStatus
+	json.Unmarshal(resp.Result, &s)
+	return s.Status
+}
+
+// inDoubt returns the batches a worker prepared without knowing the decision
+func inDoubt(id int) []string {
+	resp, err := call(fmt.Sprintf("localhost:%d", *basePort+20+id), map[string]any{"op": "batches", "token": adminToken}, false, 5*time.Second)
+	if err != nil || resp.Status != "success" {
+		return nil
+	}
+	var s struct {
+		InDoubt []string `json:"in_doubt"`
+	}
+	json.Unmarshal(resp.Result, &s)
+	return s.InDoubt
+}
+
+// agree waits until every running worker that took part in the batch reached the
+// state expected, and the coordinator reports it too
+func (c *cluster) agree(id, expected string) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var problems []string
+		if got := status(*basePort, id); got != expected {
+			problems = append(problems, fmt.Sprintf("coordinator has %q", got))
+		}
+		participants := 0
+		for worker, server := range c.workers {
+			if server == nil {
+				continue
+			}
+			got := status(*basePort+worker, id)
+			if got == "" {
+				continue
+			}
+			participants++
+			if got != expected {
+				problems = append(problems, fmt.Sprintf("worker%d has %q", worker, got))
+			}
+		}
+		if participants == 0 {
+			problems = append(problems, "no worker knows the batch")
+		}
+		if len(problems) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("batch %s should be %s: %s", id, expected, strings.Join(problems, ", "))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitForWorkers gives the workers time to register with the coordinator
+func waitForWorkers() {
+	time.Sleep(1500 * time.Millisecond)
+}
+
+func main() {
+	flag.Parse()
+	if *numWorkers < 2 {
+		log.Fatalf("At least 2 workers are needed")
+	}
+	dir, err := os.MkdirTemp("", "batchdemo")
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := &cluster{dir: dir, workers: make(map[int]*taskserver.Server)}
+	c.startCoordinator()
+	for id := 1; id <= *numWorkers; id++ {
+		c.startWorker(id)
+	}
+	waitForWorkers()
+
+	failed := false
+	check := func(err error, format string, args ...any) {
+		if err != nil {
+			fmt.Printf("FAIL: %v\n\n", err)
+			failed = true
+			return
+		}
+		fmt.Printf("OK: "+format+"\n\n", args...)
+	}
+
+	fmt.Println("Batch of 6 tasks")
+	var inputs []demoInput
+	for i := 1; i <= 6; i++ {
+		inputs = append(inputs, demoInput{Value: i * 10})
+	}
+	batch, err := submit(inputs...)
+	if err == nil && batch.Status != "committed" {
+		err = fmt.Errorf("batch %s", batch.Status)
+	}
+	if err == nil {
+		for _, item := range batch.Items {
+			if string(item.Result) != strconv.Itoa((item.Index+1)*10) {
+				err = fmt.Errorf("task %d returned %s", item.Index, item.Result)
+			}
+		}
+	}
+	if err == nil {
+		err = c.agree(batch.BatchID, "committed")
+	}
+	check(err, "committed on every worker with the 6 results")
+
+	fmt.Println("Batch with a task that fails")
+	batch, err = submit(demoInput{Value: 1}, demoInput{Value: 2, Fail: true}, demoInput{Value: 3})
+	if err == nil && (batch.Status != "aborted" || len(batch.Items) != 0) {
+		err = fmt.Errorf("batch %s with %d results", batch.Status, len(batch.Items))
+	}
+	if err == nil {
+		err = c.agree(batch.BatchID, "aborted")
+	}
+	check(err, "aborted on every worker, no result published: %s", batch.Reason)
+
+	fmt.Println("Batch with a task slower than the prepare timeout")
+	batch, err = submit(demoInput{Value: 1}, demoInput{Value: 2, SleepMs: 3000})
+	if err == nil && batch.Status != "aborted" {
+		err = fmt.Errorf("batch %s", batch.Status)
+	}
+	if err == nil {
+		// the slow worker prepares after the decision and learns it from the coordinator
+		time.Sleep(1500 * time.Millisecond)
+		err = c.agree(batch.BatchID, "aborted")
+	}
+	check(err, "aborted on every worker: %s", batch.Reason)
+
+	fmt.Println("Worker crash after preparing, the batch commits while it is down")
+	done := make(chan batchStatus, 1)
+	go func() {
+		batch, _ := submit(demoInput{Value: 1}, demoInput{Value: 2, SleepMs: 1000})
+		done <- batch
+	}()
+	crashed, id := 0, ""
+	for deadline := time.Now().Add(900 * time.Millisecond); crashed == 0 && time.Now().Before(deadline); {
+		for worker := 1; worker <= *numWorkers; worker++ {
+			if prepared := inDoubt(worker); len(prepared) > 0 {
+				crashed, id = worker, prepared[0]
+				break
+			}
+		}
+	}
+	if crashed == 0 {
+		check(fmt.Errorf("no worker prepared its part in time"), "")
+		batch = <-done
+	} else {
+		stop(c.workers[crashed])
+		c.workers[crashed] = nil
+		batch = <-done
+		if batch.Status != "committed" {
+			err = fmt.Errorf("batch %s", batch.Status)
+		} else {
+			c.startWorker(crashed)
+			err = c.agree(id, "committed")
+		}
+		check(err, "worker%d crashed after preparing and committed after restarting", crashed)
+	}
+
+	fmt.Println("Coordinator crash before deciding")
+	go func() {
+		batch, _ := submit(demoInput{Value: 1}, demoInput{Value: 2, SleepMs: 1000})
+		done <- batch
+	}()
+	time.Sleep(500 * time.Millisecond)
+	var prepared []string
+	for worker := 1; worker <= *numWorkers; worker++ {
+		prepared = append(prepared, inDoubt(worker)...)
+	}
+	stop(c.coordinator)
+	<-done
+	c.startCoordinator()
+	if len(prepared) == 0 {
+		err = fmt.Errorf("no worker prepared its part before the crash")
+	} else {
+		// the coordinator has no decision for the batch, the workers learn it was aborted
+		time.Sleep(1500 * time.Millisecond)
+		err = c.agree(prepared[0], "aborted")
+	}
+	check(err, "the restarted coordinator aborted the undecided batch on every worker")
+
+	fmt.Println("Batch after the restarts")
+	waitForWorkers()
+	batch, err = submit(demoInput{Value: 7}, demoInput{Value: 8}, demoInput{Value: 9})
+	if err == nil && batch.Status != "committed" {
+		err = fmt.Errorf("batch %s: %s", batch.Status, batch.Reason)
+	}
+	if err == nil {
+		err = c.agree(batch.BatchID, "committed")
+	}
+	check(err, "committed on every worker")
+
+	for worker := 1; worker <= *numWorkers; worker++ {
+		if doubt := inDoubt(worker); len(doubt) > 0 {
+			check(fmt.Errorf("worker%d still waits for the decision of %v", worker, doubt), "")
+		}
+	}
+
+	for _, server := range c.workers {
+		if server != nil {
+			stop(server)
+		}
+	}
+	stop(c.coordinator)
+	os.RemoveAll(dir)
+	if failed {
+		fmt.Println("Batch checks failed")
+		os.Exit(1)
+	}
+	fmt.Println("All batch checks passed")
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/gossip"
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/taskserver"
+)
+
+// CacheDemo runs several task servers sharing the result cache in this process, sends
+// the same requests to different servers while servers leave and join, and checks that
+// no result is computed twice; it exits with status 1 if a check fails
+
+var (
+	numServers  = flag.Int("servers", 4, "number of servers started at first")
+	numKeys     = flag.Int("keys", 40, "distinct requests sent in every round")
+	basePort    = flag.Int("base-port", 8400, "server i listens on base-port+i, gossip on base-port+100+i, the cache on base-port+200+i")
+	replication = flag.Int("replication", 2, "servers storing each result")
+	verbose     = flag.Bool("v", false, "show the logs of the servers")
+)
+
+// the task counted by the demo, it echoes its input
+const demoTask = 100
+
+// executions counts the demo tasks computed by any server
+var executions atomic.Int64
+
+// cluster holds the running servers by id, a stopped server is nil
+type cluster struct {
+	servers map[int]*taskserver.Server
+}
+
+func name(id int) string {
+	return fmt.Sprintf("server%d", id)
+}
+
+func clientAddress(id int) string {
+	return "localhost:" + strconv.Itoa(*basePort+id)
+}
+
+func (c *cluster) start(id int, seeds ...int) {
+	var seedAddresses []string
+	for _, seed := range seeds {
+		seedAddresses = append(seedAddresses, fmt.Sprintf("localhost:%d", *basePort+100+seed))
+	}
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	config := taskserver.Config{
+		Host: "localhost",
+		Port: strconv.Itoa(*basePort + id),
+		Gossip: taskserver.GossipConfig{
+			Name:                      name(id),
+			BindAddress:               fmt.Sprintf("localhost:%d", *basePort+100+id),
+			Seeds:                     seedAddresses,
+			ProbeIntervalMilliseconds: 100,
+		},
+		Cache: taskserver.CacheConfig{
+			Address:           fmt.Sprintf("localhost:%d", *basePort+200+id),
+			ReplicationFactor: *replication,
+		},
+	}
+	server, err := taskserver.New(config,
+		taskserver.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))),
+		taskserver.WithTask(demoTask, func(input json.RawMessage) (any, error) {
+			executions.Add(1)
+			return input, nil
+		}),
+	)
+	if err != nil {
+		log.Fatalf("Error creating %s: %v", name(id), err)
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != taskserver.ErrServerClosed {
+			log.Fatalf("Error serving %s: %v", name(id), err)
+		}
+	}()
+	c.servers[id] = server
+}
+
+func (c *cluster) stop(id int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.servers[id].Shutdown(ctx)
+	c.servers[id] = nil
+}
+
+// live returns the ids of the running servers
+func (c *cluster) live() []int {
+	var ids []int
+	for id, server := range c.servers {
+		if server != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// waitForMembers waits until every running server sees exactly the running servers as
+// alive, then gives the caches time to rebalance
+func (c *cluster) waitForMembers() error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := c.membersMatch()
+		if err == nil {
+			time.Sleep(time.Second)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (c *cluster) membersMatch() error {
+	live := c.live()
+	for _, id := range live {
+		alive := 0
+		for _, member := range c.servers[id].Members() {
+			if member.State == gossip.Alive {
+				alive++
+			}
+		}
+		if alive != len(live) {
+			return fmt.Errorf("%s sees %d live members, expected %d", name(id), alive, len(live))
+		}
+	}
+	return nil
+}
+
+// send executes the demo task on a server, input is sent exactly as given
+func send(id int, input string) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("tcp", clientAddress(id), 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil { // welcome line
+		return nil, err
+	}
+	fmt.Fprintf(conn, "{\"task\":%d,\"input\":%s}\n", demoTask, input)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Status string          `json:"status"`
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// round sends every request to a running server, spreading them so that a request
+// rarely reaches the server that computed it; spaced changes the formatting of the
+// input without changing its value
+func (c *cluster) round(offset int, spaced bool) error {
+	live := c.live()
+	for key := 0; key < *numKeys; key++ {
+		input := fmt.Sprintf(`{"key":%d,"name":"k%d"}`, key, key)
+		if spaced {
+			input = fmt.Sprintf(`{ "name" : "k%d", "key" : %d }`, key, key)
+		}
+		result, err := send(live[(key+offset)%len(live)], input)
+		if err != nil {
+			return fmt.Errorf("request %d: %v", key, err)
+		}
+		var echoed struct {
+			Key int `json:"key"`
+		}
+		if json.Unmarshal(result, &echoed) != nil || echoed.Key != key {
+			return fmt.Errorf("request %d got the result %s", key, result)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if *numServers <= *replication {
+		log.Fatalf("More servers than the replication factor are needed")
+	}
+	c := &cluster{servers: make(map[int]*taskserver.Server)}
+	defer func() {
+		for _, id := range c.live() {
+			c.stop(id)
+		}
+	}()
+
+	failed := false
+	// step runs a round and checks how many results had to be computed
+	step := func(description string, offset int, spaced bool, computed int64) {
+		fmt.Println(description)
+		if err := c.waitForMembers(); err != nil {
+			fmt.Printf("FAIL: %v\n\n", err)
+			failed = true
+			return
+		}
+		before := executions.Load()
+		if err := c.round(offset, spaced); err != nil {
+			fmt.Printf("FAIL: %v\n\n", err)
+			failed = true
+			return
+		}
+		if got := executions.Load() - before; got != computed {
+			fmt.Printf("FAIL: %d results computed, expected %d\n\n", got, computed)
+			failed = true
+			return
+		}
+		fmt.Printf("OK: %d results computed, %d served from the cache\n\n", computed, int64(*numKeys)-computed)
+	}
+
+	c.start(1)
+	for id := 2; id <= *numServers; id++ {
+		c.start(id, 1)
+	}
+	step(fmt.Sprintf("Started %d servers, every result is computed once", *numServers), 0, false, int64(*numKeys))
+	step("Same requests on other servers, formatted differently", 1, true, 0)
+
+	// the replicas still hold the results of the server that left
+	c.stop(1)
+	step("server1 left", 0, false, 0)
+
+	// only the copies handed off after server1 left remain for its keys
+	c.stop(2)
+	step("server2 left", 1, false, 0)
+
+	newID := *numServers + 1
+	c.start(newID, *numServers)
+	step(fmt.Sprintf("Started %s, it receives the results it owns now", name(newID)), 2, true, 0)
+
+	// every result now lives on the owners it has in the final ring, the other servers
+	// have dropped their copies
+	c.stop(newID - 1)
+	step(fmt.Sprintf("%s left", name(newID-1)), 0, false, 0)
+
+	if failed {
+		fmt.Println("Cache checks failed")
+		for _, id := range c.live() {
+			c.stop(id)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("All cache checks passed")
+}
@@ -14,17 +14,45 @@ import (
 // number of clients to run concurrently
 const NUM_CLIENTS = 100
 
+// server address used without a registry, use "unix" and the socket path to connect through the local socket
+const SERVER_NETWORK = "tcp"
+const SERVER_ADDRESS = "localhost:8080"
+
+// attempts made for a request before giving up, retries reuse the idempotency key
+const MAX_ATTEMPTS = 3
+
 // JSON structures must match those in the server and in the file
 type GenericRequest struct {
 	TaskNumber int             `json:"task"`
 	Input      json.RawMessage `json:"input"`
 	ClientID   int             `json:"client_id"`
+	TraceID    string          `json:"trace_id,omitempty"`
+	SpanID     string          `json:"span_id,omitempty"`
+
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	RequestID      string `json:"request_id,omitempty"`
+
+	// used by the "hello" handshake
+	Op        string `json:"op,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
 }
 
 type GenericResponse struct {
-	Status string          `json:"status"`
-	Result json.RawMessage `json:"result,omitempty"`
-	Error  string          `json:"error,omitempty"`
+	Status  string          `json:"status"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Code    string          `json:"code,omitempty"`
+	TraceID string          `json:"trace_id,omitempty"`
+
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// result of the "hello" handshake, the server assigns the session and the client id
+type helloResult struct {
+	SessionID string            `json:"session_id"`
+	ClientID  int               `json:"client_id"`
+	Resumed   bool              `json:"resumed"`
+	Pending   []GenericResponse `json:"pending,omitempty"`
 }
 
 // running client instance
@@ -32,12 +60,56 @@ func runSingleClient(clientID int, wg *sync.WaitGroup, requestToSend GenericRequ
 	// waitgroup done at the end
 	defer wg.Done()
 
-	// server connection
-	conn, err := net.DialTimeout("tcp", "localhost:8080", 2*time.Second)
+	// starting a trace, the server continues it with its own spans
+	span := startSpan(clientID, requestToSend.TaskNumber)
+	spanError := "incomplete request"
+	defer func() { finishSpan(span, spanError) }()
+
+	// adding client ID, trace context and idempotency key to the request
+	requestToSend.ClientID = clientID
+	requestToSend.TraceID = span.TraceID
+	requestToSend.SpanID = span.SpanID
+	requestToSend.IdempotencyKey = span.SpanID
+	requestToSend.RequestID = span.SpanID
+
+	// the server is chosen once, a session can only be resumed on the server that created it
+	network, address := resolveServer(clientID, requestToSend.TaskNumber)
+
+	// retrying on connection errors, the server runs the task only once and a resumed
+	// session returns the response if it completed after the connection was lost
+	var resp GenericResponse
+	var err error
+	sessionID := ""
+	for attempt := 1; attempt <= MAX_ATTEMPTS; attempt++ {
+		resp, err = sendRequest(clientID, network, address, &sessionID, requestToSend)
+		if err == nil {
+			break
+		}
+		fmt.Printf("[Client %d] Attempt %d failed: %v\n", clientID, attempt, err)
+		time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+	}
 	if err != nil {
-		fmt.Printf("[Client %d] Error: %v", clientID, err)
 		return
 	}
+
+	spanError = resp.Error
+	if resp.Status == "success" {
+		fmt.Printf("[Client %d] <- Success: %s\n\n", clientID, string(resp.Result))
+	} else {
+		fmt.Printf("[Client %d] <- Error response: %s\n\n", clientID, resp.Error)
+	}
+}
+
+// sendRequest opens a session on a new connection, resuming sessionID if set, then
+// sends the request and waits for the response
+func sendRequest(clientID int, network, address string, sessionID *string, requestToSend GenericRequest) (GenericResponse, error) {
+	var resp GenericResponse
+
+	// server connection
+	conn, err := net.DialTimeout(network, address, 2*time.Second)
+	if err != nil {
+		return resp, err
+	}
 	defer conn.Close()
 
 	// reading and ignoring the welcome message
@@ -45,41 +117,67 @@ func runSingleClient(clientID int, wg *sync.WaitGroup, requestToSend GenericRequ
 	reader := bufio.NewReader(conn)
 	welcomeMessage, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Printf("[Client %d] Error reading welcome message: %v", clientID, err)
-		return
+		return resp, fmt.Errorf("reading welcome message: %w", err)
 	}
 	log.Printf("[Client %d] %s", clientID, welcomeMessage)
 
-	// adding client ID to the request
-	requestToSend.ClientID = clientID
+	// starting or resuming the session
+	hello, err := json.Marshal(GenericRequest{Op: "hello", SessionID: *sessionID})
+	if err != nil {
+		return resp, err
+	}
+	fmt.Fprintf(conn, "%s\n", hello)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	helloJson, err := reader.ReadString('\n')
+	if err != nil {
+		return resp, fmt.Errorf("reading hello response: %w", err)
+	}
+	var helloResp GenericResponse
+	var session helloResult
+	if err := json.Unmarshal([]byte(helloJson), &helloResp); err != nil {
+		return resp, fmt.Errorf("decoding hello response: %w", err)
+	}
+	switch {
+	case helloResp.Code == "unknown_op":
+		// the proxy balances single requests and has no sessions
+		log.Printf("[Client %d] Server without sessions, continuing without one", clientID)
+	case helloResp.Status != "success":
+		return resp, fmt.Errorf("hello rejected: %s", helloResp.Error)
+	default:
+		if err := json.Unmarshal(helloResp.Result, &session); err != nil {
+			return resp, fmt.Errorf("decoding hello result: %w", err)
+		}
+		*sessionID = session.SessionID
+		log.Printf("[Client %d] Session %s, server client id %d, resumed %t", clientID, session.SessionID, session.ClientID, session.Resumed)
+	}
+
+	// the response may have arrived while the client was disconnected
+	for _, pending := range session.Pending {
+		if pending.RequestID == requestToSend.RequestID {
+			return pending, nil
+		}
+	}
 
 	// encoding the request to JSON
 	requestJson, err := json.Marshal(requestToSend)
 	if err != nil {
-		fmt.Printf("[Client %d] Error encoding request: %v", clientID, err)
-		return
+		return resp, fmt.Errorf("encoding request: %w", err)
 	}
 
 	// sending the request
 	fmt.Fprintf(conn, "%s\n", requestJson)
-	fmt.Printf("[Client %d] -> Requested task #%d\n", clientID, requestToSend.TaskNumber)
+	fmt.Printf("[Client %d] -> Requested task #%d (trace %s)\n", clientID, requestToSend.TaskNumber, requestToSend.TraceID)
 
 	// waiting for the response
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	responseJson, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Printf("[Client %d] <- Error reading response: %v", clientID, err)
-		return
+		return resp, fmt.Errorf("reading response: %w", err)
 	}
 
 	// decode the response
-	var resp GenericResponse
-	json.Unmarshal([]byte(responseJson), &resp)
-
-	if resp.Status == "success" {
-		fmt.Printf("[Client %d] <- Success: %s\n\n", clientID, string(resp.Result))
-	} else {
-		fmt.Printf("[Client %d] <- Error response: %s\n\n", clientID, resp.Error)
-	}
+	err = json.Unmarshal([]byte(responseJson), &resp)
+	return resp, err
 }
 
 func main() {
@@ -138,4 +236,9 @@ func main() {
 	log.Println("Waiting for all clients to finish...")
 	wg.Wait()
 	log.Println("All clients have finished.")
+
+	// exporting the client side of the traces
+	if err := writeSpans(); err != nil {
+		log.Printf("Error writing traces: %v", err)
+	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// service registry the servers register with, empty to always use SERVER_ADDRESS
+const REGISTRY_ADDRESS = "localhost:7100"
+const SERVICE_NAME = "tema1"
+
+// JSON structures must match those in the registry
+type registryRequest struct {
+	Op      string `json:"op"`
+	Service string `json:"service"`
+	Task    int    `json:"task"`
+}
+
+type serverInstance struct {
+	ID          string `json:"id"`
+	Address     string `json:"address"`
+	Load        int64  `json:"load"`
+	Connections int64  `json:"connections"`
+}
+
+// resolveServer returns the address of a server running the task, falling back to
+// SERVER_ADDRESS when there is no registry or it cannot be reached
+func resolveServer(clientID, task int) (network, address string) {
+	if REGISTRY_ADDRESS == "" {
+		return SERVER_NETWORK, SERVER_ADDRESS
+	}
+	instances, err := lookupInstances(task)
+	if err == nil && len(instances) == 0 {
+		err = errors.New("no instance registered")
+	}
+	if err != nil {
+		log.Printf("[Client %d] Registry lookup failed (%v), using %s", clientID, err, SERVER_ADDRESS)
+		return SERVER_NETWORK, SERVER_ADDRESS
+	}
+	instance := pickInstance(instances)
+	log.Printf("[Client %d] Resolved %s to %s (%s)", clientID, SERVICE_NAME, instance.ID, instance.Address)
+	return "tcp", instance.Address
+}
+
+// lookupInstances asks the registry for the live servers running the task
+func lookupInstances(task int) ([]serverInstance, error) {
+	conn, err := net.DialTimeout("tcp", REGISTRY_ADDRESS, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request, _ := json.Marshal(registryRequest{Op: "lookup", Service: SERVICE_NAME, Task: task})
+	if _, err := conn.Write(append(request, '\n')); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var resp GenericResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("lookup rejected: %s", resp.Error)
+	}
+	var instances []serverInstance
+	err = json.Unmarshal(resp.Result, &instances)
+	return instances, err
+}
+
+// pickInstance chooses randomly among the least busy instances, so clients
+// starting together do not all pick the same one
+func pickInstance(instances []serverInstance) serverInstance {
+	busy := func(in serverInstance) int64 { return in.Connections + in.Load }
+	least := instances[:0:0]
+	for _, in := range instances {
+		switch {
+		case len(least) == 0 || busy(in) < busy(least[0]):
+			least = []serverInstance{in}
+		case busy(in) == busy(least[0]):
+			least = append(least, in)
+		}
+	}
+	return least[rand.Intn(len(least))]
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// file receiving the client spans in OTLP JSON, empty to disable the export
+const TRACE_FILE = "client_traces.jsonl"
+
+// client span of a single request, the server spans are its children
+type clientSpan struct {
+	TraceID  string
+	SpanID   string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	ClientID int
+	Task     int
+	Error    string
+}
+
+// spans collected from all clients, written once at the end
+var (
+	spansMutex sync.Mutex
+	spans      []clientSpan
+)
+
+// startSpan starts a new trace for a request
+func startSpan(clientID int, task int) clientSpan {
+	return clientSpan{
+		TraceID:  randomHex(16),
+		SpanID:   randomHex(8),
+		Name:     fmt.Sprintf("client request task %d", task),
+		Start:    time.Now(),
+		ClientID: clientID,
+		Task:     task,
+	}
+}
+
+// finishSpan records the end of a span
+func finishSpan(span clientSpan, errorMsg string) {
+	span.End = time.Now()
+	span.Error = errorMsg
+	spansMutex.Lock()
+	spans = append(spans, span)
+	spansMutex.Unlock()
+}
+
+// writeSpans appends the collected spans to TRACE_FILE as one OTLP ExportTraceServiceRequest
+func writeSpans() error {
+	if TRACE_FILE == "" || len(spans) == 0 {
+		return nil
+	}
+
+	type attribute struct {
+		Key   string            `json:"key"`
+		Value map[string]string `json:"value"`
+	}
+	otlpSpans := make([]map[string]any, 0, len(spans))
+	for _, span := range spans {
+		status := map[string]any{"code": 1}
+		if span.Error != "" {
+			status = map[string]any{"code": 2, "message": span.Error}
+		}
+		otlpSpans = append(otlpSpans, map[string]any{
+			"traceId":           span.TraceID,
+			"spanId":            span.SpanID,
+			"name":              span.Name,
+			"kind":              3, // client
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes": []attribute{
+				{Key: "client_id", Value: map[string]string{"stringValue": strconv.Itoa(span.ClientID)}},
+				{Key: "task", Value: map[string]string{"stringValue": strconv.Itoa(span.Task)}},
+			},
+			"status": status,
+		})
+	}
+	export := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []attribute{{Key: "service.name", Value: map[string]string{"stringValue": "tema1-multiclient"}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "tema1"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+
+	line, err := json.Marshal(export)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(TRACE_FILE, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
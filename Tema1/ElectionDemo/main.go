@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/election"
+)
+
+// ElectionDemo runs several election nodes in this process, kills leaders and checks
+// that the highest live node is elected every time with a higher term; it exits with
+// status 1 if a check fails
+
+var (
+	numNodes  = flag.Int("nodes", 5, "number of nodes")
+	basePort  = flag.Int("base-port", 7300, "node i listens on base-port+i")
+	heartbeat = flag.Duration("heartbeat", 200*time.Millisecond, "leader heartbeat interval")
+	verbose   = flag.Bool("v", false, "show the logs of the nodes")
+)
+
+// cluster holds the running nodes by ID, a stopped node is nil
+type cluster struct {
+	peers []election.Peer
+	nodes map[int]*election.Node
+}
+
+func (c *cluster) start(id int) {
+	var peers []election.Peer
+	var address string
+	for _, peer := range c.peers {
+		if peer.ID == id {
+			address = peer.Address
+		} else {
+			peers = append(peers, peer)
+		}
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	node, err := election.New(election.Config{
+		ID:                id,
+		Address:           address,
+		Peers:             peers,
+		HeartbeatInterval: *heartbeat,
+		Logger:            slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+		OnLeaderChange: func(leader int, term uint64) {
+			fmt.Printf("  node %d: leader is %d in term %d\n", id, leader, term)
+		},
+	})
+	if err != nil {
+		log.Fatalf("Error creating node %d: %v", id, err)
+	}
+	if err := node.Start(); err != nil {
+		log.Fatalf("Error starting node %d: %v", id, err)
+	}
+	c.nodes[id] = node
+}
+
+func (c *cluster) kill(id int) {
+	c.nodes[id].Stop()
+	c.nodes[id] = nil
+}
+
+// waitForLeader waits until every live node agrees that expected leads, in a term
+// after minTerm, and only expected considers itself the leader
+func (c *cluster) waitForLeader(expected int, minTerm uint64) (uint64, error) {
+	deadline := time.Now().Add(20 * *heartbeat)
+	for {
+		term, err := c.agreed(expected, minTerm)
+		if err == nil {
+			return term, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, err
+		}
+		time.Sleep(*heartbeat / 4)
+	}
+}
+
+func (c *cluster) agreed(expected int, minTerm uint64) (uint64, error) {
+	var agreedTerm uint64
+	leaders := 0
+	for id, node := range c.nodes {
+		if node == nil {
+			continue
+		}
+		leader, term := node.Leader()
+		if leader != expected {
+			return 0, fmt.Errorf("node %d sees leader %d, expected %d", id, leader, expected)
+		}
+		if agreedTerm != 0 && term != agreedTerm {
+			return 0, fmt.Errorf("nodes disagree on the term, %d and %d", agreedTerm, term)
+		}
+		agreedTerm = term
+		if node.IsLeader() {
+			leaders++
+		}
+	}
+	if leaders != 1 {
+		return 0, fmt.Errorf("%d nodes consider themselves the leader", leaders)
+	}
+	if agreedTerm <= minTerm {
+		return 0, fmt.Errorf("term %d did not advance past %d", agreedTerm, minTerm)
+	}
+	return agreedTerm, nil
+}
+
+func main() {
+	flag.Parse()
+	if *numNodes < 3 {
+		log.Fatalf("At least 3 nodes are needed")
+	}
+
+	c := &cluster{nodes: make(map[int]*election.Node)}
+	for id := 1; id <= *numNodes; id++ {
+		c.peers = append(c.peers, election.Peer{ID: id, Address: fmt.Sprintf("127.0.0.1:%d", *basePort+id)})
+	}
+
+	failed := false
+	step := func(description string, expected int, minTerm uint64) uint64 {
+		fmt.Printf("%s, expecting node %d to lead\n", description, expected)
+		term, err := c.waitForLeader(expected, minTerm)
+		if err != nil {
+			fmt.Printf("FAIL: %v\n\n", err)
+			failed = true
+			return minTerm
+		}
+		fmt.Printf("OK: node %d leads in term %d\n\n", expected, term)
+		return term
+	}
+
+	highest := *numNodes
+	for id := 1; id <= highest; id++ {
+		c.start(id)
+	}
+	term := step(fmt.Sprintf("Started %d nodes", highest), highest, 0)
+
+	c.kill(highest)
+	term = step(fmt.Sprintf("Killed leader %d", highest), highest-1, term)
+
+	c.kill(highest - 1)
+	term = step(fmt.Sprintf("Killed leader %d", highest-1), highest-2, term)
+
+	c.kill(1)
+	term = step("Killed follower 1", highest-2, term-1)
+
+	c.start(highest)
+	step(fmt.Sprintf("Restarted node %d", highest), highest, term)
+
+	for _, node := range c.nodes {
+		if node != nil {
+			node.Stop()
+		}
+	}
+	if failed {
+		fmt.Println("Leader election checks failed")
+		os.Exit(1)
+	}
+	fmt.Println("All leader election checks passed")
+}
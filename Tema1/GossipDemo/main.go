@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/gossip"
+)
+
+// GossipDemo runs several gossip nodes in this process, crashes, removes, restarts and
+// adds nodes, splits the cluster in two and heals it, and checks that every live node
+// converges to the expected membership view; it exits with status 1 if a check fails
+
+var (
+	numNodes = flag.Int("nodes", 5, "number of nodes started at first")
+	basePort = flag.Int("base-port", 7500, "node i listens on udp base-port+i")
+	interval = flag.Duration("probe-interval", 200*time.Millisecond, "time between probes")
+	verbose  = flag.Bool("v", false, "show the logs of the nodes")
+)
+
+// suspicions counts the members any node suspected
+var suspicions atomic.Int64
+
+// cluster holds the running nodes by name, a stopped node is nil
+type cluster struct {
+	nodes map[string]*gossip.Node
+}
+
+func name(id int) string {
+	return fmt.Sprintf("node%d", id)
+}
+
+func address(id int) string {
+	return fmt.Sprintf("127.0.0.1:%d", *basePort+id)
+}
+
+func (c *cluster) start(id int, seeds ...int) {
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	var seedAddresses []string
+	for _, seed := range seeds {
+		seedAddresses = append(seedAddresses, address(seed))
+	}
+	node, err := gossip.New(gossip.Config{
+		Name:          name(id),
+		BindAddress:   address(id),
+		Seeds:         seedAddresses,
+		Meta:          map[string]string{"client_address": fmt.Sprintf("localhost:%d", 8080+id)},
+		ProbeInterval: *interval,
+		Logger:        slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+		OnChange: func(event gossip.Event) {
+			previous := event.Previous
+			if previous == "" {
+				previous = "unknown"
+			}
+			fmt.Printf("  %s: %s %s -> %s\n", name(id), event.Member.Name, previous, event.Member.State)
+			if event.Member.State == gossip.Suspect {
+				suspicions.Add(1)
+			}
+		},
+	})
+	if err != nil {
+		log.Fatalf("Error creating %s: %v", name(id), err)
+	}
+	if err := node.Start(); err != nil {
+		log.Fatalf("Error starting %s: %v", name(id), err)
+	}
+	c.nodes[name(id)] = node
+}
+
+// waitForView waits until every live node sees the expected state of each member
+func (c *cluster) waitForView(expected map[string]string, timeout time.Duration) error {
+	return c.waitForViewOf(nil, expected, timeout)
+}
+
+// waitForViewOf waits until the given live nodes, or all of them if observers is nil, see
+// the expected state of each member
+func (c *cluster) waitForViewOf(observers []string, expected map[string]string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := c.viewMatches(observers, expected)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(*interval / 4)
+	}
+}
+
+func (c *cluster) viewMatches(observers []string, expected map[string]string) error {
+	for observer, node := range c.nodes {
+		if node == nil || observers != nil && !slices.Contains(observers, observer) {
+			continue
+		}
+		states := make(map[string]string)
+		for _, member := range node.Members() {
+			states[member.Name] = member.State
+		}
+		for member, state := range expected {
+			if states[member] != state {
+				return fmt.Errorf("%s sees %s as %q, expected %s", observer, member, states[member], state)
+			}
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if *numNodes < 4 {
+		log.Fatalf("At least 4 nodes are needed")
+	}
+	c := &cluster{nodes: make(map[string]*gossip.Node)}
+	expected := make(map[string]string)
+
+	failed := false
+	step := func(description string, timeout time.Duration) {
+		fmt.Println(description)
+		start := time.Now()
+		if err := c.waitForView(expected, timeout); err != nil {
+			fmt.Printf("FAIL: %v\n\n", err)
+			failed = true
+			return
+		}
+		fmt.Printf("OK: every node agrees after %v\n\n", time.Since(start).Round(time.Millisecond))
+	}
+	// a crashed member is found within a probe round, then suspected for SuspicionTimeout
+	detection := time.Duration(*numNodes+5) * *interval * 3
+
+	c.start(1)
+	expected[name(1)] = gossip.Alive
+	for id := 2; id <= *numNodes; id++ {
+		c.start(id, 1)
+		expected[name(id)] = gossip.Alive
+	}
+	step(fmt.Sprintf("Started %d nodes joining through %s", *numNodes, name(1)), detection)
+
+	// the members still reach each other through the others, the indirect probes succeed
+	c.nodes[name(1)].Isolate(name(2))
+	c.nodes[name(2)].Isolate(name(1))
+	fmt.Printf("Broke the link between node1 and node2 for %v\n", detection)
+	before := suspicions.Load()
+	time.Sleep(detection)
+	c.nodes[name(1)].Heal()
+	c.nodes[name(2)].Heal()
+	if suspected := suspicions.Load() - before; suspected != 0 {
+		fmt.Printf("FAIL: %d suspicions while the link was broken\n\n", suspected)
+		failed = true
+	} else {
+		fmt.Printf("OK: the indirect probes kept node1 and node2 alive\n\n")
+	}
+
+	c.nodes[name(3)].Stop()
+	c.nodes[name(3)] = nil
+	expected[name(3)] = gossip.Dead
+	step("Crashed node3", detection)
+
+	c.nodes[name(4)].Leave()
+	c.nodes[name(4)] = nil
+	expected[name(4)] = gossip.Left
+	step("node4 left the cluster", detection)
+
+	c.start(3, 2)
+	expected[name(3)] = gossip.Alive
+	step("Restarted node3 joining through node2", detection)
+
+	newID := *numNodes + 1
+	c.start(newID, *numNodes)
+	expected[name(newID)] = gossip.Alive
+	step(fmt.Sprintf("Started %s joining through %s", name(newID), name(*numNodes)), detection)
+
+	// a full partition: each side declares the other dead, and no seed brings them together
+	// since each side still has live members
+	var minority, majority []string
+	for observer, node := range c.nodes {
+		if node == nil {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, observer)
+		} else {
+			majority = append(majority, observer)
+		}
+	}
+	for _, observer := range minority {
+		c.nodes[observer].Isolate(majority...)
+	}
+	for _, observer := range majority {
+		c.nodes[observer].Isolate(minority...)
+	}
+	fmt.Printf("Split the cluster into %v and %v\n", minority, majority)
+	for _, side := range [][]string{minority, majority} {
+		view := maps.Clone(expected)
+		for _, member := range slices.Concat(minority, majority) {
+			if !slices.Contains(side, member) {
+				view[member] = gossip.Dead
+			}
+		}
+		if err := c.waitForViewOf(side, view, detection); err != nil {
+			fmt.Printf("FAIL: %v\n\n", err)
+			failed = true
+		}
+	}
+	if !failed {
+		fmt.Printf("OK: each side declared the other dead\n\n")
+	}
+	for _, node := range c.nodes {
+		if node != nil {
+			node.Heal()
+		}
+	}
+	step("Healed the partition", detection)
+
+	for _, node := range c.nodes {
+		if node != nil {
+			node.Stop()
+		}
+	}
+	if failed {
+		fmt.Println("Membership checks failed")
+		os.Exit(1)
+	}
+	fmt.Println("All membership checks passed")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// JobClient submits jobs to the replicated job queue, or reads their status, following
+// the redirections of the followers to the leader
+//
+//	JobClient -task 1 -input '["casa","masa"]'
+//	JobClient -status 4
+
+var (
+	servers = flag.String("servers", "localhost:8181,localhost:8182,localhost:8183", "comma separated replicas of the job queue")
+	task    = flag.Int("task", 0, "task number of the job to submit")
+	input   = flag.String("input", "null", "JSON input of the job to submit")
+	status  = flag.Int("status", 0, "id of the job to read instead of submitting one")
+	token   = flag.String("token", "", "auth token, for listeners that require one")
+	wait    = flag.Bool("wait", false, "after submitting, wait until the job is completed")
+)
+
+type request struct {
+	Op         string          `json:"op"`
+	TaskNumber int             `json:"task,omitempty"`
+	Input      json.RawMessage `json:"input,omitempty"`
+	AuthToken  string          `json:"auth_token,omitempty"`
+}
+
+type response struct {
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Code   string          `json:"code,omitempty"`
+}
+
+type job struct {
+	ID     int    `json:"job_id"`
+	Status string `json:"status"`
+}
+
+// maximum number of servers tried for a request
+const maxHops = 10
+
+// send tries the servers in turn, jumping to the leader when a follower names it
+func send(req request) (response, error) {
+	candidates := strings.Split(*servers, ",")
+	next := 0
+	address := candidates[0]
+	var lastErr error
+	for hop := 0; hop < maxHops; hop++ {
+		resp, err := sendTo(address, req)
+		if err == nil && resp.Code != "not_leader" {
+			return resp, nil
+		}
+
+		var redirect struct {
+			LeaderAddress string `json:"leader_address"`
+		}
+		if err == nil {
+			json.Unmarshal(resp.Result, &redirect)
+			err = fmt.Errorf("%s: %s", address, resp.Error)
+		}
+		lastErr = err
+		if redirect.LeaderAddress != "" && redirect.LeaderAddress != address {
+			fmt.Printf("Redirected from %s to the leader at %s\n", address, redirect.LeaderAddress)
+			address = redirect.LeaderAddress
+			continue
+		}
+		if resp.Code == "not_leader" && redirect.LeaderAddress == "" {
+			// no leader yet, an election is probably running
+			time.Sleep(500 * time.Millisecond)
+		}
+		next++
+		address = candidates[next%len(candidates)]
+	}
+	return response{}, lastErr
+}
+
+// sendTo sends a request on a new connection, authenticating first if a token is given
+func sendTo(address string, req request) (response, error) {
+	var resp response
+	conn, err := net.DialTimeout("tcp", address, 3*time.Second)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil { // welcome line
+		return resp, err
+	}
+
+	requests := []request{req}
+	if *token != "" {
+		requests = []request{{Op: "auth", AuthToken: *token}, req}
+	}
+	for _, r := range requests {
+		encoded, _ := json.Marshal(r)
+		if _, err := conn.Write(append(encoded, '\n')); err != nil {
+			return resp, err
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return resp, err
+		}
+		resp = response{}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return resp, err
+		}
+		if resp.Status != "success" && r.Op == "auth" {
+			return resp, fmt.Errorf("authentication failed: %s", resp.Error)
+		}
+	}
+	return resp, nil
+}
+
+func readStatus(id int) response {
+	resp, err := send(request{Op: "job_status", Input: json.RawMessage(fmt.Sprintf(`{"job_id":%d}`, id))})
+	if err != nil {
+		log.Fatalf("Error reading job %d: %v", id, err)
+	}
+	return resp
+}
+
+func printResponse(resp response) {
+	if resp.Status != "success" {
+		fmt.Printf("Error (%s): %s\n", resp.Code, resp.Error)
+		os.Exit(1)
+	}
+	fmt.Println(string(resp.Result))
+}
+
+func main() {
+	flag.Parse()
+	if *status > 0 {
+		printResponse(readStatus(*status))
+		return
+	}
+	if *task == 0 {
+		log.Fatalf("Either -task or -status is required")
+	}
+	if !json.Valid([]byte(*input)) {
+		log.Fatalf("-input is not valid JSON")
+	}
+
+	resp, err := send(request{Op: "submit_job", TaskNumber: *task, Input: json.RawMessage(*input)})
+	if err != nil {
+		log.Fatalf("Error submitting the job: %v", err)
+	}
+	printResponse(resp)
+	if !*wait {
+		return
+	}
+
+	var submitted job
+	json.Unmarshal(resp.Result, &submitted)
+	for {
+		resp = readStatus(submitted.ID)
+		var current job
+		json.Unmarshal(resp.Result, &current)
+		if resp.Status != "success" || current.Status != "pending" {
+			printResponse(resp)
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
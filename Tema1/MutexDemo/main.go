@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/mutex"
+)
+
+// MutexDemo runs several lock nodes in this process, has all of them compete for the
+// same lock, times out a request while another node holds the lock and crashes a node,
+// checking that the lock is never held twice; it exits with status 1 if a check fails
+
+var (
+	numNodes = flag.Int("nodes", 4, "number of nodes")
+	basePort = flag.Int("base-port", 7450, "node i listens on base-port+i")
+	rounds   = flag.Int("rounds", 20, "critical sections entered by every worker")
+	workers  = flag.Int("workers", 2, "goroutines of every node competing for the lock")
+	verbose  = flag.Bool("v", false, "show the logs of the nodes")
+)
+
+// the lock the nodes compete for
+const lockName = "shared-file"
+
+// cluster holds the running nodes by ID, a stopped node is nil
+type cluster struct {
+	peers []mutex.Peer
+	nodes map[int]*mutex.Node
+}
+
+func (c *cluster) start(id int) {
+	var peers []mutex.Peer
+	var address string
+	for _, peer := range c.peers {
+		if peer.ID == id {
+			address = peer.Address
+		} else {
+			peers = append(peers, peer)
+		}
+	}
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	node, err := mutex.New(mutex.Config{
+		ID:      id,
+		Address: address,
+		Peers:   peers,
+		Logger:  slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+	})
+	if err != nil {
+		log.Fatalf("Error creating node %d: %v", id, err)
+	}
+	if err := node.Start(); err != nil {
+		log.Fatalf("Error starting node %d: %v", id, err)
+	}
+	c.nodes[id] = node
+}
+
+// contend has the workers of every live node enter the critical section, it returns
+// the number of times two holders overlapped
+func (c *cluster) contend() (entries int64, overlaps int64, err error) {
+	var holders atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, len(c.nodes)**workers)
+	for id, node := range c.nodes {
+		if node == nil {
+			continue
+		}
+		for w := 0; w < *workers; w++ {
+			wg.Add(1)
+			go func(id int, node *mutex.Node) {
+				defer wg.Done()
+				for i := 0; i < *rounds; i++ {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					err := node.Acquire(ctx, lockName)
+					cancel()
+					if err != nil {
+						errs <- fmt.Errorf("node %d: %v", id, err)
+						return
+					}
+					if holders.Add(1) > 1 {
+						atomic.AddInt64(&overlaps, 1)
+					}
+					atomic.AddInt64(&entries, 1)
+					time.Sleep(time.Millisecond)
+					holders.Add(-1)
+					node.Release(lockName)
+				}
+			}(id, node)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	return entries, overlaps, <-errs
+}
+
+func main() {
+	flag.Parse()
+	if *numNodes < 3 {
+		log.Fatalf("At least 3 nodes are needed")
+	}
+	c := &cluster{nodes: make(map[int]*mutex.Node)}
+	for id := 1; id <= *numNodes; id++ {
+		c.peers = append(c.peers, mutex.Peer{ID: id, Address: fmt.Sprintf("127.0.0.1:%d", *basePort+id)})
+	}
+	for id := 1; id <= *numNodes; id++ {
+		c.start(id)
+	}
+
+	failed := false
+	check := func(ok bool, format string, args ...any) {
+		if ok {
+			fmt.Printf("OK: "+format+"\n\n", args...)
+			return
+		}
+		fmt.Printf("FAIL: "+format+"\n\n", args...)
+		failed = true
+	}
+	contend := func(description string) {
+		fmt.Println(description)
+		start := time.Now()
+		entries, overlaps, err := c.contend()
+		if err != nil {
+			check(false, "%v", err)
+			return
+		}
+		check(overlaps == 0, "%d critical sections in %v, %d overlapping", entries, time.Since(start).Round(time.Millisecond), overlaps)
+	}
+
+	contend(fmt.Sprintf("%d nodes with %d workers each competing for the lock", *numNodes, *workers))
+
+	fmt.Println("node 1 holds the lock, node 2 asks for it with a 300ms timeout")
+	if err := c.nodes[1].Acquire(context.Background(), lockName); err != nil {
+		log.Fatalf("node 1: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	err := c.nodes[2].Acquire(ctx, lockName)
+	cancel()
+	check(errors.Is(err, context.DeadlineExceeded), "the request timed out: %v", err)
+
+	fmt.Println("node 1 releases the lock, node 2 asks again")
+	c.nodes[1].Release(lockName)
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	err = c.nodes[2].Acquire(ctx, lockName)
+	cancel()
+	check(err == nil, "node 2 got the lock: %v", err)
+	c.nodes[2].Release(lockName)
+
+	// a crashed node refuses the connections, the others stop waiting for its replies
+	c.nodes[3].Stop()
+	c.nodes[3] = nil
+	contend("Crashed node 3, the others keep competing")
+
+	for _, node := range c.nodes {
+		if node != nil {
+			node.Stop()
+		}
+	}
+	if failed {
+		fmt.Println("Mutual exclusion checks failed")
+		os.Exit(1)
+	}
+	fmt.Println("All mutual exclusion checks passed")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backend is a task server the proxy forwards requests to
+type backend struct {
+	address string
+
+	outstanding atomic.Int64  // requests sent and not answered yet
+	requests    atomic.Uint64 // requests answered by the backend
+	errors      atomic.Uint64 // failed forwarding attempts
+	ejections   atomic.Uint64
+	latencyUs   atomic.Uint64 // total time of the answered requests
+
+	mu           sync.Mutex
+	failures     int       // consecutive failed attempts
+	ejectedUntil time.Time // no requests are sent before this time
+
+	idle chan *backendConn // connections ready for the next request
+}
+
+// backendConn is a connection to a backend, past its welcome message
+type backendConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// idle connections kept for every backend
+const backendPoolSize = 32
+
+func newBackend(address string) *backend {
+	return &backend{address: address, idle: make(chan *backendConn, backendPoolSize)}
+}
+
+// available reports whether the backend may receive requests
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.ejectedUntil)
+}
+
+// succeeded resets the failure count of the backend
+func (b *backend) succeeded(latency time.Duration) {
+	b.requests.Add(1)
+	b.latencyUs.Add(uint64(latency.Microseconds()))
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+// failed counts a failed attempt, the backend is ejected after maxFailures in a row;
+// once the ejection ends a single failure ejects it again
+func (b *backend) failed(maxFailures int, ejectFor time.Duration) (ejected bool) {
+	b.errors.Add(1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures < maxFailures {
+		return false
+	}
+	b.failures = maxFailures - 1
+	b.ejectedUntil = time.Now().Add(ejectFor)
+	b.ejections.Add(1)
+	b.closeIdle()
+	return true
+}
+
+// roundTrip sends a request line and reads the response line; sent reports whether
+// the request may have reached the backend
+func (b *backend) roundTrip(line []byte, timeout time.Duration) (response []byte, sent bool, err error) {
+	bc := b.idleConn()
+	if bc == nil {
+		conn, err := net.DialTimeout("tcp", b.address, timeout)
+		if err != nil {
+			return nil, false, err
+		}
+		bc = &backendConn{conn: conn, reader: bufio.NewReader(conn)}
+		// the welcome message of the backend is not forwarded, the proxy sends its own
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := bc.reader.ReadSlice('\n'); err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+	}
+
+	bc.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := bc.conn.Write(line); err != nil {
+		bc.conn.Close()
+		return nil, false, err
+	}
+	response, err = bc.reader.ReadBytes('\n')
+	if err != nil {
+		bc.conn.Close()
+		return nil, true, err
+	}
+
+	select {
+	case b.idle <- bc:
+	default:
+		bc.conn.Close()
+	}
+	return response, true, nil
+}
+
+// idleConn returns a pooled connection the backend has not closed, nil if there is none
+func (b *backend) idleConn() *backendConn {
+	for {
+		select {
+		case bc := <-b.idle:
+			// backends close connections idle for too long, a short read shows it
+			bc.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+			if _, err := bc.reader.Peek(1); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					return bc
+				}
+			}
+			bc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// closeIdle closes the pooled connections
+func (b *backend) closeIdle() {
+	for {
+		select {
+		case bc := <-b.idle:
+			bc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// backendStats is a backend as shown by /stats
+type backendStats struct {
+	Address          string  `json:"address"`
+	Available        bool    `json:"available"`
+	Outstanding      int64   `json:"outstanding"`
+	Requests         uint64  `json:"requests"`
+	Errors           uint64  `json:"errors"`
+	Ejections        uint64  `json:"ejections"`
+	AverageLatencyMs float64 `json:"average_latency_ms"`
+}
+
+func (b *backend) stats() backendStats {
+	s := backendStats{
+		Address:     b.address,
+		Available:   b.available(time.Now()),
+		Outstanding: b.outstanding.Load(),
+		Requests:    b.requests.Load(),
+		Errors:      b.errors.Load(),
+		Ejections:   b.ejections.Load(),
+	}
+	if s.Requests > 0 {
+		s.AverageLatencyMs = float64(b.latencyUs.Load()) / float64(s.Requests) / 1000
+	}
+	return s
+}
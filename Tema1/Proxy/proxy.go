@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/hashring"
+)
+
+// balancing strategies
+const (
+	RoundRobin       = "round_robin"
+	LeastOutstanding = "least_outstanding"
+	ConsistentHash   = "consistent_hash" // on the client id, a client always reaches the same backend
+)
+
+// proxy configuration
+type Config struct {
+	Address        string   `json:"Address"` // tcp address clients connect to
+	WelcomeMessage string   `json:"WelcomeMessage"`
+	Backends       []string `json:"Backends"` // tcp addresses of the task servers
+	Strategy       string   `json:"Strategy"`
+	MaxMessageSize int      `json:"MaxMessageSize"`
+
+	ConnectionIdleTimeoutSeconds int `json:"ConnectionIdleTimeoutSeconds"`
+	BackendTimeoutSeconds        int `json:"BackendTimeoutSeconds"` // time a backend has to answer a request
+
+	// passive health checking, a backend failing MaxFailures requests in a row gets
+	// no requests for EjectSeconds
+	MaxFailures  int `json:"MaxFailures"`
+	EjectSeconds int `json:"EjectSeconds"`
+
+	// backends tried for a request, the next one only when the previous could not be reached
+	MaxAttempts int `json:"MaxAttempts"`
+
+	// address of the HTTP server exposing /stats and /metrics, empty to disable
+	HTTPAddress string `json:"HTTPAddress"`
+}
+
+func applyDefaults(config *Config) {
+	if config.Address == "" {
+		config.Address = "localhost:8000"
+	}
+	if config.WelcomeMessage == "" {
+		config.WelcomeMessage = "Connection successful!"
+	}
+	if config.Strategy == "" {
+		config.Strategy = RoundRobin
+	}
+	if config.MaxMessageSize == 0 {
+		config.MaxMessageSize = 1024
+	}
+	if config.ConnectionIdleTimeoutSeconds == 0 {
+		config.ConnectionIdleTimeoutSeconds = 60
+	}
+	if config.BackendTimeoutSeconds == 0 {
+		config.BackendTimeoutSeconds = 30
+	}
+	if config.MaxFailures == 0 {
+		config.MaxFailures = 3
+	}
+	if config.EjectSeconds == 0 {
+		config.EjectSeconds = 10
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 2
+	}
+}
+
+func validateConfig(config Config) error {
+	var problems []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+	check(len(config.Backends) > 0, "Backends must not be empty")
+	for _, address := range config.Backends {
+		_, _, err := net.SplitHostPort(address)
+		check(err == nil, "backend address %q is not host:port", address)
+	}
+	switch config.Strategy {
+	case RoundRobin, LeastOutstanding, ConsistentHash:
+	default:
+		check(false, "Strategy must be %s, %s or %s, got %q", RoundRobin, LeastOutstanding, ConsistentHash, config.Strategy)
+	}
+	check(config.MaxMessageSize >= 1, "MaxMessageSize must be at least 1")
+	check(config.ConnectionIdleTimeoutSeconds >= 1, "ConnectionIdleTimeoutSeconds must be at least 1")
+	check(config.BackendTimeoutSeconds >= 1, "BackendTimeoutSeconds must be at least 1")
+	check(config.MaxFailures >= 1 && config.EjectSeconds >= 1, "MaxFailures and EjectSeconds must be at least 1")
+	check(config.MaxAttempts >= 1, "MaxAttempts must be at least 1")
+	return errors.Join(problems...)
+}
+
+// the fields of a request the proxy needs, the line is forwarded with only the client scope added
+type proxiedRequest struct {
+	TaskNumber int    `json:"task"`
+	ClientID   int    `json:"client_id"`
+	Op         string `json:"op,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+type GenericResponse struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// error codes sent by the proxy itself
+const (
+	errInvalidJSON     = "invalid_json"
+	errUnknownOp       = "unknown_op"
+	errMessageTooLarge = "message_too_large"
+	errNoBackends      = "no_backends"
+	errBackendFailed   = "backend_failed"
+)
+
+type proxy struct {
+	config   Config
+	logger   *slog.Logger
+	backends []*backend
+	byAddr   map[string]*backend
+	ring     *hashring.Ring
+	next     atomic.Uint64 // round robin position
+
+	// the idempotency scope of a client is its connection to this proxy run, the backend
+	// connections are shared by the clients
+	instance string
+	lastConn atomic.Uint64
+
+	connections sync.WaitGroup
+	active      atomic.Int64
+}
+
+func newProxy(config Config, logger *slog.Logger) *proxy {
+	p := &proxy{config: config, logger: logger, byAddr: make(map[string]*backend), ring: hashring.New(0)}
+	p.instance = strconv.FormatInt(time.Now().UnixNano(), 36)
+	for _, address := range config.Backends {
+		b := newBackend(address)
+		p.backends = append(p.backends, b)
+		p.byAddr[address] = b
+	}
+	p.ring.Add(config.Backends...)
+	return p
+}
+
+// candidates returns the available backends in the order they should be tried
+func (p *proxy) candidates(req proxiedRequest) []*backend {
+	now := time.Now()
+	var ordered []*backend
+	switch p.config.Strategy {
+	case ConsistentHash:
+		// the next backends on the ring take over the clients of an ejected one
+		for _, address := range p.ring.GetN(strconv.Itoa(req.ClientID), len(p.backends)) {
+			ordered = append(ordered, p.byAddr[address])
+		}
+	case LeastOutstanding:
+		ordered = append(ordered, p.backends...)
+		// between equally busy backends the one that answered fewer requests spreads them evenly
+		less := func(a, b *backend) bool {
+			if a.outstanding.Load() != b.outstanding.Load() {
+				return a.outstanding.Load() < b.outstanding.Load()
+			}
+			return a.requests.Load() < b.requests.Load()
+		}
+		// insertion sort, the list is short
+		for i := 1; i < len(ordered); i++ {
+			for j := i; j > 0 && less(ordered[j], ordered[j-1]); j-- {
+				ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+			}
+		}
+	default:
+		start := int(p.next.Add(1) % uint64(len(p.backends)))
+		for i := range p.backends {
+			ordered = append(ordered, p.backends[(start+i)%len(p.backends)])
+		}
+	}
+
+	available := ordered[:0]
+	for _, b := range ordered {
+		if b.available(now) {
+			available = append(available, b)
+		}
+	}
+	return available
+}
+
+// encodeResponse returns the response line for an error of the proxy
+func encodeResponse(response GenericResponse) []byte {
+	encoded, _ := json.Marshal(response)
+	return append(encoded, '\n')
+}
+
+// forward sends a request line to the backends until one receives it, the response
+// line of the backend is returned unchanged
+func (p *proxy) forward(line []byte, req proxiedRequest, logger *slog.Logger) []byte {
+	timeout := time.Duration(p.config.BackendTimeoutSeconds) * time.Second
+	ejectFor := time.Duration(p.config.EjectSeconds) * time.Second
+
+	candidates := p.candidates(req)
+	if len(candidates) == 0 {
+		return encodeResponse(GenericResponse{Status: "error", Error: "No backend available", Code: errNoBackends, RequestID: req.RequestID})
+	}
+	for attempt, b := range candidates {
+		if attempt == p.config.MaxAttempts {
+			break
+		}
+
+		start := time.Now()
+		b.outstanding.Add(1)
+		response, sent, err := b.roundTrip(line, timeout)
+		b.outstanding.Add(-1)
+		if err == nil && !json.Valid(response) {
+			err = errors.New("invalid response from backend")
+		}
+		if err == nil {
+			b.succeeded(time.Since(start))
+			return response
+		}
+
+		logger.Warn("Error forwarding request", "backend", b.address, "error", err, "attempt", attempt+1)
+		if b.failed(p.config.MaxFailures, ejectFor) {
+			logger.Warn("Backend ejected", "backend", b.address, "seconds", p.config.EjectSeconds)
+		}
+		// a request that may have run is not sent to another backend, the idempotency
+		// store of that backend does not know its key and would run it again
+		if sent {
+			break
+		}
+	}
+	return encodeResponse(GenericResponse{Status: "error", Error: "Backend failed to answer", Code: errBackendFailed, RequestID: req.RequestID})
+}
+
+// withScope adds the idempotency scope of the client to a request line, before the scope
+// the client may have sent so that it cannot pick the scope of another client
+func withScope(line []byte, scope string) []byte {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(line, &fields) != nil {
+		return line
+	}
+	var sent string
+	json.Unmarshal(fields["forwarded_scope"], &sent)
+	if sent != "" {
+		scope += "/" + sent
+	}
+	fields["forwarded_scope"], _ = json.Marshal(scope)
+	encoded, _ := json.Marshal(fields)
+	return append(encoded, '\n')
+}
+
+// handleConnection reads requests from a client and answers each with the response of a backend
+func (p *proxy) handleConnection(conn net.Conn) {
+	defer p.connections.Done()
+	defer conn.Close()
+	p.active.Add(1)
+	defer p.active.Add(-1)
+	logger := p.logger.With("remote", conn.RemoteAddr().String())
+	scope := fmt.Sprintf("proxy-%s/c%d", p.instance, p.lastConn.Add(1))
+	logger.Info("New connection")
+	defer logger.Info("Connection closed")
+
+	write := func(data []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := conn.Write(data)
+		return err
+	}
+	if err := write([]byte(p.config.WelcomeMessage + "\n")); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	// the newline is not part of the size limit
+	scanner.Buffer(make([]byte, 0, 4096), p.config.MaxMessageSize+1)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(p.config.ConnectionIdleTimeoutSeconds) * time.Second))
+		if !scanner.Scan() {
+			if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+				write(encodeResponse(GenericResponse{Status: "error", Error: "Message too large", Code: errMessageTooLarge}))
+			}
+			return
+		}
+		line := append(scanner.Bytes(), '\n')
+
+		var req proxiedRequest
+		var response []byte
+		switch {
+		case json.Unmarshal(line, &req) != nil:
+			response = encodeResponse(GenericResponse{Status: "error", Error: "Invalid JSON", Code: errInvalidJSON})
+		case req.Op == "ping":
+			response = encodeResponse(GenericResponse{Status: "pong"})
+		case req.Op != "":
+			// sessions and authentication belong to a backend connection, requests do not
+			response = encodeResponse(GenericResponse{Status: "error", Error: "Operation not supported by the proxy", Code: errUnknownOp, RequestID: req.RequestID})
+		default:
+			response = p.forward(withScope(line, scope), req, logger.With("task", req.TaskNumber, "client_id", req.ClientID))
+		}
+		if err := write(response); err != nil {
+			return
+		}
+	}
+}
+
+// statsHandler serves the per backend statistics as JSON on /stats and for Prometheus on /metrics
+func (p *proxy) statsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := make([]backendStats, len(p.backends))
+		for i, b := range p.backends {
+			stats[i] = b.stats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(map[string]any{
+			"strategy":           p.config.Strategy,
+			"active_connections": p.active.Load(),
+			"backends":           stats,
+		})
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetric := func(name, kind, help string, value func(backendStats) any) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+			for _, b := range p.backends {
+				s := b.stats()
+				fmt.Fprintf(w, "%s{backend=%q} %v\n", name, s.Address, value(s))
+			}
+		}
+		writeMetric("tema1_proxy_backend_requests_total", "counter", "Requests answered by the backend.", func(s backendStats) any { return s.Requests })
+		writeMetric("tema1_proxy_backend_errors_total", "counter", "Failed forwarding attempts.", func(s backendStats) any { return s.Errors })
+		writeMetric("tema1_proxy_backend_ejections_total", "counter", "Times the backend was ejected.", func(s backendStats) any { return s.Ejections })
+		writeMetric("tema1_proxy_backend_outstanding", "gauge", "Requests waiting for the backend.", func(s backendStats) any { return s.Outstanding })
+		writeMetric("tema1_proxy_backend_available", "gauge", "1 if the backend receives requests.", func(s backendStats) any {
+			if s.Available {
+				return 1
+			}
+			return 0
+		})
+		fmt.Fprintf(w, "# HELP tema1_proxy_active_connections Client connections currently open.\n# TYPE tema1_proxy_active_connections gauge\ntema1_proxy_active_connections %d\n", p.active.Load())
+	})
+	return mux
+}
+
+func loadConfig(filename string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	applyDefaults(&config)
+	return config, validateConfig(config)
+}
+
+func main() {
+	configPath := flag.String("config", "config.json", "path of the configuration file")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		logger.Error("Error loading configuration", "error", err)
+		os.Exit(1)
+	}
+	p := newProxy(config, logger)
+
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		logger.Error("Error starting listener", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Proxy listening", "address", listener.Addr().String(), "strategy", config.Strategy, "backends", config.Backends)
+
+	if config.HTTPAddress != "" {
+		httpListener, err := net.Listen("tcp", config.HTTPAddress)
+		if err != nil {
+			logger.Error("Error starting HTTP server", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Stats available", "url", "http://"+httpListener.Addr().String()+"/stats")
+		go http.Serve(httpListener, p.statsHandler())
+	}
+
+	// closing the listener on a shutdown signal, open connections finish their request
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("Error accepting connection", "error", err)
+			}
+			break
+		}
+		p.connections.Add(1)
+		go p.handleConnection(conn)
+	}
+
+	logger.Info("Proxy stopping, waiting for open connections")
+	done := make(chan struct{})
+	go func() {
+		p.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+	}
+	logger.Info("Proxy stopped")
+}
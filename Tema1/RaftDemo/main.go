@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/raft"
+)
+
+// RaftDemo runs a raft cluster in this process and checks that the logs agree after
+// leader partitions, node restarts and a node losing its disk; it exits with status 1
+// if a check fails
+
+var (
+	numNodes  = flag.Int("nodes", 3, "number of nodes, 3 or 5")
+	basePort  = flag.Int("base-port", 7400, "node i listens on base-port+i")
+	threshold = flag.Uint64("snapshot-threshold", 40, "entries after which the log is compacted")
+	verbose   = flag.Bool("v", false, "show the logs of the nodes")
+)
+
+// journal is the state machine, it records the commands in order
+type journal struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (j *journal) Apply(command []byte) []byte {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, string(command))
+	return []byte(fmt.Sprint(len(j.entries)))
+}
+
+func (j *journal) Snapshot() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return json.Marshal(j.entries)
+}
+
+func (j *journal) Restore(snapshot []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = nil
+	return json.Unmarshal(snapshot, &j.entries)
+}
+
+func (j *journal) list() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.entries)
+}
+
+// cluster holds the running nodes by ID, a stopped node is nil
+type cluster struct {
+	dir      string
+	peers    []raft.Peer
+	nodes    map[int]*raft.Node
+	journals map[int]*journal
+	proposed int
+}
+
+func (c *cluster) start(id int) {
+	var peers []raft.Peer
+	var address string
+	for _, peer := range c.peers {
+		if peer.ID == id {
+			address = peer.Address
+		} else {
+			peers = append(peers, peer)
+		}
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	j := &journal{}
+	node, err := raft.New(raft.Config{
+		ID:                id,
+		Address:           address,
+		Peers:             peers,
+		Dir:               c.nodeDir(id),
+		SnapshotThreshold: *threshold,
+		StateMachine:      j,
+		Logger:            slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+	})
+	if err != nil {
+		log.Fatalf("Error creating node %d: %v", id, err)
+	}
+	if err := node.Start(); err != nil {
+		log.Fatalf("Error starting node %d: %v", id, err)
+	}
+	c.nodes[id] = node
+	c.journals[id] = j
+}
+
+func (c *cluster) nodeDir(id int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("node%d", id))
+}
+
+func (c *cluster) kill(id int) {
+	c.nodes[id].Stop()
+	c.nodes[id] = nil
+}
+
+// partition isolates the given nodes from the others, in both directions
+func (c *cluster) partition(minority ...int) {
+	for id, node := range c.nodes {
+		if node == nil {
+			continue
+		}
+		if slices.Contains(minority, id) {
+			for _, peer := range c.peers {
+				if !slices.Contains(minority, peer.ID) {
+					node.Isolate(peer.ID)
+				}
+			}
+		} else {
+			node.Isolate(minority...)
+		}
+	}
+}
+
+func (c *cluster) heal() {
+	for _, node := range c.nodes {
+		if node != nil {
+			node.Heal()
+		}
+	}
+}
+
+// waitForLeader waits until one of the given nodes leads and the others follow it
+func (c *cluster) waitForLeader(ids []int) (int, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leader, err := c.agreedLeader(ids)
+		if err == nil {
+			return leader, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (c *cluster) agreedLeader(ids []int) (int, error) {
+	leader := 0
+	for _, id := range ids {
+		status := c.nodes[id].Status()
+		if status.State == raft.Leader {
+			if leader != 0 {
+				return 0, fmt.Errorf("nodes %d and %d both lead", leader, id)
+			}
+			leader = id
+		}
+	}
+	if leader == 0 {
+		return 0, errors.New("no leader elected")
+	}
+	for _, id := range ids {
+		if seen, _ := c.nodes[id].Leader(); seen != leader {
+			return 0, fmt.Errorf("node %d follows %d, the leader is %d", id, seen, leader)
+		}
+	}
+	return leader, nil
+}
+
+// propose sends commands to one of the reachable nodes and follows the redirections
+// to the leader, like a client would
+func (c *cluster) propose(reachable []int, count int) error {
+	target := reachable[0]
+	for i := 0; i < count; {
+		command := fmt.Sprintf("cmd-%d", c.proposed+1)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := c.nodes[target].Propose(ctx, []byte(command))
+		cancel()
+
+		var notLeader *raft.NotLeaderError
+		switch {
+		case err == nil:
+			c.proposed++
+			i++
+		case errors.As(err, &notLeader) && slices.Contains(reachable, notLeader.Leader):
+			target = notLeader.Leader
+		case errors.As(err, &notLeader):
+			time.Sleep(50 * time.Millisecond)
+		default:
+			return fmt.Errorf("proposing %s to node %d: %w", command, target, err)
+		}
+	}
+	return nil
+}
+
+// waitForConvergence waits until every live node applied the same commands, at least count of them
+func (c *cluster) waitForConvergence(count int) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := c.converged(count)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (c *cluster) converged(count int) error {
+	var reference []string
+	referenceID := 0
+	for id, node := range c.nodes {
+		if node == nil {
+			continue
+		}
+		entries := c.journals[id].list()
+		if len(entries) < count {
+			return fmt.Errorf("node %d applied %d commands, expected %d", id, len(entries), count)
+		}
+		if reference == nil {
+			reference, referenceID = entries, id
+			continue
+		}
+		if !slices.Equal(entries, reference) {
+			return fmt.Errorf("nodes %d and %d applied different commands", referenceID, id)
+		}
+	}
+	for i, entry := range reference {
+		if entry != fmt.Sprintf("cmd-%d", i+1) {
+			return fmt.Errorf("command %d is %s", i+1, entry)
+		}
+	}
+	return nil
+}
+
+func (c *cluster) live() []int {
+	var ids []int
+	for id, node := range c.nodes {
+		if node != nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func main() {
+	flag.Parse()
+	if *numNodes != 3 && *numNodes != 5 {
+		log.Fatalf("The demo runs 3 or 5 nodes")
+	}
+	dir, err := os.MkdirTemp("", "raftdemo")
+	if err != nil {
+		log.Fatalf("Error creating the data directory: %v", err)
+	}
+
+	c := &cluster{dir: dir, nodes: make(map[int]*raft.Node), journals: make(map[int]*journal)}
+	for id := 1; id <= *numNodes; id++ {
+		c.peers = append(c.peers, raft.Peer{ID: id, Address: fmt.Sprintf("127.0.0.1:%d", *basePort+id)})
+	}
+
+	failed := false
+	check := func(description string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL: %s: %v\n\n", description, err)
+			failed = true
+			return
+		}
+		fmt.Printf("OK: %s\n\n", description)
+	}
+	leaderOf := func(ids []int) int {
+		leader, err := c.waitForLeader(ids)
+		if err != nil {
+			check("electing a leader", err)
+			return 0
+		}
+		fmt.Printf("  node %d leads in term %d\n", leader, c.nodes[leader].Status().Term)
+		return leader
+	}
+
+	for id := 1; id <= *numNodes; id++ {
+		c.start(id)
+	}
+	fmt.Printf("Started %d nodes in %s\n", *numNodes, dir)
+	leader := leaderOf(c.live())
+	check("replicating 50 commands", errors.Join(c.propose(c.live(), 50), c.waitForConvergence(c.proposed)))
+
+	// the leader is cut off, the majority elects another and keeps committing
+	minority := []int{leader}
+	if *numNodes == 5 {
+		minority = append(minority, leader%*numNodes+1)
+	}
+	fmt.Printf("Partitioning %v from the other nodes\n", minority)
+	c.partition(minority...)
+	var majority []int
+	for _, id := range c.live() {
+		if !slices.Contains(minority, id) {
+			majority = append(majority, id)
+		}
+	}
+	newLeader := leaderOf(majority)
+	if newLeader == leader {
+		check("electing a new leader in the majority", errors.New("the old leader still leads"))
+	}
+	lostErr := make(chan error, 1)
+	go func() {
+		// the isolated leader cannot commit
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		_, err := c.nodes[leader].Propose(ctx, []byte("lost"))
+		lostErr <- err
+	}()
+	check("committing 30 commands in the majority", c.propose(majority, 30))
+	if err := <-lostErr; err == nil {
+		check("rejecting a proposal in the minority", errors.New("the isolated leader committed a command"))
+	} else {
+		check("rejecting a proposal in the minority", nil)
+		fmt.Printf("  the isolated leader answered: %v\n", err)
+	}
+	fmt.Println("Healing the partition")
+	c.heal()
+	leaderOf(c.live())
+	check("converging after the partition", c.waitForConvergence(c.proposed))
+
+	// a follower restarts from its disk and catches up
+	follower := 0
+	for _, id := range c.live() {
+		if !c.nodes[id].IsLeader() {
+			follower = id
+		}
+	}
+	fmt.Printf("Stopping follower %d, proposing 20 commands, restarting it from its disk\n", follower)
+	c.kill(follower)
+	check("committing without the follower", c.propose(c.live(), 20))
+	c.start(follower)
+	check("recovering the follower from its disk", c.waitForConvergence(c.proposed))
+
+	// a follower loses its disk and is rebuilt from the snapshot of the leader
+	fmt.Printf("Stopping follower %d, wiping its data, proposing %d commands, restarting it\n", follower, 2**threshold)
+	c.kill(follower)
+	os.RemoveAll(c.nodeDir(follower))
+	check(fmt.Sprintf("committing %d commands", 2**threshold), c.propose(c.live(), int(2**threshold)))
+	c.start(follower)
+	err = c.waitForConvergence(c.proposed)
+	if err == nil && c.nodes[follower].Status().SnapshotIndex == 0 {
+		err = errors.New("the follower did not receive a snapshot")
+	}
+	check("rebuilding the wiped follower from a snapshot", err)
+
+	// the whole cluster restarts and keeps its log
+	fmt.Println("Restarting every node")
+	for _, id := range c.live() {
+		c.kill(id)
+	}
+	for id := 1; id <= *numNodes; id++ {
+		c.start(id)
+	}
+	leaderOf(c.live())
+	check("restarting the cluster", errors.Join(c.waitForConvergence(c.proposed), c.propose(c.live(), 10), c.waitForConvergence(c.proposed)))
+
+	for _, id := range c.live() {
+		status := c.nodes[id].Status()
+		fmt.Printf("  node %d: %s term %d commit %d snapshot %d\n", id, status.State, status.Term, status.CommitIndex, status.SnapshotIndex)
+		c.kill(id)
+	}
+	os.RemoveAll(dir)
+	if failed {
+		fmt.Println("Raft checks failed")
+		os.Exit(1)
+	}
+	fmt.Println("All raft checks passed")
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// JSON structures must match the ones sent by the server and the client
+type registryRequest struct {
+	Op          string `json:"op"`              // register, heartbeat, deregister, lookup or list
+	Token       string `json:"token,omitempty"` // shared token, required by register, heartbeat and deregister
+	Service     string `json:"service,omitempty"`
+	ID          string `json:"id,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Tasks       []int  `json:"tasks,omitempty"`
+	Load        int64  `json:"load"`
+	Connections int64  `json:"connections"`
+	TTLSeconds  int    `json:"ttl_seconds,omitempty"`
+	Task        int    `json:"task,omitempty"` // used by lookup, 0 matches every instance
+}
+
+type GenericResponse struct {
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Code   string          `json:"code,omitempty"`
+}
+
+// instance is a registered task server, the state file holds a list of them
+type instance struct {
+	Service      string    `json:"service"`
+	ID           string    `json:"id"`
+	Address      string    `json:"address"`
+	Tasks        []int     `json:"tasks"`
+	Load         int64     `json:"load"`
+	Connections  int64     `json:"connections"`
+	TTLSeconds   int       `json:"ttl_seconds"`
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+func (in *instance) expired(now time.Time) bool {
+	return now.Sub(in.LastSeen) > time.Duration(in.TTLSeconds)*time.Second
+}
+
+func (in *instance) supports(task int) bool {
+	if task == 0 {
+		return true
+	}
+	for _, t := range in.Tasks {
+		if t == task {
+			return true
+		}
+	}
+	return false
+}
+
+// error codes
+const (
+	errInvalidJSON     = "invalid_json"
+	errUnknownOp       = "unknown_op"
+	errInvalidArgument = "invalid_argument"
+	errNotRegistered   = "not_registered" // the instance expired, it has to register again
+	errInvalidToken    = "invalid_token"
+)
+
+type registry struct {
+	mu         sync.Mutex
+	instances  map[string]*instance // by service and id
+	defaultTTL int
+	token      string // shared token of the servers, only they can change the registrations
+	statePath  string
+	dirty      bool // heartbeats not saved yet
+	logger     *slog.Logger
+}
+
+func key(service, id string) string {
+	return service + "/" + id
+}
+
+// load restores the instances saved by a previous run, the expired ones are dropped by the next sweep
+func (r *registry) load() error {
+	data, err := os.ReadFile(r.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []*instance
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for _, in := range saved {
+		r.instances[key(in.Service, in.ID)] = in
+	}
+	r.logger.Info("State restored", "file", r.statePath, "instances", len(saved))
+	return nil
+}
+
+// saveLocked writes the instances to the state file, replacing it atomically; r.mu must be held
+func (r *registry) saveLocked() {
+	if r.statePath == "" {
+		return
+	}
+	saved := r.listLocked("", 0)
+	data, _ := json.MarshalIndent(saved, "", "  ")
+	temp := r.statePath + ".tmp"
+	err := os.WriteFile(temp, data, 0o644)
+	if err == nil {
+		err = os.Rename(temp, r.statePath)
+	}
+	if err != nil {
+		r.logger.Error("Error saving state", "file", r.statePath, "error", err)
+		return
+	}
+	r.dirty = false
+}
+
+// listLocked returns the live instances of a service running the task, least busy first;
+// an empty service matches every service
+func (r *registry) listLocked(service string, task int) []*instance {
+	now := time.Now()
+	result := []*instance{}
+	for _, in := range r.instances {
+		if (service == "" || in.Service == service) && in.supports(task) && !in.expired(now) {
+			copied := *in
+			result = append(result, &copied)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Connections+a.Load != b.Connections+b.Load {
+			return a.Connections+a.Load < b.Connections+b.Load
+		}
+		return key(a.Service, a.ID) < key(b.Service, b.ID)
+	})
+	return result
+}
+
+// execute runs a registry request
+func (r *registry) execute(req registryRequest, logger *slog.Logger) GenericResponse {
+	success := func(result any) GenericResponse {
+		encoded, _ := json.Marshal(result)
+		return GenericResponse{Status: "success", Result: encoded}
+	}
+	invalid := func(message string) GenericResponse {
+		return GenericResponse{Status: "error", Error: message, Code: errInvalidArgument}
+	}
+
+	switch req.Op {
+	case "register", "heartbeat", "deregister":
+		if subtle.ConstantTimeCompare([]byte(req.Token), []byte(r.token)) != 1 {
+			logger.Warn("Rejected request with invalid token", "op", req.Op, "service", req.Service, "id", req.ID)
+			return GenericResponse{Status: "error", Error: "Invalid registry token", Code: errInvalidToken}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	switch req.Op {
+	case "register":
+		if req.Service == "" || req.ID == "" || req.Address == "" {
+			return invalid("service, id and address are required")
+		}
+		if req.TTLSeconds <= 0 {
+			req.TTLSeconds = r.defaultTTL
+		}
+		r.instances[key(req.Service, req.ID)] = &instance{
+			Service:      req.Service,
+			ID:           req.ID,
+			Address:      req.Address,
+			Tasks:        req.Tasks,
+			Load:         req.Load,
+			Connections:  req.Connections,
+			TTLSeconds:   req.TTLSeconds,
+			RegisteredAt: now,
+			LastSeen:     now,
+		}
+		logger.Info("Instance registered", "service", req.Service, "id", req.ID, "address", req.Address)
+		r.saveLocked()
+		return success(nil)
+	case "heartbeat":
+		in, ok := r.instances[key(req.Service, req.ID)]
+		if !ok || in.expired(now) {
+			return GenericResponse{Status: "error", Error: "Instance not registered", Code: errNotRegistered}
+		}
+		in.Load, in.Connections, in.LastSeen = req.Load, req.Connections, now
+		r.dirty = true
+		return success(nil)
+	case "deregister":
+		if _, ok := r.instances[key(req.Service, req.ID)]; ok {
+			delete(r.instances, key(req.Service, req.ID))
+			logger.Info("Instance deregistered", "service", req.Service, "id", req.ID)
+			r.saveLocked()
+		}
+		return success(nil)
+	case "lookup":
+		if req.Service == "" {
+			return invalid("service is required")
+		}
+		return success(r.listLocked(req.Service, req.Task))
+	case "list":
+		return success(r.listLocked("", 0))
+	default:
+		return GenericResponse{Status: "error", Error: "Unknown operation", Code: errUnknownOp}
+	}
+}
+
+// sweep drops the expired instances and saves the heartbeats, until ctx is done
+func (r *registry) sweep(ctx context.Context, saveInterval time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastSave := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			r.saveLocked()
+			r.mu.Unlock()
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			expired := false
+			for k, in := range r.instances {
+				if in.expired(now) {
+					delete(r.instances, k)
+					r.logger.Warn("Instance expired", "service", in.Service, "id", in.ID, "last_seen", in.LastSeen)
+					expired = true
+				}
+			}
+			if expired || (r.dirty && now.Sub(lastSave) >= saveInterval) {
+				r.saveLocked()
+				lastSave = now
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// handleConnection answers requests until the connection is closed or stays silent
+func (r *registry) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	logger := r.logger.With("remote", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var req registryRequest
+		var response GenericResponse
+		if err := json.Unmarshal(line, &req); err != nil {
+			response = GenericResponse{Status: "error", Error: "Invalid JSON", Code: errInvalidJSON}
+		} else {
+			response = r.execute(req, logger)
+		}
+
+		encoded, _ := json.Marshal(response)
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(append(encoded, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+func main() {
+	address := flag.String("address", "localhost:7100", "tcp address of the registry")
+	statePath := flag.String("state", "registry-state.json", "file the registrations are saved to, empty to keep them in memory")
+	defaultTTL := flag.Int("ttl", 10, "seconds an instance is kept without a heartbeat, when it does not choose")
+	saveInterval := flag.Duration("save-interval", 5*time.Second, "how often heartbeats are saved to the state file")
+	token := flag.String("token", os.Getenv("TEMA1_REGISTRY_TOKEN"), "token the servers register with, defaults to $TEMA1_REGISTRY_TOKEN")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if *token == "" {
+		logger.Error("A registry token is required, set -token or TEMA1_REGISTRY_TOKEN")
+		os.Exit(1)
+	}
+	r := &registry{
+		instances:  make(map[string]*instance),
+		defaultTTL: *defaultTTL,
+		token:      *token,
+		statePath:  *statePath,
+		logger:     logger,
+	}
+	if r.statePath != "" {
+		if err := os.MkdirAll(filepath.Dir(r.statePath), 0o755); err != nil {
+			logger.Error("Error creating state directory", "error", err)
+			os.Exit(1)
+		}
+		if err := r.load(); err != nil {
+			logger.Error("Error loading state", "file", r.statePath, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	listener, err := net.Listen("tcp", *address)
+	if err != nil {
+		logger.Error("Error starting listener", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("Registry listening", "address", listener.Addr().String())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	swept := make(chan struct{})
+	go func() {
+		r.sweep(ctx, *saveInterval)
+		close(swept)
+	}()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go r.handleConnection(conn)
+	}
+	// the last heartbeats are saved before exiting
+	<-swept
+	logger.Info("Registry stopped")
+}
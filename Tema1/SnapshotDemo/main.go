@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/taskserver"
+)
+
+// SnapshotDemo runs a coordinator and several workers in this process, keeps clients
+// sending tasks through the coordinator and takes Chandy–Lamport snapshots with the
+// "snapshot" admin operation. Every task the coordinator forwarded and did not see
+// answered must be in exactly one place of a snapshot: executing on the worker, on the
+// channel to the worker or, answered, on the channel back. The last snapshot is taken
+// with a worker crashed and must say so. It exits with status 1 if a check fails.
+
+var (
+	numWorkers = flag.Int("workers", 3, "number of workers")
+	numClients = flag.Int("clients", 8, "clients sending tasks while the snapshots are taken")
+	snapshots  = flag.Int("snapshots", 10, "snapshots taken under load")
+	basePort   = flag.Int("base-port", 8750, "the coordinator listens on base-port, its cluster listener on base-port+10, its admin interface on base-port+20 and worker i on base-port+i")
+	verbose    = flag.Bool("v", false, "show the logs of the servers")
+)
+
+// the task sent by the clients, it sleeps for its input in milliseconds
+const demoTask = 100
+
+const adminToken = "demo"
+
+const coordinatorID = "coordinator"
+
+// tags and markers without the cluster token are ignored by the workers
+const clusterToken = "demo-cluster"
+
+func logger() *slog.Logger {
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+func serve(name string, server *taskserver.Server) {
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != taskserver.ErrServerClosed {
+			log.Fatalf("Error serving %s: %v", name, err)
+		}
+	}()
+}
+
+func startCoordinator(dir string) *taskserver.Server {
+	server, err := taskserver.New(taskserver.Config{
+		Host:                     "localhost",
+		Port:                     strconv.Itoa(*basePort),
+		MaxConcurrentConnections: 100,
+		Admin:                    taskserver.AdminConfig{Address: fmt.Sprintf("localhost:%d", *basePort+20), Token: adminToken},
+		Cluster: taskserver.ClusterConfig{
+			Role:    taskserver.RoleCoordinator,
+			NodeID:  coordinatorID,
+			Address: fmt.Sprintf("localhost:%d", *basePort+10),
+			Token:   clusterToken,
+		},
+		Snapshots: taskserver.SnapshotConfig{Dir: dir, TimeoutSeconds: 2},
+	}, taskserver.WithLogger(logger()))
+	if err != nil {
+		log.Fatalf("Error creating the coordinator: %v", err)
+	}
+	serve("the coordinator", server)
+	return server
+}
+
+func startWorker(id int) *taskserver.Server {
+	server, err := taskserver.New(taskserver.Config{
+		Host:                     "localhost",
+		Port:                     strconv.Itoa(*basePort + id),
+		MaxConcurrentConnections: 100,
+		Cluster: taskserver.ClusterConfig{
+			Role:                     taskserver.RoleWorker,
+			NodeID:                   fmt.Sprintf("worker%d", id),
+			CoordinatorAddress:       fmt.Sprintf("localhost:%d", *basePort+10),
+			Token:                    clusterToken,
+			HeartbeatIntervalSeconds: 1,
+		},
+		Snapshots: taskserver.SnapshotConfig{TimeoutSeconds: 2},
+	}, taskserver.WithLogger(logger()), taskserver.WithTask(demoTask, func(raw json.RawMessage) (any, error) {
+		var sleepMs int
+		if err := json.Unmarshal(raw, &sleepMs); err != nil {
+			return nil, err
+		}
+		time.Sleep(time.Duration(sleepMs) * time.Millisecond)
+		return sleepMs, nil
+	}))
+	if err != nil {
+		log.Fatalf("Error creating worker %d: %v", id, err)
+	}
+	serve(fmt.Sprintf("worker %d", id), server)
+	return server
+}
+
+type response struct {
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+	Code   string          `json:"code"`
+}
+
+// the parts of a snapshot file the checks read
+type snapshot struct {
+	ID        uint64 `json:"snapshot_id"`
+	Complete  bool   `json:"complete"`
+	InTransit int    `json:"in_transit"`
+	Nodes     []struct {
+		NodeID   string `json:"node_id"`
+		InFlight []struct {
+			Peer string `json:"peer"`
+		} `json:"in_flight"`
+		Channels []struct {
+			From     string `json:"from"`
+			Complete bool   `json:"complete"`
+			Messages []struct {
+				Kind string `json:"kind"`
+			} `json:"messages"`
+		} `json:"channels"`
+	} `json:"nodes"`
+	Missing []string `json:"missing"`
+}
+
+type snapshotResult struct {
+	File       string `json:"file"`
+	SnapshotID uint64 `json:"snapshot_id"`
+}
+
+// takeSnapshot runs the admin operation and reads the file it wrote
+func takeSnapshot() (snapshot, error) {
+	var snap snapshot
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", *basePort+20), time.Second)
+	if err != nil {
+		return snap, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	encoded, _ := json.Marshal(map[string]string{"op": "snapshot", "token": adminToken})
+	if _, err := conn.Write(append(encoded, '\n')); err != nil {
+		return snap, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return snap, err
+	}
+	var resp response
+	var result snapshotResult
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return snap, err
+	}
+	if resp.Status != "success" {
+		return snap, fmt.Errorf("%s: %s", resp.Code, resp.Error)
+	}
+	if err := json.Unmarshal(resp.Result, &result); err != nil {
+		return snap, err
+	}
+	data, err := os.ReadFile(result.File)
+	if err != nil {
+		return snap, err
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, err
+	}
+	if snap.ID != result.SnapshotID {
+		return snap, fmt.Errorf("%s holds snapshot %d instead of %d", result.File, snap.ID, result.SnapshotID)
+	}
+	return snap, nil
+}
+
+// conserved checks that every task the coordinator was waiting for is on its worker
+// or on one of the two channels between them, and returns the tasks in transit
+func conserved(snap snapshot) (inTransit int, err error) {
+	waiting := make(map[string]int)   // by worker, recorded by the coordinator
+	accounted := make(map[string]int) // by worker, recorded by the worker or on a channel
+	for _, node := range snap.Nodes {
+		for _, task := range node.InFlight {
+			if node.NodeID == coordinatorID {
+				waiting[task.Peer]++
+			} else {
+				accounted[node.NodeID]++
+			}
+		}
+		for _, channel := range node.Channels {
+			if !channel.Complete {
+				return 0, fmt.Errorf("channel %s -> %s is incomplete", channel.From, node.NodeID)
+			}
+			worker := channel.From
+			if node.NodeID != coordinatorID {
+				worker = node.NodeID
+			}
+			accounted[worker] += len(channel.Messages)
+			inTransit += len(channel.Messages)
+		}
+	}
+	for worker := 1; worker <= *numWorkers; worker++ {
+		name := fmt.Sprintf("worker%d", worker)
+		if waiting[name] != accounted[name] {
+			return 0, fmt.Errorf("the coordinator waits for %d tasks of %s, %d are on the worker or its channels", waiting[name], name, accounted[name])
+		}
+	}
+	return inTransit, nil
+}
+
+// forgeTag sends a task tagged as if the coordinator had recorded the last possible
+// snapshot, a worker trusting it would ignore every later snapshot
+func forgeTag(port int) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	encoded, _ := json.Marshal(map[string]any{"task": demoTask, "input": 0, "channel": map[string]any{"from": coordinatorID, "snapshot": uint64(math.MaxUint64)}})
+	if _, err := conn.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+	_, err = reader.ReadString('\n')
+	return err
+}
+
+// load keeps clients sending tasks to the coordinator until stop is closed
+func load(stop chan struct{}) (sent *atomic.Int64, wait func()) {
+	sent = new(atomic.Int64)
+	var wg sync.WaitGroup
+	for i := 0; i < *numClients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", *basePort), time.Second)
+				if err != nil {
+					time.Sleep(50 * time.Millisecond)
+					continue
+				}
+				reader := bufio.NewReader(conn)
+				reader.ReadString('\n')
+				for n := 0; n < 50; n++ {
+					select {
+					case <-stop:
+						conn.Close()
+						return
+					default:
+					}
+					encoded, _ := json.Marshal(map[string]any{"task": demoTask, "input": rand.Intn(20)})
+					conn.SetDeadline(time.Now().Add(5 * time.Second))
+					if _, err := conn.Write(append(encoded, '\n')); err != nil {
+						break
+					}
+					if _, err := reader.ReadString('\n'); err != nil {
+						break
+					}
+					sent.Add(1)
+				}
+				conn.Close()
+			}
+		}()
+	}
+	return sent, wg.Wait
+}
+
+func main() {
+	flag.Parse()
+	if *numWorkers < 2 {
+		log.Fatalf("At least 2 workers are needed")
+	}
+	dir, err := os.MkdirTemp("", "snapshotdemo")
+	if err != nil {
+		log.Fatal(err)
+	}
+	coordinator := startCoordinator(dir)
+	workers := make(map[int]*taskserver.Server)
+	for id := 1; id <= *numWorkers; id++ {
+		workers[id] = startWorker(id)
+	}
+	// the workers register with their first heartbeat
+	time.Sleep(1500 * time.Millisecond)
+
+	failed := false
+	check := func(err error, format string, args ...any) {
+		if err != nil {
+			fmt.Printf("FAIL: %v\n\n", err)
+			failed = true
+			return
+		}
+		fmt.Printf("OK: "+format+"\n\n", args...)
+	}
+
+	fmt.Println("Snapshot of the idle cluster")
+	snap, err := takeSnapshot()
+	if err == nil && (!snap.Complete || len(snap.Nodes) != *numWorkers+1 || snap.InTransit != 0) {
+		err = fmt.Errorf("complete %v with %d nodes and %d messages in transit", snap.Complete, len(snap.Nodes), snap.InTransit)
+	}
+	check(err, "complete, %d nodes, nothing in transit", len(snap.Nodes))
+
+	fmt.Printf("%d snapshots while %d clients send tasks\n", *snapshots, *numClients)
+	stopLoad := make(chan struct{})
+	sent, wait := load(stopLoad)
+	time.Sleep(300 * time.Millisecond)
+	inTransit, inFlight := 0, 0
+	for i := 0; i < *snapshots && err == nil; i++ {
+		snap, err = takeSnapshot()
+		if err == nil && !snap.Complete {
+			err = fmt.Errorf("snapshot %d is incomplete, missing %v", snap.ID, snap.Missing)
+		}
+		var transit int
+		if err == nil {
+			transit, err = conserved(snap)
+		}
+		inTransit += transit
+		for _, node := range snap.Nodes {
+			if node.NodeID == coordinatorID {
+				inFlight += len(node.InFlight)
+			}
+		}
+		time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+	}
+	close(stopLoad)
+	wait()
+	check(err, "every forwarded task accounted for once: %d forwarded, %d in transit over %d tasks executed", inFlight, inTransit, sent.Load())
+
+	fmt.Println("Client sending a forged channel tag to worker2")
+	err = forgeTag(*basePort + 2)
+	if err == nil {
+		snap, err = takeSnapshot()
+	}
+	if err == nil && !snap.Complete {
+		err = fmt.Errorf("snapshot %d is incomplete, missing %v", snap.ID, snap.Missing)
+	}
+	check(err, "the tag was ignored and the next snapshot is complete")
+
+	fmt.Println("Snapshot with worker1 crashed")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	workers[1].Shutdown(ctx)
+	cancel()
+	snap, err = takeSnapshot()
+	if err == nil && (snap.Complete || len(snap.Missing) != 1 || snap.Missing[0] != "worker1") {
+		err = fmt.Errorf("complete %v, missing %v", snap.Complete, snap.Missing)
+	}
+	check(err, "written incomplete, missing %v", snap.Missing)
+
+	for id, server := range workers {
+		if id != 1 {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			server.Shutdown(ctx)
+			cancel()
+		}
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	coordinator.Shutdown(ctx)
+	cancel()
+	os.RemoveAll(dir)
+
+	if failed {
+		fmt.Println("Snapshot checks failed")
+		os.Exit(1)
+	}
+	fmt.Println("All snapshot checks passed")
+}
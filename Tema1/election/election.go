@@ -0,0 +1,430 @@
+// Package election elects a leader among a fixed set of nodes with the bully algorithm.
+//
+// Every node has a unique numeric ID, the live node with the highest ID becomes the
+// leader. A node that stops hearing from the leader sends ELECTION to the nodes with
+// higher IDs; if none answers it wins and announces itself with COORDINATOR,
+// otherwise it waits for the winner's announcement. The leader repeats the
+// announcement every heartbeat interval, which is how followers notice it is gone.
+//
+// Every won election increases the term, so a leader change can be told apart from
+// a repeated announcement and a stale leader from the current one.
+package election
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peer is another node taking part in the election
+type Peer struct {
+	ID      int    `json:"ID"`
+	Address string `json:"Address"` // tcp address of its election listener
+}
+
+// Config configures a node, ID and Address are required
+type Config struct {
+	ID      int    // unique, must be positive, the highest live ID wins
+	Address string // tcp address the node listens on for election messages
+	Peers   []Peer
+
+	HeartbeatInterval time.Duration // how often the leader announces itself, default 1s
+	Timeout           time.Duration // silence after which the leader is considered dead, default 3 heartbeats
+
+	Logger *slog.Logger
+
+	// OnLeaderChange is called when the node accepts a new leader or term, from the
+	// goroutine that handled the change; it must not block
+	OnLeaderChange func(leader int, term uint64)
+}
+
+// message types
+const (
+	msgElection    = "election"
+	msgCoordinator = "coordinator"
+)
+
+// message exchanged between nodes, one JSON object per line on a connection per message
+type message struct {
+	Type string `json:"type"`
+	From int    `json:"from"`
+	Term uint64 `json:"term"`
+}
+
+// reply statuses
+const (
+	replyOK       = "ok"       // the sender has a higher ID and takes over the election
+	replyAccepted = "accepted" // the coordinator was accepted
+	replyStale    = "stale"    // the coordinator announced an old term, Term is the current one
+)
+
+type reply struct {
+	Status string `json:"status"`
+	Term   uint64 `json:"term"`
+}
+
+// Node is a participant in the election, it must be created with New
+type Node struct {
+	config Config
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	term      uint64
+	leader    int // last accepted leader, 0 before the first one
+	electing  bool
+	lastHeard time.Time // last announcement of the leader, or the start of the wait for one
+
+	listener net.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// New validates the configuration and returns a node that is not started yet
+func New(config Config) (*Node, error) {
+	if config.ID <= 0 {
+		return nil, fmt.Errorf("election: ID must be positive, got %d", config.ID)
+	}
+	if config.Address == "" {
+		return nil, errors.New("election: Address is required")
+	}
+	ids := map[int]bool{config.ID: true}
+	for _, peer := range config.Peers {
+		if peer.ID <= 0 || peer.Address == "" {
+			return nil, fmt.Errorf("election: peer %d needs a positive ID and an Address", peer.ID)
+		}
+		if ids[peer.ID] {
+			return nil, fmt.Errorf("election: ID %d is used twice", peer.ID)
+		}
+		ids[peer.ID] = true
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 3 * config.HeartbeatInterval
+	}
+	if config.Timeout <= config.HeartbeatInterval {
+		return nil, errors.New("election: Timeout must be longer than HeartbeatInterval")
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	return &Node{
+		config: config,
+		logger: config.Logger.With("election_id", config.ID),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Start opens the election listener and starts an election
+func (n *Node) Start() error {
+	listener, err := net.Listen("tcp", n.config.Address)
+	if err != nil {
+		return err
+	}
+	n.serve(listener)
+	return nil
+}
+
+// serve takes part in the election with the messages received on listener
+func (n *Node) serve(listener net.Listener) {
+	n.listener = listener
+	n.wg.Add(2)
+	go n.accept()
+	go n.monitor()
+	go n.startElection()
+}
+
+// Stop leaves the election without telling the other nodes, as a crash would
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.done)
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		n.wg.Wait()
+	})
+}
+
+// Leader returns the last accepted leader, 0 before the first election ends, and its term
+func (n *Node) Leader() (leader int, term uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader, n.term
+}
+
+// IsLeader reports whether this node is the leader
+func (n *Node) IsLeader() bool {
+	leader, _ := n.Leader()
+	return leader == n.config.ID
+}
+
+// ID returns the ID of the node
+func (n *Node) ID() int {
+	return n.config.ID
+}
+
+func (n *Node) stopped() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// monitor announces the leadership, or starts an election when the leader is silent
+func (n *Node) monitor() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		leading := n.leader == n.config.ID
+		silent := !n.electing && time.Since(n.lastHeard) > n.config.Timeout
+		n.mu.Unlock()
+		switch {
+		case leading:
+			n.announce()
+		case silent:
+			n.logger.Info("Leader silent, starting an election")
+			go n.startElection()
+		}
+	}
+}
+
+// startElection challenges the nodes with higher IDs, the node wins if none answers
+func (n *Node) startElection() {
+	n.mu.Lock()
+	if n.electing || n.stopped() {
+		n.mu.Unlock()
+		return
+	}
+	n.electing = true
+	term := n.term + 1
+	n.mu.Unlock()
+
+	var higher []Peer
+	for _, peer := range n.config.Peers {
+		if peer.ID > n.config.ID {
+			higher = append(higher, peer)
+		}
+	}
+	answered := false
+	for _, r := range n.sendAll(higher, message{Type: msgElection, From: n.config.ID, Term: term}) {
+		if r.Status == replyOK {
+			answered = true
+		}
+	}
+
+	if answered {
+		// a higher node takes over, its announcement is expected within the timeout
+		n.mu.Lock()
+		n.electing = false
+		n.lastHeard = time.Now()
+		n.mu.Unlock()
+		return
+	}
+	n.becomeLeader(term)
+}
+
+// becomeLeader takes the leadership and announces it
+func (n *Node) becomeLeader(term uint64) {
+	n.mu.Lock()
+	n.electing = false
+	if n.stopped() {
+		n.mu.Unlock()
+		return
+	}
+	// a newer term may have been seen during the election
+	if term <= n.term {
+		term = n.term + 1
+	}
+	n.leader, n.term = n.config.ID, term
+	n.mu.Unlock()
+
+	n.logger.Info("Elected leader", "term", term)
+	n.notify(n.config.ID, term)
+	n.announce()
+}
+
+// announce sends COORDINATOR to every peer; a peer on a newer term makes the leader
+// move past it, the peer accepts the next announcement
+func (n *Node) announce() {
+	n.mu.Lock()
+	if n.leader != n.config.ID {
+		n.mu.Unlock()
+		return
+	}
+	term := n.term
+	n.mu.Unlock()
+
+	var newest uint64
+	for _, r := range n.sendAll(n.config.Peers, message{Type: msgCoordinator, From: n.config.ID, Term: term}) {
+		if r.Status == replyStale && r.Term > newest {
+			newest = r.Term
+		}
+	}
+	if newest == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	if n.leader != n.config.ID || newest < n.term {
+		n.mu.Unlock()
+		return
+	}
+	n.term = newest + 1
+	term = n.term
+	n.mu.Unlock()
+	n.logger.Info("Peer on a newer term, leadership moved to a new term", "term", term)
+	n.notify(n.config.ID, term)
+}
+
+// sendAll sends a message to the peers concurrently and returns the replies received
+func (n *Node) sendAll(peers []Peer, msg message) []reply {
+	replies := make(chan reply, len(peers))
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer Peer) {
+			defer wg.Done()
+			r, err := n.send(peer, msg)
+			if err != nil {
+				n.logger.Debug("Peer unreachable", "peer", peer.ID, "type", msg.Type, "error", err)
+				return
+			}
+			replies <- r
+		}(peer)
+	}
+	wg.Wait()
+	close(replies)
+
+	var result []reply
+	for r := range replies {
+		result = append(result, r)
+	}
+	return result
+}
+
+// send delivers a message on a new connection and waits for the reply
+func (n *Node) send(peer Peer, msg message) (reply, error) {
+	var r reply
+	timeout := n.config.HeartbeatInterval
+	conn, err := net.DialTimeout("tcp", peer.Address, timeout)
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	encoded, _ := json.Marshal(msg)
+	if _, err := conn.Write(append(encoded, '\n')); err != nil {
+		return r, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(line, &r)
+	return r, err
+}
+
+// accept handles the messages of the other nodes until the node stops
+func (n *Node) accept() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		go n.handle(conn)
+	}
+}
+
+// handle answers a single message
+func (n *Node) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(n.config.HeartbeatInterval))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	var msg message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+
+	r := n.receive(msg)
+	encoded, _ := json.Marshal(r)
+	conn.Write(append(encoded, '\n'))
+}
+
+// receive applies a message to the state of the node and returns the reply
+func (n *Node) receive(msg message) reply {
+	n.mu.Lock()
+	if msg.Term > n.term && msg.Type == msgElection {
+		// candidates use the next term, remembering it keeps the terms increasing
+		n.term = msg.Term - 1
+	}
+
+	// a lower node holding an election or claiming the leadership is bullied,
+	// the leader just reminds it who leads
+	if msg.From < n.config.ID {
+		term := n.term
+		leading := n.leader == n.config.ID
+		n.mu.Unlock()
+		switch {
+		case leading:
+			go n.announce()
+		case msg.Type == msgCoordinator:
+			n.logger.Info("Lower node claims the leadership, taking over", "from", msg.From)
+			go n.startElection()
+		default:
+			go n.startElection()
+		}
+		return reply{Status: replyOK, Term: term}
+	}
+
+	if msg.Type != msgCoordinator {
+		// elections are only sent to higher nodes
+		term := n.term
+		n.mu.Unlock()
+		return reply{Status: replyOK, Term: term}
+	}
+	if msg.Term < n.term {
+		term := n.term
+		n.mu.Unlock()
+		return reply{Status: replyStale, Term: term}
+	}
+
+	changed := n.leader != msg.From || n.term != msg.Term
+	n.leader, n.term = msg.From, msg.Term
+	n.electing = false
+	n.lastHeard = time.Now()
+	n.mu.Unlock()
+
+	if changed {
+		n.logger.Info("New leader", "leader", msg.From, "term", msg.Term)
+		n.notify(msg.From, msg.Term)
+	}
+	return reply{Status: replyAccepted, Term: msg.Term}
+}
+
+func (n *Node) notify(leader int, term uint64) {
+	if n.config.OnLeaderChange != nil {
+		n.config.OnLeaderChange(leader, term)
+	}
+}
@@ -0,0 +1,96 @@
+package election
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// startCluster starts nodes with IDs 1 to count on free ports of 127.0.0.1
+func startCluster(t *testing.T, count int) []*Node {
+	t.Helper()
+	listeners := make([]net.Listener, count)
+	peers := make([]Peer, count)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		peers[i] = Peer{ID: i + 1, Address: listener.Addr().String()}
+	}
+
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		var others []Peer
+		for _, peer := range peers {
+			if peer.ID != peers[i].ID {
+				others = append(others, peer)
+			}
+		}
+		node, err := New(Config{
+			ID:                peers[i].ID,
+			Address:           peers[i].Address,
+			Peers:             others,
+			HeartbeatInterval: 50 * time.Millisecond,
+			Timeout:           200 * time.Millisecond,
+			Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+	}
+	for i, node := range nodes {
+		node.serve(listeners[i])
+		t.Cleanup(node.Stop)
+	}
+	return nodes
+}
+
+// waitForLeader waits until every node accepts the same leader other than gone and
+// returns it with its term
+func waitForLeader(t *testing.T, nodes []*Node, gone int) (int, uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leader, term := nodes[0].Leader()
+		agreed := leader != 0 && leader != gone
+		for _, node := range nodes[1:] {
+			if l, tm := node.Leader(); l != leader || tm != term {
+				agreed = false
+			}
+		}
+		if agreed {
+			return leader, term
+		}
+		if time.Now().After(deadline) {
+			for _, node := range nodes {
+				l, tm := node.Leader()
+				t.Logf("node %d sees leader %d in term %d", node.ID(), l, tm)
+			}
+			t.Fatal("the nodes did not agree on a leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNextHighestIDWinsAfterLeaderStops(t *testing.T) {
+	nodes := startCluster(t, 3)
+
+	leader, term := waitForLeader(t, nodes, 0)
+	if leader != 3 {
+		t.Fatalf("leader is %d, expected 3", leader)
+	}
+
+	nodes[2].Stop()
+	newLeader, newTerm := waitForLeader(t, nodes[:2], leader)
+	if newLeader != 2 {
+		t.Errorf("leader after node 3 stopped is %d, expected 2", newLeader)
+	}
+	if newTerm <= term {
+		t.Errorf("term after node 3 stopped is %d, expected more than %d", newTerm, term)
+	}
+}
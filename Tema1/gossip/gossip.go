@@ -0,0 +1,693 @@
+// Package gossip maintains the membership of a cluster with a SWIM-style protocol over UDP.
+//
+// A node joins through seed nodes, which answer with their view of the cluster. Every
+// ProbeInterval a node pings one member; without an ack it asks a few other members to
+// ping it on its behalf, and if none of them gets an ack either the member becomes
+// suspect. A suspect member that does not refute the suspicion within SuspicionTimeout,
+// by announcing a higher incarnation, is declared dead. Membership changes are not sent
+// separately, they are piggybacked on the probe messages and spread epidemically.
+package gossip
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// member states
+const (
+	Alive   = "alive"
+	Suspect = "suspect"
+	Dead    = "dead"
+	Left    = "left" // the member left on purpose
+)
+
+// Member is a node of the cluster as seen by the local node
+type Member struct {
+	Name        string            `json:"name"`
+	Address     string            `json:"address"` // udp address of its gossip listener
+	Meta        map[string]string `json:"meta,omitempty"`
+	State       string            `json:"state"`
+	Incarnation uint64            `json:"incarnation"` // raised by the member to refute a suspicion
+}
+
+// Event describes a membership change, Previous is empty for a member seen for the first time
+type Event struct {
+	Member   Member
+	Previous string
+}
+
+// Config configures a node, Name and BindAddress are required
+type Config struct {
+	Name             string            // unique in the cluster
+	BindAddress      string            // udp address the node listens on
+	AdvertiseAddress string            // address announced to the others, default BindAddress
+	Seeds            []string          // udp addresses of members to join through
+	Meta             map[string]string // announced with the member, for example the address clients use
+
+	ProbeInterval    time.Duration // time between probes, default 1s
+	ProbeTimeout     time.Duration // wait for a direct ack before asking others, default half of ProbeInterval
+	IndirectProbes   int           // members asked to probe a silent member, default 3
+	SuspicionTimeout time.Duration // time a suspect member has to refute, default 5 probe intervals
+
+	Logger *slog.Logger
+
+	// OnChange is called for every membership change, outside the locks of the node; it must not block
+	OnChange func(Event)
+}
+
+// message types
+const (
+	msgPing    = "ping"
+	msgAck     = "ack"
+	msgPingReq = "ping_req" // asks the receiver to probe Target and forward the ack
+	msgJoin    = "join"     // answered with sync
+	msgSync    = "sync"     // the full membership view
+)
+
+// message is sent in a single datagram, Members carries piggybacked updates or the full view
+type message struct {
+	Type          string   `json:"type"`
+	Seq           uint64   `json:"seq,omitempty"`
+	From          string   `json:"from"`
+	Target        string   `json:"target,omitempty"`
+	TargetAddress string   `json:"target_address,omitempty"`
+	Members       []Member `json:"members,omitempty"`
+}
+
+// broadcast is an update waiting to be piggybacked
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+const (
+	maxPiggyback         = 8
+	retransmitMultiplier = 4
+	maxDatagram          = 65507
+)
+
+// Node is a member of the cluster, it must be created with New
+type Node struct {
+	config Config
+	logger *slog.Logger
+	conn   *net.UDPConn
+
+	mu         sync.Mutex
+	self       Member
+	leaving    bool
+	members    map[string]*Member // every other member ever seen, by name
+	suspicions map[string]*time.Timer
+	broadcasts []*broadcast
+	probeOrder []string
+	seq        uint64
+	acks       map[uint64]func() // called when the ack with that sequence number arrives
+	synced     chan struct{}     // signaled when a seed answers a join
+	isolated   map[string]bool   // members whose messages are dropped, for testing
+
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// New validates the configuration and returns a node that is not started yet
+func New(config Config) (*Node, error) {
+	if config.Name == "" {
+		return nil, errors.New("gossip: Name is required")
+	}
+	if config.BindAddress == "" {
+		return nil, errors.New("gossip: BindAddress is required")
+	}
+	if config.AdvertiseAddress == "" {
+		config.AdvertiseAddress = config.BindAddress
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = time.Second
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = config.ProbeInterval / 2
+	}
+	if config.ProbeTimeout >= config.ProbeInterval {
+		return nil, errors.New("gossip: ProbeTimeout must be shorter than ProbeInterval")
+	}
+	if config.IndirectProbes <= 0 {
+		config.IndirectProbes = 3
+	}
+	if config.SuspicionTimeout <= 0 {
+		config.SuspicionTimeout = 5 * config.ProbeInterval
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	return &Node{
+		config: config,
+		logger: config.Logger.With("gossip_name", config.Name),
+		// a restarted node announces a higher incarnation than its previous run,
+		// which overrides the dead state the others remember
+		self: Member{
+			Name:        config.Name,
+			Address:     config.AdvertiseAddress,
+			Meta:        config.Meta,
+			State:       Alive,
+			Incarnation: uint64(time.Now().UnixMilli()),
+		},
+		members:    make(map[string]*Member),
+		suspicions: make(map[string]*time.Timer),
+		acks:       make(map[uint64]func()),
+		synced:     make(chan struct{}, 1),
+		isolated:   make(map[string]bool),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// Start opens the UDP listener, joins through the seeds and starts probing; a node that
+// reaches no seed keeps trying while it knows no other member
+func (n *Node) Start() error {
+	address, err := net.ResolveUDPAddr("udp", n.config.BindAddress)
+	if err != nil {
+		return err
+	}
+	n.conn, err = net.ListenUDP("udp", address)
+	if err != nil {
+		return err
+	}
+
+	n.wg.Add(2)
+	go n.receive()
+	go n.probe()
+	if len(n.config.Seeds) > 0 && !n.join() {
+		n.logger.Warn("No seed answered, retrying in the background", "seeds", n.config.Seeds)
+	}
+	return nil
+}
+
+// Leave announces that the node leaves the cluster and stops it
+func (n *Node) Leave() {
+	n.mu.Lock()
+	if n.leaving || n.stopped() {
+		n.mu.Unlock()
+		return
+	}
+	n.leaving = true
+	n.self.State = Left
+	n.self.Incarnation++
+	n.queueBroadcast(n.self)
+	var targets []Member
+	for _, m := range n.members {
+		if m.State == Alive || m.State == Suspect {
+			targets = append(targets, *m)
+		}
+	}
+	n.mu.Unlock()
+
+	// told directly, the others do not have to wait for a probe
+	for _, m := range targets {
+		n.send(m.Address, message{Type: msgPing, From: n.config.Name})
+	}
+	n.logger.Info("Left the cluster")
+	n.Stop()
+}
+
+// Stop closes the listener without telling the others, as a crash would
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.done)
+		if n.conn != nil {
+			n.conn.Close()
+		}
+		n.wg.Wait()
+		n.mu.Lock()
+		for _, timer := range n.suspicions {
+			timer.Stop()
+		}
+		n.mu.Unlock()
+	})
+}
+
+// Members returns the local node and every member it knows of, sorted by name
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	members := []Member{n.self}
+	for _, m := range n.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// LocalMember returns the local node as announced to the others
+func (n *Node) LocalMember() Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.self
+}
+
+// Isolate drops the messages between this node and the given members in both
+// directions, simulating a broken link
+func (n *Node) Isolate(names ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, name := range names {
+		n.isolated[name] = true
+	}
+}
+
+// Heal restores the links with every member
+func (n *Node) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated = make(map[string]bool)
+}
+
+// isolatedAddress reports whether address belongs to an isolated member; n.mu must be held
+func (n *Node) isolatedAddress(address string) bool {
+	for name := range n.isolated {
+		if m, ok := n.members[name]; ok && m.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) stopped() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// join sends a join to every seed and waits for the first view
+func (n *Node) join() bool {
+	n.mu.Lock()
+	self := n.self
+	n.mu.Unlock()
+	for _, seed := range n.config.Seeds {
+		if seed != n.config.AdvertiseAddress {
+			n.send(seed, message{Type: msgJoin, From: n.config.Name, Members: []Member{self}})
+		}
+	}
+	select {
+	case <-n.synced:
+		return true
+	case <-time.After(2 * n.config.ProbeTimeout):
+		return false
+	case <-n.done:
+		return false
+	}
+}
+
+// probe checks one member every ProbeInterval
+func (n *Node) probe() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		target, ok := n.nextTarget()
+		if !ok {
+			if len(n.config.Seeds) > 0 && n.join() {
+				n.logger.Info("Joined the cluster through a seed")
+			}
+			continue
+		}
+		if !n.probeMember(target) {
+			n.suspect(target)
+		}
+		n.pingDead()
+	}
+}
+
+// pingDead pings a random dead member with its dead entry and the local node, a member that
+// is still running refutes and the two sides of a healed partition find each other again
+func (n *Node) pingDead() {
+	n.mu.Lock()
+	var dead []Member
+	for _, m := range n.members {
+		if m.State == Dead {
+			dead = append(dead, *m)
+		}
+	}
+	self := n.self
+	n.mu.Unlock()
+	if len(dead) == 0 {
+		return
+	}
+	target := dead[rand.Intn(len(dead))]
+	n.send(target.Address, message{Type: msgPing, From: n.config.Name, Members: []Member{target, self}})
+}
+
+// nextTarget returns the next member to probe, every live member is probed once per round
+func (n *Node) nextTarget() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		for len(n.probeOrder) > 0 {
+			name := n.probeOrder[0]
+			n.probeOrder = n.probeOrder[1:]
+			if m, ok := n.members[name]; ok && (m.State == Alive || m.State == Suspect) {
+				return *m, true
+			}
+		}
+		// a new round in a new random order
+		for name := range n.members {
+			n.probeOrder = append(n.probeOrder, name)
+		}
+		rand.Shuffle(len(n.probeOrder), func(i, j int) {
+			n.probeOrder[i], n.probeOrder[j] = n.probeOrder[j], n.probeOrder[i]
+		})
+	}
+	return Member{}, false
+}
+
+// probeMember pings a member directly, then through other members; it reports whether an ack arrived
+func (n *Node) probeMember(target Member) bool {
+	acked := make(chan struct{}, 1)
+	seq := n.expectAck(func() {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	})
+	defer n.forgetAck(seq)
+
+	n.send(target.Address, message{Type: msgPing, Seq: seq, From: n.config.Name, Target: target.Name})
+	select {
+	case <-acked:
+		return true
+	case <-n.done:
+		return true
+	case <-time.After(n.config.ProbeTimeout):
+	}
+
+	helpers := n.randomMembers(n.config.IndirectProbes, target.Name)
+	n.logger.Debug("No ack, probing indirectly", "member", target.Name, "helpers", len(helpers))
+	for _, helper := range helpers {
+		n.send(helper.Address, message{Type: msgPingReq, Seq: seq, From: n.config.Name, Target: target.Name, TargetAddress: target.Address})
+	}
+	select {
+	case <-acked:
+		return true
+	case <-n.done:
+		return true
+	case <-time.After(n.config.ProbeInterval - n.config.ProbeTimeout):
+		return false
+	}
+}
+
+// randomMembers returns up to count alive members other than exclude
+func (n *Node) randomMembers(count int, exclude string) []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var candidates []Member
+	for _, m := range n.members {
+		if m.State == Alive && m.Name != exclude {
+			candidates = append(candidates, *m)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	return candidates[:min(count, len(candidates))]
+}
+
+func (n *Node) expectAck(callback func()) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	n.acks[n.seq] = callback
+	return n.seq
+}
+
+func (n *Node) forgetAck(seq uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.acks, seq)
+}
+
+// suspect starts suspecting a member that did not answer a probe
+func (n *Node) suspect(target Member) {
+	n.mu.Lock()
+	current, ok := n.members[target.Name]
+	alive := ok && current.State == Alive
+	n.mu.Unlock()
+	if alive {
+		n.logger.Info("Member did not answer, suspecting it", "member", target.Name)
+	}
+	target.State = Suspect
+	n.apply([]Member{target})
+}
+
+// receive handles the datagrams until the node stops
+func (n *Node) receive() {
+	defer n.wg.Done()
+	buffer := make([]byte, maxDatagram)
+	for {
+		size, from, err := n.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if n.stopped() {
+				return
+			}
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(buffer[:size], &msg); err != nil {
+			n.logger.Debug("Ignoring invalid datagram", "from", from.String(), "error", err)
+			continue
+		}
+		n.mu.Lock()
+		dropped := n.isolated[msg.From]
+		n.mu.Unlock()
+		if dropped {
+			continue
+		}
+		n.handle(msg, from)
+	}
+}
+
+// handle merges the updates a message carries and answers it
+func (n *Node) handle(msg message, from *net.UDPAddr) {
+	n.apply(msg.Members)
+
+	// the sender runs although it was declared dead here, it is told so that it refutes
+	n.mu.Lock()
+	sender, known := n.members[msg.From]
+	var deadSender Member
+	if known && sender.State == Dead {
+		deadSender = *sender
+	}
+	self := n.self
+	n.mu.Unlock()
+	if deadSender.Name != "" {
+		n.sendTo(from, message{Type: msgPing, From: n.config.Name, Members: []Member{deadSender, self}})
+	}
+
+	switch msg.Type {
+	case msgPing:
+		if msg.Seq != 0 && (msg.Target == "" || msg.Target == n.config.Name) {
+			n.sendTo(from, message{Type: msgAck, Seq: msg.Seq, From: n.config.Name})
+		}
+	case msgAck:
+		n.mu.Lock()
+		callback := n.acks[msg.Seq]
+		n.mu.Unlock()
+		if callback != nil {
+			callback()
+		}
+	case msgPingReq:
+		// the ack of the target is forwarded with the sequence number of the requester
+		requester, requesterSeq := from, msg.Seq
+		seq := n.expectAck(func() {
+			n.sendTo(requester, message{Type: msgAck, Seq: requesterSeq, From: n.config.Name})
+		})
+		n.send(msg.TargetAddress, message{Type: msgPing, Seq: seq, From: n.config.Name, Target: msg.Target})
+		time.AfterFunc(n.config.ProbeInterval, func() { n.forgetAck(seq) })
+	case msgJoin:
+		n.mu.Lock()
+		view := []Member{n.self}
+		for _, m := range n.members {
+			view = append(view, *m)
+		}
+		n.mu.Unlock()
+		n.sendTo(from, message{Type: msgSync, From: n.config.Name, Members: view})
+	case msgSync:
+		select {
+		case n.synced <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// apply merges membership updates into the local view, spreads the accepted ones further
+// and reports the changes
+func (n *Node) apply(updates []Member) {
+	var events []Event
+	n.mu.Lock()
+	for _, update := range updates {
+		if event, ok := n.merge(update); ok {
+			events = append(events, event)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, event := range events {
+		n.logger.Info("Membership changed", "member", event.Member.Name, "state", event.Member.State, "previous", event.Previous)
+		if n.config.OnChange != nil {
+			n.config.OnChange(event)
+		}
+	}
+}
+
+// merge applies one update, it returns an event when the state of a member changed;
+// n.mu must be held
+func (n *Node) merge(update Member) (Event, bool) {
+	if update.Name == n.config.Name {
+		// the others suspect this node or think it is dead, a higher incarnation refutes it
+		if update.State != Alive && !n.leaving && update.Incarnation >= n.self.Incarnation {
+			n.self.Incarnation = update.Incarnation + 1
+			n.queueBroadcast(n.self)
+			n.logger.Info("Refuting a suspicion", "state", update.State, "incarnation", n.self.Incarnation)
+		}
+		return Event{}, false
+	}
+
+	current, known := n.members[update.Name]
+	if !known {
+		member := update
+		n.members[update.Name] = &member
+		// a member gone before this node heard of it is recorded without a change
+		if update.State == Dead || update.State == Left {
+			return Event{}, false
+		}
+		n.probeOrder = append(n.probeOrder, update.Name)
+		n.queueBroadcast(member)
+		if member.State == Suspect {
+			n.startSuspicion(member)
+		}
+		return Event{Member: member}, true
+	}
+
+	gone := current.State == Dead || current.State == Left
+	var accept bool
+	switch update.State {
+	case Alive:
+		accept = update.Incarnation > current.Incarnation
+	case Suspect:
+		accept = current.State == Alive && update.Incarnation >= current.Incarnation ||
+			current.State == Suspect && update.Incarnation > current.Incarnation
+	case Dead, Left:
+		accept = !gone && update.Incarnation >= current.Incarnation
+	}
+	if !accept {
+		return Event{}, false
+	}
+
+	previous := current.State
+	*current = update
+	n.queueBroadcast(update)
+	if timer, ok := n.suspicions[update.Name]; ok && update.State != Suspect {
+		timer.Stop()
+		delete(n.suspicions, update.Name)
+	}
+	if update.State == Suspect {
+		n.startSuspicion(update)
+	}
+	if previous == update.State {
+		return Event{}, false
+	}
+	return Event{Member: update, Previous: previous}, true
+}
+
+// startSuspicion declares a member dead if it is still suspect with the same incarnation
+// after SuspicionTimeout; n.mu must be held
+func (n *Node) startSuspicion(member Member) {
+	if timer, ok := n.suspicions[member.Name]; ok {
+		timer.Stop()
+	}
+	n.suspicions[member.Name] = time.AfterFunc(n.config.SuspicionTimeout, func() {
+		n.mu.Lock()
+		current, ok := n.members[member.Name]
+		stillSuspect := ok && current.State == Suspect && current.Incarnation == member.Incarnation
+		delete(n.suspicions, member.Name)
+		n.mu.Unlock()
+		if stillSuspect && !n.stopped() {
+			dead := member
+			dead.State = Dead
+			n.logger.Warn("Suspect member did not refute, declaring it dead", "member", member.Name)
+			n.apply([]Member{dead})
+		}
+	})
+}
+
+// queueBroadcast schedules an update for piggybacking, replacing an older one about the
+// same member; n.mu must be held
+func (n *Node) queueBroadcast(member Member) {
+	for i, b := range n.broadcasts {
+		if b.member.Name == member.Name {
+			n.broadcasts = append(n.broadcasts[:i], n.broadcasts[i+1:]...)
+			break
+		}
+	}
+	n.broadcasts = append(n.broadcasts, &broadcast{member: member})
+}
+
+// piggyback returns the updates sent least often so far, each update is sent
+// retransmitMultiplier * log10(members) times; n.mu must be held
+func (n *Node) piggyback() []Member {
+	limit := retransmitMultiplier * int(math.Ceil(math.Log10(float64(len(n.members)+2))))
+	sort.SliceStable(n.broadcasts, func(i, j int) bool { return n.broadcasts[i].transmits < n.broadcasts[j].transmits })
+	var updates []Member
+	kept := n.broadcasts[:0]
+	for _, b := range n.broadcasts {
+		if len(updates) < maxPiggyback {
+			updates = append(updates, b.member)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	n.broadcasts = kept
+	return updates
+}
+
+// send resolves address and sends a message with piggybacked updates
+func (n *Node) send(address string, msg message) {
+	to, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		n.logger.Debug("Cannot resolve member address", "address", address, "error", err)
+		return
+	}
+	n.sendTo(to, msg)
+}
+
+func (n *Node) sendTo(to *net.UDPAddr, msg message) {
+	n.mu.Lock()
+	if n.isolatedAddress(to.String()) {
+		n.mu.Unlock()
+		return
+	}
+	if msg.Type != msgSync && msg.Type != msgJoin {
+		msg.Members = append(msg.Members, n.piggyback()...)
+	}
+	n.mu.Unlock()
+	encoded, err := json.Marshal(msg)
+	if err != nil || len(encoded) > maxDatagram {
+		n.logger.Warn("Message too large for a datagram", "type", msg.Type, "members", len(msg.Members))
+		return
+	}
+	if _, err := n.conn.WriteToUDP(encoded, to); err != nil && !n.stopped() {
+		n.logger.Debug("Error sending a message", "to", to.String(), "type", msg.Type, "error", err)
+	}
+}
@@ -0,0 +1,128 @@
+// Package hashring implements consistent hashing with virtual nodes.
+//
+// Every node is placed on the ring several times, so keys spread evenly and
+// adding or removing a node only moves the keys of its neighbours.
+package hashring
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultReplicas is the number of virtual nodes used when New gets 0
+const DefaultReplicas = 100
+
+// Ring maps keys to nodes, it is safe for concurrent use
+type Ring struct {
+	mu       sync.RWMutex
+	replicas int
+	points   []uint32          // sorted hashes of the virtual nodes
+	owners   map[uint32]string // virtual node hash to node
+	nodes    map[string]bool
+}
+
+// New returns an empty ring placing every node replicas times
+func New(replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &Ring{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+		nodes:    make(map[string]bool),
+	}
+}
+
+func hash(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// Add places nodes on the ring, nodes already present are ignored
+func (r *Ring) Add(nodes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, node := range nodes {
+		if r.nodes[node] {
+			continue
+		}
+		r.nodes[node] = true
+		for i := 0; i < r.replicas; i++ {
+			point := hash(strconv.Itoa(i) + "#" + node)
+			// on a collision the first node keeps the point
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = node
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove takes a node off the ring
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == node {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+// Nodes returns the nodes on the ring, sorted
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Get returns the node owning the key, empty if the ring is empty
+func (r *Ring) Get(key string) string {
+	nodes := r.GetN(key, 1)
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[0]
+}
+
+// GetN returns up to n distinct nodes for the key, in ring order starting with its owner;
+// the ones after the owner are where the key moves when the owner is removed
+func (r *Ring) GetN(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	result := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(result) < n; i++ {
+		node := r.owners[r.points[(start+i)%len(r.points)]]
+		if !seen[node] {
+			seen[node] = true
+			result = append(result, node)
+		}
+	}
+	return result
+}
@@ -0,0 +1,436 @@
+// Package mutex implements named distributed locks among a fixed set of nodes with
+// the Ricart–Agrawala algorithm.
+//
+// A node that wants a lock stamps a request with its Lamport clock and sends it to
+// every peer; it holds the lock once every peer has replied. A peer replies at once
+// unless it holds the lock or requested it earlier, ties broken by the lower ID; the
+// deferred replies are sent when it releases the lock. Every message carries the
+// clock of its sender, so a request sent after seeing another one is always later.
+//
+// A peer whose listener refuses the connection is not running and cannot hold the
+// lock, so it counts as having replied; an unreachable peer blocks the request until
+// its timeout expires.
+package mutex
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Peer is another node sharing the locks
+type Peer struct {
+	ID      int    `json:"ID"`
+	Address string `json:"Address"` // tcp address of its lock listener
+}
+
+// Config configures a node, ID and Address are required
+type Config struct {
+	ID      int    // unique, must be positive, breaks ties between requests with the same clock
+	Address string // tcp address the node listens on for lock messages
+	Peers   []Peer
+
+	RetryInterval time.Duration // between attempts to deliver a message to a peer, default 100ms
+
+	Logger *slog.Logger
+}
+
+var (
+	// ErrStopped is returned by Acquire after Stop
+	ErrStopped = errors.New("mutex: node stopped")
+	// ErrNotHeld is returned by Release for a lock the node does not hold
+	ErrNotHeld = errors.New("mutex: lock not held")
+)
+
+// message types
+const (
+	msgRequest = "request"
+	msgReply   = "reply"
+)
+
+// message exchanged between nodes, one JSON object per line on a connection per message
+type message struct {
+	Type  string `json:"type"`
+	From  int    `json:"from"`
+	Lock  string `json:"lock"`
+	Clock uint64 `json:"clock"` // Lamport clock of the sender when it sent the message
+
+	// a reply names the request it answers, replies to a withdrawn request are ignored
+	Request uint64 `json:"request,omitempty"`
+}
+
+// lock states
+const (
+	Requesting = "requesting"
+	Held       = "held"
+)
+
+// lockState is what the node knows about one lock
+type lockState struct {
+	state     string       // empty, Requesting or Held
+	timestamp uint64       // of the pending or granted request
+	replied   map[int]bool // peers that replied to the request
+	granted   chan struct{}
+	deferred  map[int]uint64 // peers waiting for a reply, with the timestamp of their request
+}
+
+// Node takes part in the locks, it must be created with New
+type Node struct {
+	config Config
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	clock uint64
+	locks map[string]*lockState
+	local map[string]chan struct{} // one request at a time per lock from this node
+
+	listener net.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// New validates the configuration and returns a node that is not started yet
+func New(config Config) (*Node, error) {
+	if config.ID <= 0 {
+		return nil, fmt.Errorf("mutex: ID must be positive, got %d", config.ID)
+	}
+	if config.Address == "" {
+		return nil, errors.New("mutex: Address is required")
+	}
+	ids := map[int]bool{config.ID: true}
+	for _, peer := range config.Peers {
+		if peer.ID <= 0 || peer.Address == "" {
+			return nil, fmt.Errorf("mutex: peer %d needs a positive ID and an Address", peer.ID)
+		}
+		if ids[peer.ID] {
+			return nil, fmt.Errorf("mutex: ID %d is used twice", peer.ID)
+		}
+		ids[peer.ID] = true
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = 100 * time.Millisecond
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	return &Node{
+		config: config,
+		logger: config.Logger.With("mutex_id", config.ID),
+		locks:  make(map[string]*lockState),
+		local:  make(map[string]chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Start opens the lock listener
+func (n *Node) Start() error {
+	listener, err := net.Listen("tcp", n.config.Address)
+	if err != nil {
+		return err
+	}
+	n.listener = listener
+	n.wg.Add(1)
+	go n.accept()
+	return nil
+}
+
+// Stop closes the listener without releasing the locks held, as a crash would; the
+// peers see the refused connections and stop waiting for this node
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.done)
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		n.wg.Wait()
+	})
+}
+
+// ID returns the ID of the node
+func (n *Node) ID() int {
+	return n.config.ID
+}
+
+// Clock returns the Lamport clock of the node
+func (n *Node) Clock() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.clock
+}
+
+// Acquire waits until the node holds the lock, or until ctx is done; a request that
+// times out is withdrawn
+func (n *Node) Acquire(ctx context.Context, name string) error {
+	n.mu.Lock()
+	local, ok := n.local[name]
+	if !ok {
+		local = make(chan struct{}, 1)
+		n.local[name] = local
+	}
+	n.mu.Unlock()
+	select {
+	case local <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.done:
+		return ErrStopped
+	}
+
+	n.mu.Lock()
+	lock := n.lock(name)
+	n.clock++
+	lock.state, lock.timestamp = Requesting, n.clock
+	lock.replied = make(map[int]bool)
+	lock.granted = make(chan struct{})
+	request := message{Type: msgRequest, From: n.config.ID, Lock: name, Clock: n.clock}
+	granted := lock.granted
+	n.checkGranted(lock)
+	n.mu.Unlock()
+
+	for _, peer := range n.config.Peers {
+		go n.request(peer, request)
+	}
+
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+	case <-n.done:
+	}
+
+	n.mu.Lock()
+	if lock.state == Held {
+		// granted while the context expired
+		n.mu.Unlock()
+		return nil
+	}
+	n.logger.Debug("Lock request withdrawn", "lock", name, "missing", n.missing(lock))
+	lock.state = ""
+	n.flushDeferred(name, lock)
+	n.mu.Unlock()
+	<-local
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrStopped
+}
+
+// Release gives up a lock held by the node and answers the requests deferred meanwhile
+func (n *Node) Release(name string) error {
+	n.mu.Lock()
+	lock, ok := n.locks[name]
+	if !ok || lock.state != Held {
+		n.mu.Unlock()
+		return ErrNotHeld
+	}
+	lock.state = ""
+	n.flushDeferred(name, lock)
+	local := n.local[name]
+	n.mu.Unlock()
+	<-local
+	return nil
+}
+
+// lock returns the state of a lock, the caller holds mu
+func (n *Node) lock(name string) *lockState {
+	lock, ok := n.locks[name]
+	if !ok {
+		lock = &lockState{deferred: make(map[int]uint64)}
+		n.locks[name] = lock
+	}
+	return lock
+}
+
+// checkGranted takes the lock once every peer replied, the caller holds mu
+func (n *Node) checkGranted(lock *lockState) {
+	if lock.state != Requesting || len(lock.replied) < len(n.config.Peers) {
+		return
+	}
+	lock.state = Held
+	close(lock.granted)
+}
+
+// missing returns the peers that did not reply to the request yet, the caller holds mu
+func (n *Node) missing(lock *lockState) []int {
+	var ids []int
+	for _, peer := range n.config.Peers {
+		if !lock.replied[peer.ID] {
+			ids = append(ids, peer.ID)
+		}
+	}
+	return ids
+}
+
+// flushDeferred replies to the requests deferred while the lock was wanted, the caller holds mu
+func (n *Node) flushDeferred(name string, lock *lockState) {
+	for _, peer := range n.config.Peers {
+		timestamp, ok := lock.deferred[peer.ID]
+		if !ok {
+			continue
+		}
+		delete(lock.deferred, peer.ID)
+		n.clock++
+		go n.reply(peer, message{Type: msgReply, From: n.config.ID, Lock: name, Clock: n.clock, Request: timestamp})
+	}
+}
+
+// request delivers a request to a peer while it is pending; a peer that is not running
+// counts as a reply
+func (n *Node) request(peer Peer, msg message) {
+	pending := func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		lock := n.locks[msg.Lock]
+		return lock.state == Requesting && lock.timestamp == msg.Clock && !lock.replied[peer.ID]
+	}
+	if err := n.deliver(peer, msg, pending); errors.Is(err, syscall.ECONNREFUSED) {
+		n.logger.Debug("Peer not running, counted as a reply", "peer", peer.ID, "lock", msg.Lock)
+		n.receive(message{Type: msgReply, From: peer.ID, Lock: msg.Lock, Request: msg.Clock})
+	}
+}
+
+// how long a deferred reply is retried, the requester gives up long before
+const replyRetryTimeout = time.Minute
+
+// reply delivers a reply to a peer, a peer that is not running no longer waits for it
+func (n *Node) reply(peer Peer, msg message) {
+	deadline := time.Now().Add(replyRetryTimeout)
+	n.deliver(peer, msg, func() bool { return time.Now().Before(deadline) })
+}
+
+// deliver sends a message until the peer acknowledges it, the connection is refused or
+// retry returns false
+func (n *Node) deliver(peer Peer, msg message, retry func() bool) error {
+	for {
+		if !retry() {
+			return nil
+		}
+		err := n.send(peer, msg)
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			return err
+		}
+		n.logger.Debug("Peer unreachable, retrying", "peer", peer.ID, "type", msg.Type, "error", err)
+		select {
+		case <-n.done:
+			return ErrStopped
+		case <-time.After(n.config.RetryInterval):
+		}
+	}
+}
+
+// send delivers a message on a new connection and waits for the acknowledgement
+func (n *Node) send(peer Peer, msg message) error {
+	timeout := 10 * n.config.RetryInterval
+	conn, err := net.DialTimeout("tcp", peer.Address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	encoded, _ := json.Marshal(msg)
+	if _, err := conn.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+	_, err = bufio.NewReader(conn).ReadBytes('\n')
+	return err
+}
+
+// accept handles the messages of the other nodes until the node stops
+func (n *Node) accept() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		go n.handle(conn)
+	}
+}
+
+// handle acknowledges a single message once it is applied
+func (n *Node) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * n.config.RetryInterval))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	var msg message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+	n.receive(msg)
+	conn.Write([]byte("{\"status\":\"ok\"}\n"))
+}
+
+// receive applies a message to the state of the node
+func (n *Node) receive(msg message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.clock = max(n.clock, msg.Clock) + 1
+	lock := n.lock(msg.Lock)
+
+	switch msg.Type {
+	case msgRequest:
+		// the earlier request wins, the lower ID on the same clock
+		earlier := lock.timestamp < msg.Clock || (lock.timestamp == msg.Clock && n.config.ID < msg.From)
+		if lock.state == Held || (lock.state == Requesting && earlier) {
+			lock.deferred[msg.From] = msg.Clock
+			return
+		}
+		n.clock++
+		for _, peer := range n.config.Peers {
+			if peer.ID == msg.From {
+				go n.reply(peer, message{Type: msgReply, From: n.config.ID, Lock: msg.Lock, Clock: n.clock, Request: msg.Clock})
+			}
+		}
+	case msgReply:
+		if lock.state != Requesting || lock.timestamp != msg.Request {
+			return
+		}
+		lock.replied[msg.From] = true
+		n.checkGranted(lock)
+	}
+}
+
+// LockStatus describes a lock the node holds or waits for
+type LockStatus struct {
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	Timestamp uint64 `json:"timestamp"`         // Lamport time of the request
+	Missing   []int  `json:"missing,omitempty"` // peers that did not reply yet
+	Deferred  []int  `json:"deferred,omitempty"`
+}
+
+// Locks returns the locks the node holds or waits for, sorted by name
+func (n *Node) Locks() []LockStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var locks []LockStatus
+	for name, lock := range n.locks {
+		if lock.state == "" {
+			continue
+		}
+		status := LockStatus{Name: name, State: lock.state, Timestamp: lock.timestamp}
+		if lock.state == Requesting {
+			status.Missing = n.missing(lock)
+		}
+		for id := range lock.deferred {
+			status.Deferred = append(status.Deferred, id)
+		}
+		sort.Ints(status.Deferred)
+		locks = append(locks, status)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks
+}
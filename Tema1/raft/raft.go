@@ -0,0 +1,969 @@
+// Package raft replicates a log of commands across a fixed set of nodes with the Raft
+// consensus algorithm and applies the committed commands to a state machine.
+//
+// One node is elected leader for a term; it appends the proposed commands to its log
+// and replicates them to the followers. An entry is committed once a majority stores
+// it, then every node applies it in log order, so all state machines go through the
+// same states. Entries are kept in memory and written to Dir before the node answers,
+// and the log is compacted into a snapshot of the state machine every
+// SnapshotThreshold entries; a follower too far behind receives the snapshot.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peer is another node of the cluster
+type Peer struct {
+	ID      int    `json:"ID"`
+	Address string `json:"Address"` // tcp address of its raft listener
+}
+
+// StateMachine receives the committed commands, in the same order on every node
+type StateMachine interface {
+	Apply(command []byte) []byte // the result is returned by Propose on the leader
+	Snapshot() ([]byte, error)   // the state after the commands applied so far
+	Restore(snapshot []byte) error
+}
+
+// Config configures a node, ID, Address and StateMachine are required
+type Config struct {
+	ID      int    // unique, must be positive
+	Address string // tcp address the node listens on for the other nodes
+	Peers   []Peer
+	Dir     string // where the log and the snapshots are kept, nothing is persisted when empty
+
+	HeartbeatInterval time.Duration // how often the leader contacts the followers, default 50ms
+	ElectionTimeout   time.Duration // minimum silence before a new election, randomized up to twice as long, default 300ms
+	SnapshotThreshold uint64        // applied entries after which the log is compacted, default 1000
+
+	StateMachine StateMachine
+	Logger       *slog.Logger
+}
+
+// Entry is a command at a position of the log; a nil Command is a no-op appended by new leaders
+type Entry struct {
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+	Command []byte `json:"command,omitempty"`
+}
+
+var (
+	// ErrStopped is returned by Propose after Stop
+	ErrStopped = errors.New("raft: node stopped")
+	// ErrLost is returned by Propose when the leadership was lost before the entry was
+	// applied; the entry may still have been committed by the new leader
+	ErrLost = errors.New("raft: leadership lost, the outcome of the proposal is unknown")
+)
+
+// NotLeaderError is returned by Propose on a node that is not the leader
+type NotLeaderError struct {
+	Leader int // ID of the leader known to the node, 0 if none
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == 0 {
+		return "raft: not the leader, no leader known"
+	}
+	return fmt.Sprintf("raft: not the leader, the leader is %d", e.Leader)
+}
+
+// node states
+const (
+	Follower  = "follower"
+	Candidate = "candidate"
+	Leader    = "leader"
+)
+
+// Status describes the state of a node
+type Status struct {
+	ID            int    `json:"id"`
+	State         string `json:"state"`
+	Term          uint64 `json:"term"`
+	Leader        int    `json:"leader"`
+	CommitIndex   uint64 `json:"commit_index"`
+	LastApplied   uint64 `json:"last_applied"`
+	LastLogIndex  uint64 `json:"last_log_index"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+}
+
+// result of applying a proposed entry
+type applied struct {
+	result []byte
+	err    error
+}
+
+// waiter is a Propose call waiting for its entry to be applied
+type waiter struct {
+	term uint64
+	ch   chan applied
+}
+
+// maximum number of entries sent in one AppendEntries
+const maxBatch = 256
+
+// Node is a member of a raft cluster, it must be created with New
+type Node struct {
+	config  Config
+	logger  *slog.Logger
+	storage *storage
+	peers   map[int]*peerClient
+
+	mu       sync.Mutex
+	state    string
+	term     uint64
+	votedFor int
+	leader   int
+	log      []Entry // entries after the snapshot, log[i].Index == snapshotIndex+i+1
+
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshot      snapshotFile  // latest snapshot, sent to the followers that are too far behind
+	pending       *snapshotFile // received from the leader, not restored yet
+
+	commitIndex uint64
+	lastApplied uint64
+
+	electionDeadline time.Time
+	nextIndex        map[int]uint64
+	matchIndex       map[int]uint64
+	lastContact      map[int]time.Time // last successful RPC to each peer, for the leader
+
+	waiters   map[uint64]waiter
+	applyCh   chan struct{}
+	replicate map[int]chan struct{}
+
+	isolatedMu sync.Mutex
+	isolated   map[int]bool
+
+	listener net.Listener
+	connsMu  sync.Mutex
+	conns    map[net.Conn]bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// New validates the configuration, restores the state saved in Dir and returns a node
+// that is not started yet
+func New(config Config) (*Node, error) {
+	if config.ID <= 0 {
+		return nil, fmt.Errorf("raft: ID must be positive, got %d", config.ID)
+	}
+	if config.Address == "" {
+		return nil, errors.New("raft: Address is required")
+	}
+	if config.StateMachine == nil {
+		return nil, errors.New("raft: StateMachine is required")
+	}
+	ids := map[int]bool{config.ID: true}
+	for _, peer := range config.Peers {
+		if peer.ID <= 0 || peer.Address == "" {
+			return nil, fmt.Errorf("raft: peer %d needs a positive ID and an Address", peer.ID)
+		}
+		if ids[peer.ID] {
+			return nil, fmt.Errorf("raft: ID %d is used twice", peer.ID)
+		}
+		ids[peer.ID] = true
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = 300 * time.Millisecond
+	}
+	if config.ElectionTimeout < 2*config.HeartbeatInterval {
+		return nil, errors.New("raft: ElectionTimeout must be at least twice HeartbeatInterval")
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = 1000
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	st, err := openStorage(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("raft: opening %s: %w", config.Dir, err)
+	}
+	state, snapshot, err := st.load()
+	if err != nil {
+		return nil, fmt.Errorf("raft: loading the state from %s: %w", config.Dir, err)
+	}
+	// the log may not have been saved after the snapshot that covers its first entries
+	for len(state.Log) > 0 && state.Log[0].Index <= snapshot.Index {
+		if state.Log[0].Index == snapshot.Index && state.Log[0].Term != snapshot.Term {
+			state.Log = nil
+			break
+		}
+		state.Log = state.Log[1:]
+	}
+	if len(state.Log) > 0 && state.Log[0].Index != snapshot.Index+1 {
+		state.Log = nil
+	}
+	if snapshot.Data != nil {
+		if err := config.StateMachine.Restore(snapshot.Data); err != nil {
+			return nil, fmt.Errorf("raft: restoring the snapshot: %w", err)
+		}
+	}
+
+	n := &Node{
+		config:        config,
+		logger:        config.Logger.With("raft_id", config.ID),
+		storage:       st,
+		peers:         make(map[int]*peerClient),
+		state:         Follower,
+		term:          state.Term,
+		votedFor:      state.VotedFor,
+		log:           state.Log,
+		snapshotIndex: snapshot.Index,
+		snapshotTerm:  snapshot.Term,
+		snapshot:      snapshot,
+		commitIndex:   snapshot.Index,
+		lastApplied:   snapshot.Index,
+		waiters:       make(map[uint64]waiter),
+		applyCh:       make(chan struct{}, 1),
+		replicate:     make(map[int]chan struct{}),
+		isolated:      make(map[int]bool),
+		conns:         make(map[net.Conn]bool),
+		done:          make(chan struct{}),
+	}
+	for _, peer := range config.Peers {
+		n.peers[peer.ID] = newPeerClient(peer)
+		n.replicate[peer.ID] = make(chan struct{}, 1)
+	}
+	return n, nil
+}
+
+// Start opens the raft listener and starts following, an election is held when no leader is heard
+func (n *Node) Start() error {
+	listener, err := net.Listen("tcp", n.config.Address)
+	if err != nil {
+		return err
+	}
+	n.serve(listener)
+	return nil
+}
+
+// serve answers the other nodes on listener and starts following
+func (n *Node) serve(listener net.Listener) {
+	n.listener = listener
+
+	n.mu.Lock()
+	n.resetElectionTimer()
+	term, last := n.term, n.lastIndex()
+	n.mu.Unlock()
+
+	n.wg.Add(3 + len(n.peers))
+	go n.accept()
+	go n.run()
+	go n.applier()
+	for id := range n.peers {
+		go n.replicator(id)
+	}
+	n.logger.Info("Raft node started", "address", n.config.Address, "term", term, "log", last)
+}
+
+// Stop closes the listener and the connections and waits for the goroutines, as a crash
+// would the node does not tell the others
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.done)
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		n.connsMu.Lock()
+		for conn := range n.conns {
+			conn.Close()
+		}
+		n.connsMu.Unlock()
+		n.wg.Wait()
+		for _, peer := range n.peers {
+			peer.close()
+		}
+
+		n.mu.Lock()
+		for index, w := range n.waiters {
+			w.ch <- applied{err: ErrStopped}
+			delete(n.waiters, index)
+		}
+		n.mu.Unlock()
+	})
+}
+
+// Propose appends a command to the log and waits until it is applied, returning the
+// result of the state machine; only the leader accepts proposals
+func (n *Node) Propose(ctx context.Context, command []byte) ([]byte, error) {
+	if command == nil {
+		command = []byte{}
+	}
+	n.mu.Lock()
+	if n.stopped() {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.state != Leader {
+		leader := n.leader
+		n.mu.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.term, Command: command}
+	n.log = append(n.log, entry)
+	if err := n.persist(); err != nil {
+		n.log = n.log[:len(n.log)-1]
+		n.mu.Unlock()
+		return nil, fmt.Errorf("raft: saving the entry: %w", err)
+	}
+	ch := make(chan applied, 1)
+	n.waiters[entry.Index] = waiter{term: entry.Term, ch: ch}
+	n.advanceCommit()
+	n.mu.Unlock()
+	n.notifyReplicators()
+
+	select {
+	case result := <-ch:
+		return result.result, result.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Status returns the current state of the node
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.config.ID,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastLogIndex:  n.lastIndex(),
+		SnapshotIndex: n.snapshotIndex,
+	}
+}
+
+// Leader returns the ID of the leader known to the node, 0 if none, and the term
+func (n *Node) Leader() (leader int, term uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader, n.term
+}
+
+// IsLeader reports whether the node is the leader of its term
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == Leader
+}
+
+// ID returns the ID of the node
+func (n *Node) ID() int {
+	return n.config.ID
+}
+
+// Isolate drops the traffic between this node and the given peers in both
+// directions, simulating a network partition
+func (n *Node) Isolate(ids ...int) {
+	n.isolatedMu.Lock()
+	defer n.isolatedMu.Unlock()
+	for _, id := range ids {
+		n.isolated[id] = true
+	}
+}
+
+// Heal restores the traffic with every peer
+func (n *Node) Heal() {
+	n.isolatedMu.Lock()
+	defer n.isolatedMu.Unlock()
+	n.isolated = make(map[int]bool)
+}
+
+func (n *Node) isolatedFrom(id int) bool {
+	n.isolatedMu.Lock()
+	defer n.isolatedMu.Unlock()
+	return n.isolated[id]
+}
+
+func (n *Node) stopped() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// the following methods expect n.mu to be held
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshotIndex
+	}
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshotTerm
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, 0 if it is compacted or missing
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm
+	}
+	if index < n.snapshotIndex || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.snapshotIndex-1].Term
+}
+
+// entriesFrom returns a copy of up to maxBatch entries starting at index
+func (n *Node) entriesFrom(index uint64) []Entry {
+	start := index - n.snapshotIndex - 1
+	end := min(uint64(len(n.log)), start+maxBatch)
+	if start >= end {
+		return nil
+	}
+	return append([]Entry(nil), n.log[start:end]...)
+}
+
+// persist saves the term, the vote and the log, it must succeed before answering with
+// or acting on the changed state: a node that could not save it is not counted in a majority
+func (n *Node) persist() error {
+	err := n.storage.saveState(persistentState{Term: n.term, VotedFor: n.votedFor, Log: n.log})
+	if err != nil {
+		n.logger.Error("Error saving the raft state", "error", err)
+	}
+	return err
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// becomeFollower moves to a newer term, or steps down in the current one; an error
+// means the new term was not saved and the node must not vote or accept entries in it
+func (n *Node) becomeFollower(term uint64, leader int) error {
+	var err error
+	if term > n.term {
+		n.term = term
+		n.votedFor = 0
+		err = n.persist()
+	}
+	if n.state != Follower {
+		n.logger.Info("Became follower", "term", n.term, "leader", leader)
+	}
+	n.state = Follower
+	n.leader = leader
+	return err
+}
+
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.config.ID
+	n.nextIndex = make(map[int]uint64)
+	n.matchIndex = make(map[int]uint64)
+	n.lastContact = make(map[int]time.Time)
+	now := time.Now()
+	for id := range n.peers {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.lastContact[id] = now
+	}
+	// entries of earlier terms are only committed through an entry of the current term
+	n.log = append(n.log, Entry{Index: n.lastIndex() + 1, Term: n.term})
+	if err := n.persist(); err != nil {
+		n.log = n.log[:len(n.log)-1]
+		n.becomeFollower(n.term, 0)
+		n.resetElectionTimer()
+		return
+	}
+	n.logger.Info("Elected leader", "term", n.term, "log", n.lastIndex())
+	n.advanceCommit()
+}
+
+// advanceCommit commits the newest entry of the current term stored by a majority
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		votes := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				votes++
+			}
+		}
+		if votes > (len(n.peers)+1)/2 {
+			n.commitIndex = index
+			n.notifyApplier()
+			return
+		}
+	}
+}
+
+func (n *Node) notifyApplier() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) notifyReplicators() {
+	for _, ch := range n.replicate {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run starts elections when the leader is silent and makes a leader cut off from the
+// majority step down
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		switch {
+		case n.state == Leader:
+			if !n.hasQuorum() {
+				n.logger.Warn("Lost contact with the majority, stepping down", "term", n.term)
+				n.becomeFollower(n.term, 0)
+				n.resetElectionTimer()
+			}
+			n.mu.Unlock()
+		case time.Now().After(n.electionDeadline):
+			n.startElection()
+		default:
+			n.mu.Unlock()
+		}
+	}
+}
+
+// hasQuorum reports whether the leader heard from a majority within the election timeout
+func (n *Node) hasQuorum() bool {
+	reached := 1
+	for _, contact := range n.lastContact {
+		if time.Since(contact) < 2*n.config.ElectionTimeout {
+			reached++
+		}
+	}
+	return reached > (len(n.peers)+1)/2
+}
+
+// startElection becomes candidate in a new term and asks the peers for votes, it
+// releases n.mu
+func (n *Node) startElection() {
+	n.term++
+	n.state = Candidate
+	n.votedFor = n.config.ID
+	n.leader = 0
+	n.resetElectionTimer()
+	if err := n.persist(); err != nil {
+		// the vote for itself could be given again after a restart
+		n.state = Follower
+		n.mu.Unlock()
+		return
+	}
+	term := n.term
+	request := requestVoteRequest{Term: term, CandidateID: n.config.ID, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	n.logger.Debug("Starting an election", "term", term)
+	if len(n.peers) == 0 {
+		n.becomeLeader()
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+
+	votes := 1
+	for id := range n.peers {
+		go func(id int) {
+			var response requestVoteResponse
+			if err := n.send(id, rpcRequestVote, request, &response); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if response.Term > n.term {
+				n.becomeFollower(response.Term, 0)
+				return
+			}
+			if !response.Granted || n.state != Candidate || n.term != term || n.stopped() {
+				return
+			}
+			votes++
+			if votes > (len(n.peers)+1)/2 {
+				n.becomeLeader()
+				n.notifyReplicators()
+			}
+		}(id)
+	}
+}
+
+func (n *Node) handleRequestVote(req requestVoteRequest) requestVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return requestVoteResponse{Term: n.term}
+	}
+	if req.Term > n.term {
+		if err := n.becomeFollower(req.Term, 0); err != nil {
+			return requestVoteResponse{Term: n.term}
+		}
+	}
+
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex()
+	if (n.votedFor == 0 || n.votedFor == req.CandidateID) && upToDate {
+		n.votedFor = req.CandidateID
+		if err := n.persist(); err != nil {
+			n.votedFor = 0
+			return requestVoteResponse{Term: n.term}
+		}
+		n.resetElectionTimer()
+		return requestVoteResponse{Term: n.term, Granted: true}
+	}
+	return requestVoteResponse{Term: n.term}
+}
+
+// replicator sends new entries, or heartbeats when there are none, to a peer while
+// the node leads
+func (n *Node) replicator(id int) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		case <-n.replicate[id]:
+		}
+		// keep sending while the peer is behind
+		for n.replicateTo(id) {
+		}
+	}
+}
+
+// replicateTo sends one AppendEntries or InstallSnapshot to a peer, it returns true
+// when more entries should be sent right away
+func (n *Node) replicateTo(id int) bool {
+	n.mu.Lock()
+	if n.state != Leader || n.stopped() {
+		n.mu.Unlock()
+		return false
+	}
+	term := n.term
+	next := n.nextIndex[id]
+	if next <= n.snapshotIndex {
+		n.mu.Unlock()
+		return n.sendSnapshot(id, term)
+	}
+	request := appendEntriesRequest{
+		Term:         term,
+		LeaderID:     n.config.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      n.entriesFrom(next),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	var response appendEntriesResponse
+	if err := n.send(id, rpcAppendEntries, request, &response); err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if response.Term > n.term {
+		n.becomeFollower(response.Term, 0)
+		n.resetElectionTimer()
+		return false
+	}
+	if n.state != Leader || n.term != term {
+		return false
+	}
+	n.lastContact[id] = time.Now()
+	if response.Failed {
+		return false
+	}
+	if !response.Success {
+		n.nextIndex[id] = max(1, min(response.ConflictIndex, n.lastIndex()+1))
+		return true
+	}
+	match := request.PrevLogIndex + uint64(len(request.Entries))
+	if match > n.matchIndex[id] {
+		n.matchIndex[id] = match
+		n.nextIndex[id] = match + 1
+		n.advanceCommit()
+	}
+	return n.nextIndex[id] <= n.lastIndex()
+}
+
+// sendSnapshot sends the snapshot to a peer whose next entry was compacted
+func (n *Node) sendSnapshot(id int, term uint64) bool {
+	n.mu.Lock()
+	snapshot := n.snapshot
+	n.mu.Unlock()
+	request := installSnapshotRequest{
+		Term:      term,
+		LeaderID:  n.config.ID,
+		LastIndex: snapshot.Index,
+		LastTerm:  snapshot.Term,
+		Data:      snapshot.Data,
+	}
+	n.logger.Info("Sending the snapshot", "peer", id, "index", snapshot.Index)
+	var response installSnapshotResponse
+	if err := n.send(id, rpcInstallSnapshot, request, &response); err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if response.Term > n.term {
+		n.becomeFollower(response.Term, 0)
+		n.resetElectionTimer()
+		return false
+	}
+	if n.state != Leader || n.term != term {
+		return false
+	}
+	n.lastContact[id] = time.Now()
+	if response.Failed {
+		return false
+	}
+	if snapshot.Index > n.matchIndex[id] {
+		n.matchIndex[id] = snapshot.Index
+		n.nextIndex[id] = snapshot.Index + 1
+		n.advanceCommit()
+	}
+	return n.nextIndex[id] <= n.lastIndex()
+}
+
+func (n *Node) handleAppendEntries(req appendEntriesRequest) appendEntriesResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return appendEntriesResponse{Term: n.term}
+	}
+	if err := n.becomeFollower(req.Term, req.LeaderID); err != nil {
+		return appendEntriesResponse{Term: n.term, Failed: true}
+	}
+	n.resetElectionTimer()
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return appendEntriesResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	// entries included in the snapshot are committed and already match
+	if req.PrevLogIndex < n.snapshotIndex {
+		skip := n.snapshotIndex - req.PrevLogIndex
+		if skip >= uint64(len(req.Entries)) {
+			return appendEntriesResponse{Term: n.term, Success: true}
+		}
+		req.Entries = req.Entries[skip:]
+		req.PrevLogIndex, req.PrevLogTerm = n.snapshotIndex, n.snapshotTerm
+	}
+	if term := n.termAt(req.PrevLogIndex); term != req.PrevLogTerm {
+		// skip the whole conflicting term
+		conflict := req.PrevLogIndex
+		for conflict > n.snapshotIndex+1 && n.termAt(conflict-1) == term {
+			conflict--
+		}
+		return appendEntriesResponse{Term: n.term, ConflictIndex: conflict}
+	}
+
+	for i, entry := range req.Entries {
+		if entry.Index <= n.lastIndex() && n.termAt(entry.Index) == entry.Term {
+			continue
+		}
+		// the new log is built aside so the saved one is kept if it cannot be written
+		keep := min(entry.Index-n.snapshotIndex-1, uint64(len(n.log)))
+		previous := n.log
+		n.log = append(append([]Entry(nil), n.log[:keep]...), req.Entries[i:]...)
+		if err := n.persist(); err != nil {
+			n.log = previous
+			return appendEntriesResponse{Term: n.term, Failed: true}
+		}
+		break
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		// the entries after the request may not match the leader, the commit index stops at
+		// the last one known to match and never moves back
+		n.commitIndex = max(n.commitIndex, min(req.LeaderCommit, req.PrevLogIndex+uint64(len(req.Entries))))
+		n.notifyApplier()
+	}
+	return appendEntriesResponse{Term: n.term, Success: true}
+}
+
+func (n *Node) handleInstallSnapshot(req installSnapshotRequest) installSnapshotResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return installSnapshotResponse{Term: n.term}
+	}
+	if err := n.becomeFollower(req.Term, req.LeaderID); err != nil {
+		return installSnapshotResponse{Term: n.term, Failed: true}
+	}
+	n.resetElectionTimer()
+	if req.LastIndex <= n.snapshotIndex || req.LastIndex <= n.lastApplied {
+		return installSnapshotResponse{Term: n.term}
+	}
+
+	// entries after the snapshot are kept if the log agrees with it
+	previous := n.log
+	if n.termAt(req.LastIndex) == req.LastTerm {
+		n.log = append([]Entry(nil), n.log[req.LastIndex-n.snapshotIndex:]...)
+	} else {
+		n.log = nil
+	}
+	snapshot := snapshotFile{Index: req.LastIndex, Term: req.LastTerm, Data: req.Data}
+	if err := n.saveSnapshot(snapshot); err != nil {
+		n.log = previous
+		return installSnapshotResponse{Term: n.term, Failed: true}
+	}
+	if err := n.persist(); err != nil {
+		// the saved snapshot is newer than the saved log, New drops the entries it covers
+		n.log = previous
+		return installSnapshotResponse{Term: n.term, Failed: true}
+	}
+	n.snapshotIndex, n.snapshotTerm = req.LastIndex, req.LastTerm
+	n.commitIndex = max(n.commitIndex, req.LastIndex)
+	n.pending = &snapshot
+	n.notifyApplier()
+	n.logger.Info("Installed the snapshot of the leader", "index", req.LastIndex)
+	return installSnapshotResponse{Term: n.term}
+}
+
+// saveSnapshot writes the snapshot to Dir and makes it the latest one
+func (n *Node) saveSnapshot(snapshot snapshotFile) error {
+	if err := n.storage.saveSnapshot(snapshot); err != nil {
+		n.logger.Error("Error saving the snapshot", "error", err)
+		return err
+	}
+	n.snapshot = snapshot
+	return nil
+}
+
+// applier applies the committed entries in order, answers the waiting proposals and
+// compacts the log
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.applyCh:
+		}
+
+		n.mu.Lock()
+		if n.pending != nil {
+			snapshot := n.pending
+			n.pending = nil
+			n.mu.Unlock()
+			if err := n.config.StateMachine.Restore(snapshot.Data); err != nil {
+				n.logger.Error("Error restoring the snapshot", "error", err)
+			}
+			n.mu.Lock()
+			n.lastApplied = max(n.lastApplied, snapshot.Index)
+			n.failWaiters(snapshot.Index)
+		}
+		var entries []Entry
+		// a newer snapshot is restored first, the entries it replaced are gone
+		if n.pending == nil && n.commitIndex > n.lastApplied && n.lastApplied >= n.snapshotIndex {
+			entries = append(entries, n.log[n.lastApplied-n.snapshotIndex:n.commitIndex-n.snapshotIndex]...)
+		}
+		n.mu.Unlock()
+
+		for _, entry := range entries {
+			var result []byte
+			if entry.Command != nil {
+				result = n.config.StateMachine.Apply(entry.Command)
+			}
+
+			n.mu.Lock()
+			n.lastApplied = entry.Index
+			if w, ok := n.waiters[entry.Index]; ok {
+				delete(n.waiters, entry.Index)
+				if w.term == entry.Term {
+					w.ch <- applied{result: result}
+				} else {
+					w.ch <- applied{err: ErrLost}
+				}
+			}
+			n.mu.Unlock()
+		}
+
+		n.mu.Lock()
+		// a snapshot may have arrived while the entries were applied
+		pending := n.pending != nil
+		compact := n.lastApplied-n.snapshotIndex >= n.config.SnapshotThreshold
+		n.mu.Unlock()
+		if pending {
+			n.notifyApplier()
+		} else if compact {
+			n.compact()
+		}
+	}
+}
+
+// failWaiters fails the proposals up to index, replaced by a snapshot before they were applied
+func (n *Node) failWaiters(index uint64) {
+	for i, w := range n.waiters {
+		if i <= index {
+			w.ch <- applied{err: ErrLost}
+			delete(n.waiters, i)
+		}
+	}
+}
+
+// compact replaces the applied entries with a snapshot of the state machine, it is
+// only called by the applier so the state matches lastApplied
+func (n *Node) compact() {
+	data, err := n.config.StateMachine.Snapshot()
+	if err != nil {
+		n.logger.Error("Error taking a snapshot", "error", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index := n.lastApplied
+	if index <= n.snapshotIndex {
+		return
+	}
+	snapshot := snapshotFile{Index: index, Term: n.termAt(index), Data: data}
+	if n.saveSnapshot(snapshot) != nil {
+		// the entries are kept until a later compaction succeeds
+		return
+	}
+	n.log = append([]Entry(nil), n.log[index-n.snapshotIndex:]...)
+	n.snapshotIndex, n.snapshotTerm = snapshot.Index, snapshot.Term
+	// the log is saved again by the next change if this fails, the snapshot already covers its entries
+	n.persist()
+	n.logger.Debug("Compacted the log", "index", index, "remaining", len(n.log))
+}
@@ -0,0 +1,263 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// journal is the state machine, it records the commands in order
+type journal struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (j *journal) Apply(command []byte) []byte {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, string(command))
+	return []byte(fmt.Sprint(len(j.entries)))
+}
+
+func (j *journal) Snapshot() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return json.Marshal(j.entries)
+}
+
+func (j *journal) Restore(snapshot []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = nil
+	return json.Unmarshal(snapshot, &j.entries)
+}
+
+func (j *journal) list() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.entries)
+}
+
+// cluster is a set of nodes on free ports of 127.0.0.1, each with a directory of its own
+type cluster struct {
+	t        *testing.T
+	dir      string
+	peers    []Peer
+	nodes    map[int]*Node
+	journals map[int]*journal
+}
+
+func newCluster(t *testing.T, size int) *cluster {
+	t.Helper()
+	c := &cluster{t: t, dir: t.TempDir(), nodes: make(map[int]*Node), journals: make(map[int]*journal)}
+	listeners := make(map[int]net.Listener)
+	for id := 1; id <= size; id++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[id] = listener
+		c.peers = append(c.peers, Peer{ID: id, Address: listener.Addr().String()})
+	}
+	for id, listener := range listeners {
+		c.nodes[id] = c.newNode(id)
+		c.nodes[id].serve(listener)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+	return c
+}
+
+// newNode creates a node with a new state machine, restoring what was saved in its directory
+func (c *cluster) newNode(id int) *Node {
+	c.t.Helper()
+	var peers []Peer
+	var address string
+	for _, peer := range c.peers {
+		if peer.ID == id {
+			address = peer.Address
+		} else {
+			peers = append(peers, peer)
+		}
+	}
+	j := &journal{}
+	node, err := New(Config{
+		ID:                id,
+		Address:           address,
+		Peers:             peers,
+		Dir:               filepath.Join(c.dir, fmt.Sprintf("node%d", id)),
+		HeartbeatInterval: 20 * time.Millisecond,
+		ElectionTimeout:   100 * time.Millisecond,
+		SnapshotThreshold: 5,
+		StateMachine:      j,
+		Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.journals[id] = j
+	return node
+}
+
+// waitFor polls condition until it holds or fails the test after a few seconds
+func (c *cluster) waitFor(description string, condition func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForLeader waits until one of ids is the leader and the others follow it in its term
+func (c *cluster) waitForLeader(ids ...int) *Node {
+	c.t.Helper()
+	var leader *Node
+	c.waitFor(fmt.Sprintf("a leader among %v", ids), func() bool {
+		leader = nil
+		for _, id := range ids {
+			if c.nodes[id].IsLeader() {
+				leader = c.nodes[id]
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		_, term := leader.Leader()
+		for _, id := range ids {
+			if l, t := c.nodes[id].Leader(); l != leader.ID() || t != term {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// propose proposes the commands to the leader one after the other
+func (c *cluster) propose(leader *Node, commands ...string) {
+	c.t.Helper()
+	for _, command := range commands {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := leader.Propose(ctx, []byte(command))
+		cancel()
+		if err != nil {
+			c.t.Fatalf("proposing %q to node %d: %v", command, leader.ID(), err)
+		}
+	}
+}
+
+// waitForJournals waits until the state machines of ids applied exactly the commands
+func (c *cluster) waitForJournals(commands []string, ids ...int) {
+	c.t.Helper()
+	c.waitFor(fmt.Sprintf("nodes %v to apply %v", ids, commands), func() bool {
+		for _, id := range ids {
+			if !slices.Equal(c.journals[id].list(), commands) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func commands(prefix string, count int) []string {
+	var list []string
+	for i := 1; i <= count; i++ {
+		list = append(list, fmt.Sprintf("%s%d", prefix, i))
+	}
+	return list
+}
+
+func TestLeaderPartitionKeepsCommittedEntries(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitForLeader(1, 2, 3)
+	_, oldTerm := leader.Leader()
+	before := commands("before", 3)
+	c.propose(leader, before...)
+	c.waitForJournals(before, 1, 2, 3)
+
+	// the old leader is cut off from both followers
+	var rest []int
+	for id := 1; id <= 3; id++ {
+		if id != leader.ID() {
+			rest = append(rest, id)
+			c.nodes[id].Isolate(leader.ID())
+		}
+	}
+	leader.Isolate(rest...)
+	newLeader := c.waitForLeader(rest...)
+	if _, term := newLeader.Leader(); term <= oldTerm {
+		t.Errorf("new leader %d has term %d, expected more than %d", newLeader.ID(), term, oldTerm)
+	}
+	during := append(slices.Clone(before), "during")
+	c.propose(newLeader, "during")
+	c.waitForJournals(during, rest...)
+
+	// once healed the old leader follows the new one and catches up
+	for _, node := range c.nodes {
+		node.Heal()
+	}
+	c.waitForLeader(1, 2, 3)
+	c.waitForJournals(during, 1, 2, 3)
+}
+
+func TestRestartRestoresLogAndSnapshot(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitForLeader(1, 2, 3)
+	all := commands("entry", 12)
+	c.propose(leader, all...)
+	c.waitForJournals(all, 1, 2, 3)
+
+	followerID := leader.ID()%3 + 1
+	follower := c.nodes[followerID]
+	c.waitFor("a snapshot on the follower", func() bool { return follower.Status().SnapshotIndex > 0 })
+	saved := follower.Status()
+	follower.Stop()
+
+	restarted := c.newNode(followerID)
+	c.nodes[followerID] = restarted
+	restored := restarted.Status()
+	if restored.SnapshotIndex != saved.SnapshotIndex || restored.LastLogIndex != saved.LastLogIndex || restored.Term != saved.Term {
+		t.Errorf("restored snapshot %d, log %d, term %d; saved snapshot %d, log %d, term %d",
+			restored.SnapshotIndex, restored.LastLogIndex, restored.Term, saved.SnapshotIndex, saved.LastLogIndex, saved.Term)
+	}
+	if applied := c.journals[followerID].list(); len(applied) == 0 || !slices.Equal(applied, all[:len(applied)]) {
+		t.Errorf("state machine restored from the snapshot holds %v, expected a prefix of %v", applied, all)
+	}
+
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	more := append(slices.Clone(all), "after")
+	c.propose(c.waitForLeader(1, 2, 3), "after")
+	c.waitForJournals(more, 1, 2, 3)
+}
+
+func TestProposeToFollowerFails(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.waitForLeader(1, 2, 3)
+	follower := c.nodes[leader.ID()%3+1]
+
+	_, err := follower.Propose(context.Background(), []byte("rejected"))
+	var notLeader *NotLeaderError
+	if !errors.As(err, &notLeader) {
+		t.Fatalf("proposal to a follower returned %v, expected a NotLeaderError", err)
+	}
+	if notLeader.Leader != leader.ID() {
+		t.Errorf("NotLeaderError names %d as the leader, expected %d", notLeader.Leader, leader.ID())
+	}
+}
@@ -0,0 +1,215 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+// RPC types
+const (
+	rpcAppendEntries   = "append_entries"
+	rpcRequestVote     = "request_vote"
+	rpcInstallSnapshot = "install_snapshot"
+)
+
+// envelope wraps every RPC request, one JSON object per line; the reply is the bare response
+type envelope struct {
+	Type string          `json:"type"`
+	From int             `json:"from"`
+	Body json.RawMessage `json:"body"`
+}
+
+type appendEntriesRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     int     `json:"leader_id"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+type appendEntriesResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// on failure, the index the leader should continue from, it skips a whole conflicting term at once
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+	// the entries could not be saved, the leader retries them with the next heartbeat
+	Failed bool `json:"failed,omitempty"`
+}
+
+type requestVoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  int    `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type requestVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type installSnapshotRequest struct {
+	Term      uint64 `json:"term"`
+	LeaderID  int    `json:"leader_id"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+	Data      []byte `json:"data"`
+}
+
+type installSnapshotResponse struct {
+	Term   uint64 `json:"term"`
+	Failed bool   `json:"failed,omitempty"` // the snapshot could not be saved
+}
+
+var errPartitioned = errors.New("raft: peer isolated")
+
+// rpcConn is a connection to a peer that is not used by another call
+type rpcConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// peerClient sends RPCs to a peer, calls run concurrently on pooled connections
+type peerClient struct {
+	peer Peer
+	idle chan *rpcConn
+}
+
+func newPeerClient(peer Peer) *peerClient {
+	return &peerClient{peer: peer, idle: make(chan *rpcConn, 4)}
+}
+
+// call sends a request and decodes the response, within timeout
+func (c *peerClient) call(from int, rpcType string, request, response any, timeout time.Duration) error {
+	var rc *rpcConn
+	select {
+	case rc = <-c.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", c.peer.Address, timeout)
+		if err != nil {
+			return err
+		}
+		rc = &rpcConn{conn: conn, reader: bufio.NewReader(conn)}
+	}
+
+	body, _ := json.Marshal(request)
+	encoded, _ := json.Marshal(envelope{Type: rpcType, From: from, Body: body})
+	rc.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := rc.conn.Write(append(encoded, '\n')); err != nil {
+		rc.conn.Close()
+		return err
+	}
+	line, err := rc.reader.ReadBytes('\n')
+	if err != nil {
+		rc.conn.Close()
+		return err
+	}
+	if err := json.Unmarshal(line, response); err != nil {
+		rc.conn.Close()
+		return err
+	}
+
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return nil
+}
+
+func (c *peerClient) close() {
+	for {
+		select {
+		case rc := <-c.idle:
+			rc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// send calls a peer unless it is isolated from this node
+func (n *Node) send(peerID int, rpcType string, request, response any) error {
+	if n.isolatedFrom(peerID) {
+		return errPartitioned
+	}
+	timeout := n.config.ElectionTimeout
+	if rpcType == rpcInstallSnapshot {
+		timeout *= 10
+	}
+	return n.peers[peerID].call(n.config.ID, rpcType, request, response, timeout)
+}
+
+// accept serves the RPCs of the peers until the node stops
+func (n *Node) accept() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		n.connsMu.Lock()
+		n.conns[conn] = true
+		n.connsMu.Unlock()
+		go n.serveConn(conn)
+	}
+}
+
+// serveConn answers the RPCs sent on a connection
+func (n *Node) serveConn(conn net.Conn) {
+	defer func() {
+		n.connsMu.Lock()
+		delete(n.conns, conn)
+		n.connsMu.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var env envelope
+		if err := json.Unmarshal(line, &env); err != nil {
+			return
+		}
+		// an isolated peer sees the connection drop, as with a network partition
+		if n.isolatedFrom(env.From) {
+			return
+		}
+
+		var response any
+		switch env.Type {
+		case rpcAppendEntries:
+			var req appendEntriesRequest
+			if json.Unmarshal(env.Body, &req) != nil {
+				return
+			}
+			response = n.handleAppendEntries(req)
+		case rpcRequestVote:
+			var req requestVoteRequest
+			if json.Unmarshal(env.Body, &req) != nil {
+				return
+			}
+			response = n.handleRequestVote(req)
+		case rpcInstallSnapshot:
+			var req installSnapshotRequest
+			if json.Unmarshal(env.Body, &req) != nil {
+				return
+			}
+			response = n.handleInstallSnapshot(req)
+		default:
+			return
+		}
+
+		encoded, _ := json.Marshal(response)
+		conn.SetWriteDeadline(time.Now().Add(n.config.ElectionTimeout))
+		if _, err := conn.Write(append(encoded, '\n')); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// state that must survive a restart, written before answering any RPC that changed it
+type persistentState struct {
+	Term     uint64  `json:"term"`
+	VotedFor int     `json:"voted_for"`
+	Log      []Entry `json:"log"` // entries after the snapshot
+}
+
+// snapshot of the state machine with the position of the last entry it includes
+type snapshotFile struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+// storage keeps the state and the snapshot in a directory, nothing is written when dir is empty
+type storage struct {
+	dir string
+}
+
+const (
+	stateFileName    = "state.json"
+	snapshotFileName = "snapshot.json"
+)
+
+func openStorage(dir string) (*storage, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &storage{dir: dir}, nil
+}
+
+// load returns what the previous run saved, zero values for a new node
+func (st *storage) load() (persistentState, snapshotFile, error) {
+	var state persistentState
+	var snapshot snapshotFile
+	if st.dir == "" {
+		return state, snapshot, nil
+	}
+	if err := readJSON(filepath.Join(st.dir, snapshotFileName), &snapshot); err != nil {
+		return state, snapshot, err
+	}
+	if err := readJSON(filepath.Join(st.dir, stateFileName), &state); err != nil {
+		return state, snapshot, err
+	}
+
+	// a crash between saving the snapshot and the compacted log leaves entries it already includes
+	log := state.Log[:0]
+	for _, entry := range state.Log {
+		if entry.Index > snapshot.Index {
+			log = append(log, entry)
+		}
+	}
+	state.Log = log
+	return state, snapshot, nil
+}
+
+func (st *storage) saveState(state persistentState) error {
+	if st.dir == "" {
+		return nil
+	}
+	return writeJSON(filepath.Join(st.dir, stateFileName), state)
+}
+
+func (st *storage) saveSnapshot(snapshot snapshotFile) error {
+	if st.dir == "" {
+		return nil
+	}
+	return writeJSON(filepath.Join(st.dir, snapshotFileName), snapshot)
+}
+
+func readJSON(path string, value any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// writeJSON replaces the file atomically and flushes it to the disk
+func writeJSON(path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
@@ -0,0 +1,259 @@
+package taskserver
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// admin interface configuration, disabled when Address is empty
+type AdminConfig struct {
+	Address string `json:"Address"` // tcp address of the admin listener
+	Token   string `json:"Token"`   // every admin request must carry this token
+}
+
+// request accepted on the admin listener, one JSON object per line
+type adminRequest struct {
+	Op     string `json:"op"` // one of the operations of executeAdminRequest
+	Token  string `json:"token"`
+	ConnID string `json:"conn_id,omitempty"` // used by disconnect
+	Level  string `json:"level,omitempty"`   // used by set_log_level
+}
+
+// connection as shown by the "list" operation
+type connectionSummary struct {
+	ID          string    `json:"conn_id"`
+	Remote      string    `json:"remote"`
+	Listener    string    `json:"listener"`
+	ClientID    int64     `json:"client_id"`
+	Requests    uint64    `json:"requests"`
+	ConnectedAt time.Time `json:"connected_at"`
+	IdleSeconds float64   `json:"idle_seconds"`
+	Busy        bool      `json:"busy"`
+}
+
+// acceptGate lets the admin pause and resume accepting new connections
+type acceptGate struct {
+	mu     sync.Mutex
+	paused bool
+	resume chan struct{}
+}
+
+// pause makes the listeners stop accepting, it reports whether the state changed
+func (g *acceptGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	g.paused = true
+	g.resume = make(chan struct{})
+	return true
+}
+
+// open resumes accepting, it reports whether the state changed
+func (g *acceptGate) open() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		return false
+	}
+	g.paused = false
+	close(g.resume)
+	return true
+}
+
+// isPaused reports whether accepting is paused
+func (g *acceptGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait blocks while accepting is paused
+func (g *acceptGate) wait() {
+	g.mu.Lock()
+	if !g.paused {
+		g.mu.Unlock()
+		return
+	}
+	resume := g.resume
+	g.mu.Unlock()
+	<-resume
+}
+
+// list returns a summary of every open connection, oldest first
+func (r *connectionRegistry) list() []connectionSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	summaries := make([]connectionSummary, 0, len(r.conns))
+	for _, info := range r.conns {
+		summaries = append(summaries, connectionSummary{
+			ID:          info.id,
+			Remote:      info.conn.RemoteAddr().String(),
+			Listener:    info.listener,
+			ClientID:    info.clientID.Load(),
+			Requests:    info.requests.Load(),
+			ConnectedAt: info.connectedAt,
+			IdleSeconds: time.Since(time.Unix(0, info.lastActivity.Load())).Seconds(),
+			Busy:        info.busy.Load(),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].ConnectedAt.Before(summaries[j].ConnectedAt)
+	})
+	return summaries
+}
+
+// disconnect closes the connection with the given id
+func (r *connectionRegistry) disconnect(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, ok := r.conns[id]
+	if !ok {
+		return false
+	}
+	info.kicked.Store(true)
+	info.conn.Close()
+	return true
+}
+
+// startAdminServer serves the admin interface in the background, it is closed by Shutdown
+func (s *Server) startAdminServer(config AdminConfig) error {
+	if config.Address == "" {
+		return nil
+	}
+	if config.Token == "" {
+		return errors.New("admin interface requires a Token")
+	}
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return err
+	}
+	s.addCloser(listener)
+	s.logger.Info("Admin interface listening", "address", listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Error("Admin listener stopped", "error", err)
+				}
+				return
+			}
+			go s.handleAdminConnection(conn)
+		}
+	}()
+	return nil
+}
+
+// handleAdminConnection executes admin requests until the connection is closed
+func (s *Server) handleAdminConnection(conn net.Conn) {
+	defer conn.Close()
+	logger := s.logger.With("admin_remote", conn.RemoteAddr().String())
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		// the token is read for every request, it can be changed by a reload
+		token := s.activeConfig().Admin.Token
+
+		var req adminRequest
+		var response GenericResponse
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			response = GenericResponse{Status: "error", Error: "Invalid JSON", Code: errInvalidJSON}
+		} else if token == "" || subtle.ConstantTimeCompare([]byte(req.Token), []byte(token)) != 1 {
+			logger.Warn("Rejected admin request with invalid token", "op", req.Op)
+			response = GenericResponse{Status: "error", Error: "Invalid admin token", Code: errInvalidToken}
+		} else {
+			response = s.executeAdminRequest(req, logger)
+		}
+
+		if err := sendResponse(conn, response, 10*time.Second); err != nil {
+			return
+		}
+	}
+}
+
+// executeAdminRequest runs an authenticated admin operation
+func (s *Server) executeAdminRequest(req adminRequest, logger *slog.Logger) GenericResponse {
+	success := func(result any) GenericResponse {
+		encoded, _ := json.Marshal(result)
+		return GenericResponse{Status: "success", Result: encoded}
+	}
+
+	switch req.Op {
+	case "list":
+		return success(s.connections.list())
+	case "disconnect":
+		if !s.connections.disconnect(req.ConnID) {
+			return GenericResponse{Status: "error", Error: "Unknown connection", Code: errUnknownConnection}
+		}
+		logger.Info("Connection disconnected by admin", "conn_id", req.ConnID)
+		return success(req.ConnID)
+	case "pause":
+		if s.gate.pause() {
+			logger.Info("Accepting paused by admin")
+		}
+		return success("paused")
+	case "resume":
+		if s.gate.open() {
+			logger.Info("Accepting resumed by admin")
+		}
+		return success("accepting")
+	case "set_log_level":
+		level, err := parseLevel(req.Level)
+		if err != nil {
+			return GenericResponse{Status: "error", Error: err.Error(), Code: errInvalidArgument}
+		}
+		s.logLevel.Set(level)
+		logger.Info("Log level changed by admin", "level", level.String())
+		return success(level.String())
+	case "leader":
+		return success(s.leaderStatus())
+	case "members":
+		if s.membership == nil {
+			return GenericResponse{Status: "error", Error: "Gossip membership not configured", Code: errInvalidArgument}
+		}
+		return success(s.Members())
+	case "jobs":
+		return success(s.jobsStatus())
+	case "batches":
+		return success(s.batchesStatus())
+	case "locks":
+		return success(s.locksStatus())
+	case "cache":
+		return success(s.cacheStatus())
+	case "workers":
+		if s.coordinator == nil {
+			return GenericResponse{Status: "error", Error: "Not a cluster coordinator", Code: errInvalidArgument}
+		}
+		return success(s.clusterWorkers())
+	case "snapshot":
+		if s.coordinator == nil {
+			return GenericResponse{Status: "error", Error: "Snapshots are taken by the cluster coordinator", Code: errInvalidArgument}
+		}
+		result, err := s.takeSnapshot()
+		if err != nil {
+			logger.Warn("Error taking a snapshot", "error", err)
+			code, message := errorResponse(err)
+			return GenericResponse{Status: "error", Error: message, Code: code}
+		}
+		logger.Info("Snapshot taken by admin", "snapshot_id", result.SnapshotID, "file", result.File)
+		return success(result)
+	default:
+		return GenericResponse{Status: "error", Error: "Unknown operation", Code: errUnknownOp}
+	}
+}
@@ -0,0 +1,81 @@
+package taskserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// audit log configuration, the log is disabled when File is empty
+type AuditConfig struct {
+	File        string `json:"File"`
+	MaxSizeMB   int    `json:"MaxSizeMB"`   // rotate above this size, 0 to disable size rotation
+	MaxAgeHours int    `json:"MaxAgeHours"` // rotate after this many hours, 0 to disable time rotation
+	MaxBackups  int    `json:"MaxBackups"`  // rotated files to keep, 0 to keep all
+	Compress    bool   `json:"Compress"`    // gzip rotated files
+}
+
+// one line of the audit log, the AuditQuery command decodes the same structure
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	ConnID      string    `json:"conn_id"`
+	RequestID   string    `json:"request_id"`
+	Remote      string    `json:"remote"`
+	ClientID    int       `json:"client_id"`
+	Task        int       `json:"task"`
+	InputSHA256 string    `json:"input_sha256"`
+	DurationMs  float64   `json:"duration_ms"`
+	Status      string    `json:"status"`
+	ErrorCode   string    `json:"error_code,omitempty"`
+	Replayed    bool      `json:"replayed,omitempty"` // answered with the stored response of an idempotent request
+}
+
+// auditLog appends one JSON line for every executed task
+type auditLog struct {
+	writer *rotatingWriter
+	logger *slog.Logger
+}
+
+// openAuditLog opens the audit log described by the configuration, nil if disabled
+func openAuditLog(config AuditConfig, logger *slog.Logger) (*auditLog, error) {
+	if config.File == "" {
+		return nil, nil
+	}
+	writer, err := newRotatingWriter(config.File, rotateOptions{
+		MaxSize:    int64(config.MaxSizeMB) * 1024 * 1024,
+		MaxAge:     time.Duration(config.MaxAgeHours) * time.Hour,
+		MaxBackups: config.MaxBackups,
+		Compress:   config.Compress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{writer: writer, logger: logger}, nil
+}
+
+// record appends a record to the log, it is a no-op on a disabled log
+func (a *auditLog) record(record auditRecord) {
+	if a == nil {
+		return
+	}
+	line, _ := json.Marshal(record)
+	if _, err := a.writer.Write(append(line, '\n')); err != nil {
+		a.logger.Error("Error writing audit record", "request_id", record.RequestID, "error", err)
+	}
+}
+
+// Close closes the log file
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.writer.Close()
+}
+
+// hashInput returns the hex encoded sha256 of a task input
+func hashInput(input json.RawMessage) string {
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:])
+}
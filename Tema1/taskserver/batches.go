@@ -0,0 +1,751 @@
+package taskserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// atomic batch configuration, disabled when Dir is empty
+//
+// A client sends a batch of tasks to the coordinator with "submit_batch"; the tasks
+// are split among the workers and committed with two-phase commit. Every worker runs
+// its tasks and records the results in Dir before voting, the coordinator records its
+// decision in Dir before announcing it, so a batch is either committed on every worker
+// or on none, also across crashes. The results are only returned once the batch is
+// committed. A worker that prepared a batch and did not hear the decision asks the
+// coordinator for it; a batch the coordinator has no decision for was aborted.
+type BatchConfig struct {
+	Dir                       string `json:"Dir"`                       // where the decision log or the prepared batches are kept
+	PrepareTimeoutSeconds     int    `json:"PrepareTimeoutSeconds"`     // coordinator: time the workers have to run their tasks and vote
+	RetryIntervalMilliseconds int    `json:"RetryIntervalMilliseconds"` // between deliveries of a decision, or questions about one
+}
+
+// batch states, a batch is preparing on the coordinator until it is decided
+const (
+	batchPreparing = "preparing"
+	batchPrepared  = "prepared"
+	batchCommitted = "committed"
+	batchAborted   = "aborted"
+
+	// recorded by the coordinator when every worker acknowledged the decision
+	batchEnded = "ended"
+)
+
+// batchItem is a task of a batch, Index is its position in the batch
+type batchItem struct {
+	Index      int             `json:"index"`
+	TaskNumber int             `json:"task"`
+	Input      json.RawMessage `json:"input,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+}
+
+// batchMessage is the input of "prepare_batch", "commit_batch" and "abort_batch",
+// sent by the coordinator to a worker
+type batchMessage struct {
+	Token   string      `json:"token,omitempty"` // Cluster.Token
+	BatchID string      `json:"batch_id"`
+	Items   []batchItem `json:"items,omitempty"` // tasks of the worker, for prepare
+}
+
+// batchStatus is the answer to "submit_batch" and "batch_status"
+type batchStatus struct {
+	BatchID string      `json:"batch_id"`
+	Status  string      `json:"status"`
+	Items   []batchItem `json:"items,omitempty"` // with their results once committed
+	Reason  string      `json:"reason,omitempty"`
+}
+
+// batchParticipant is a worker taking part in a batch
+type batchParticipant struct {
+	NodeID  string `json:"node_id"`
+	Address string `json:"address"`
+	Items   []int  `json:"items"` // indexes of its tasks
+
+	acked bool
+}
+
+// decisionRecord is a line of the decision log of the coordinator
+type decisionRecord struct {
+	BatchID      string              `json:"batch_id"`
+	Decision     string              `json:"decision"` // committed, aborted or ended
+	Participants []*batchParticipant `json:"participants,omitempty"`
+	Items        []batchItem         `json:"items,omitempty"`
+	Reason       string              `json:"reason,omitempty"`
+	Time         time.Time           `json:"time"`
+}
+
+// coordinatorBatch is a batch as seen by the coordinator
+type coordinatorBatch struct {
+	id           string
+	status       string
+	items        []batchItem
+	reason       string
+	participants []*batchParticipant
+	ended        bool // every participant acknowledged the decision
+}
+
+// participantBatch is the part of a batch run by a worker, also a line of its log
+type participantBatch struct {
+	BatchID string      `json:"batch_id"`
+	State   string      `json:"state"`
+	Items   []batchItem `json:"items,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// batchLog is an append-only file of JSON records, every record is synced before
+// the call returns
+type batchLog struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64 // end of the last record written
+}
+
+// openBatchLog replays the records of the file and opens it for appending. A record
+// is only acknowledged once its newline is synced, so a last line without one was cut
+// short by a crash and is truncated; a record that cannot be replayed is an error.
+func openBatchLog(path string, replay func(line []byte) error) (*batchLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	good := 0 // end of the last complete line
+	for lineNumber := 1; ; lineNumber++ {
+		end := bytes.IndexByte(data[good:], '\n')
+		if end < 0 {
+			break
+		}
+		line := data[good : good+end]
+		if len(bytes.TrimSpace(line)) > 0 {
+			if err := replay(line); err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", path, lineNumber, err)
+			}
+		}
+		good += end + 1
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if good < len(data) {
+		// appending after the torn line would glue the next record to it
+		if err := file.Truncate(int64(good)); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &batchLog{file: file, size: int64(good)}, nil
+}
+
+func (l *batchLog) append(record any) error {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, err := l.file.Write(append(encoded, '\n'))
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// a partial record is removed so the next one starts on a line of its own
+		l.file.Truncate(l.size)
+		return err
+	}
+	l.size += int64(n)
+	return nil
+}
+
+func (l *batchLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// batchStore keeps the batches of the coordinator or of a worker, with their log
+type batchStore struct {
+	log *batchLog
+
+	mu          sync.Mutex
+	coordinated map[string]*coordinatorBatch // on the coordinator
+	parts       map[string]*participantBatch // on a worker
+	lastID      atomic.Uint64
+}
+
+// openBatchStore restores the batches of the node from its log, nil when batches are
+// disabled or the node is not part of a cluster
+func openBatchStore(config Config) (*batchStore, error) {
+	if config.Batches.Dir == "" || config.Cluster.Role == RoleStandalone {
+		return nil, nil
+	}
+	st := &batchStore{coordinated: make(map[string]*coordinatorBatch), parts: make(map[string]*participantBatch)}
+	var err error
+	if config.Cluster.Role == RoleCoordinator {
+		st.log, err = openBatchLog(filepath.Join(config.Batches.Dir, "decisions.log"), func(line []byte) error {
+			var record decisionRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return err
+			}
+			if batch, ok := st.coordinated[record.BatchID]; ok && record.Decision == batchEnded {
+				batch.ended = true
+				return nil
+			}
+			st.coordinated[record.BatchID] = &coordinatorBatch{
+				id:           record.BatchID,
+				status:       record.Decision,
+				items:        record.Items,
+				reason:       record.Reason,
+				participants: record.Participants,
+			}
+			return nil
+		})
+	} else {
+		st.log, err = openBatchLog(filepath.Join(config.Batches.Dir, "prepared.log"), func(line []byte) error {
+			var part participantBatch
+			if err := json.Unmarshal(line, &part); err != nil {
+				return err
+			}
+			// the results are only recorded with the prepared state
+			if previous, ok := st.parts[part.BatchID]; ok && part.Items == nil {
+				part.Items = previous.Items
+			}
+			st.parts[part.BatchID] = &part
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// newBatchID returns an id unique across restarts of the coordinator
+func (st *batchStore) newBatchID() string {
+	return fmt.Sprintf("b%d-%d", time.Now().UnixNano(), st.lastID.Add(1))
+}
+
+// handleBatchRequest executes the batch operations, "submit_batch" on the coordinator,
+// "prepare_batch", "commit_batch" and "abort_batch" on the workers and "batch_status" on both
+func (s *Server) handleBatchRequest(req GenericRequest) GenericResponse {
+	fail := func(code, message string) GenericResponse {
+		return GenericResponse{Status: "error", Error: message, Code: code, RequestID: req.RequestID}
+	}
+	success := func(result any) GenericResponse {
+		encoded, _ := json.Marshal(result)
+		return GenericResponse{Status: "success", Result: encoded, RequestID: req.RequestID}
+	}
+	if s.batches == nil {
+		return fail(errUnknownOp, "Batches not configured")
+	}
+	coordinating := s.coordinator != nil
+
+	switch req.Op {
+	case "submit_batch":
+		if !coordinating {
+			return fail(errUnknownOp, "Batches are submitted to the cluster coordinator")
+		}
+		var input struct {
+			Tasks []batchItem `json:"tasks"`
+		}
+		if err := json.Unmarshal(req.Input, &input); err != nil || len(input.Tasks) == 0 {
+			return fail(errInvalidArgument, `Input must be {"tasks": [{"task": N, "input": ...}, ...]}`)
+		}
+		for i := range input.Tasks {
+			input.Tasks[i].Index, input.Tasks[i].Result = i, nil
+		}
+		status, err := s.runBatch(input.Tasks)
+		if err != nil {
+			return fail(errorResponse(err))
+		}
+		if status.Status != batchCommitted {
+			response := fail(errBatchAborted, status.Reason)
+			response.Result, _ = json.Marshal(status)
+			return response
+		}
+		return success(status)
+	case "batch_status":
+		var input struct {
+			BatchID string `json:"batch_id"`
+		}
+		if err := json.Unmarshal(req.Input, &input); err != nil || input.BatchID == "" {
+			return fail(errInvalidArgument, `Input must be {"batch_id": "..."}`)
+		}
+		status, ok := s.batchStatus(input.BatchID)
+		if !ok {
+			return fail(errUnknownBatch, fmt.Sprintf("Unknown batch %s", input.BatchID))
+		}
+		return success(status)
+	}
+
+	// the messages of the coordinator to a worker
+	if coordinating {
+		return fail(errUnknownOp, "Batch messages are sent to the workers")
+	}
+	var msg batchMessage
+	if err := json.Unmarshal(req.Input, &msg); err != nil || msg.BatchID == "" {
+		return fail(errInvalidArgument, "Invalid batch message")
+	}
+	if !s.checkClusterToken(msg.Token) {
+		return fail(errInvalidToken, "Invalid cluster token")
+	}
+	switch req.Op {
+	case "prepare_batch":
+		part, err := s.prepareBatch(msg)
+		if err != nil {
+			return fail(errBatchAborted, err.Error())
+		}
+		return success(part)
+	case "commit_batch":
+		if err := s.finishBatch(msg.BatchID, batchCommitted); err != nil {
+			return fail(errTaskFailed, err.Error())
+		}
+	default:
+		if err := s.finishBatch(msg.BatchID, batchAborted); err != nil {
+			return fail(errTaskFailed, err.Error())
+		}
+	}
+	return success(nil)
+}
+
+// batchStatus returns what this node knows about a batch, the results of a worker
+// part are only shown once the batch is committed
+func (s *Server) batchStatus(id string) (batchStatus, bool) {
+	st := s.batches
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if batch, ok := st.coordinated[id]; ok {
+		status := batchStatus{BatchID: id, Status: batch.status, Reason: batch.reason}
+		if batch.status == batchCommitted {
+			status.Items = batch.items
+		}
+		return status, true
+	}
+	part, ok := st.parts[id]
+	if !ok {
+		return batchStatus{}, false
+	}
+	status := batchStatus{BatchID: id, Status: part.State}
+	if part.State == batchCommitted {
+		status.Items = part.Items
+	}
+	return status, true
+}
+
+// runBatch splits a batch among the workers and commits it with two-phase commit
+func (s *Server) runBatch(items []batchItem) (batchStatus, error) {
+	config := s.activeConfig()
+	st := s.batches
+	workerTimeout := time.Duration(config.Cluster.WorkerTimeoutSeconds) * time.Second
+	prepareTimeout := time.Duration(config.Batches.PrepareTimeoutSeconds) * time.Second
+
+	// the tasks are spread over as many workers as possible
+	workers := make(map[string]*workerNode)
+	used := make(map[string]bool)
+	parts := make(map[string][]batchItem)
+	var participants []*batchParticipant
+	for _, item := range items {
+		worker := s.coordinator.pick(item.TaskNumber, workerTimeout, used)
+		if worker == nil {
+			worker = s.coordinator.pick(item.TaskNumber, workerTimeout, nil)
+		}
+		if worker == nil {
+			return batchStatus{}, &TaskError{Code: errNoWorkers, Message: fmt.Sprintf("No worker available for task %d", item.TaskNumber)}
+		}
+		if !used[worker.id] {
+			used[worker.id] = true
+			workers[worker.id] = worker
+			participants = append(participants, &batchParticipant{NodeID: worker.id, Address: worker.address})
+		}
+		parts[worker.id] = append(parts[worker.id], item)
+	}
+	for _, participant := range participants {
+		for _, item := range parts[participant.NodeID] {
+			participant.Items = append(participant.Items, item.Index)
+		}
+	}
+
+	batch := &coordinatorBatch{id: st.newBatchID(), status: batchPreparing, items: items, participants: participants}
+	st.mu.Lock()
+	st.coordinated[batch.id] = batch
+	st.mu.Unlock()
+	logger := s.logger.With("batch_id", batch.id)
+	logger.Info("Preparing batch", "tasks", len(items), "workers", len(participants))
+
+	// phase 1, every worker runs its tasks and votes
+	type vote struct {
+		participant *batchParticipant
+		items       []batchItem
+		err         error
+	}
+	votes := make(chan vote, len(participants))
+	for _, participant := range participants {
+		go func(participant *batchParticipant) {
+			msg := batchMessage{Token: config.Cluster.Token, BatchID: batch.id, Items: parts[participant.NodeID]}
+			response, err := s.sendBatchMessage(workers[participant.NodeID], "prepare_batch", msg, prepareTimeout)
+			var part participantBatch
+			if err == nil {
+				err = json.Unmarshal(response.Result, &part)
+			}
+			votes <- vote{participant, part.Items, err}
+		}(participant)
+	}
+	decision, reason := batchCommitted, ""
+	for range participants {
+		v := <-votes
+		if v.err != nil {
+			logger.Warn("Worker did not prepare the batch", "worker", v.participant.NodeID, "error", v.err)
+			decision, reason = batchAborted, fmt.Sprintf("worker %s did not prepare: %v", v.participant.NodeID, v.err)
+			continue
+		}
+		for _, item := range v.items {
+			if item.Index >= 0 && item.Index < len(items) {
+				items[item.Index].Result = item.Result
+			}
+		}
+	}
+
+	// a coordinator shutting down leaves the batch undecided, the workers learn it was aborted
+	select {
+	case <-s.done:
+		return batchStatus{}, &TaskError{Code: errBatchAborted, Message: "Coordinator shutting down"}
+	default:
+	}
+
+	// the decision is durable before any worker hears it
+	record := decisionRecord{BatchID: batch.id, Decision: decision, Participants: participants, Reason: reason, Time: time.Now()}
+	if decision == batchCommitted {
+		record.Items = items
+	}
+	if err := st.log.append(record); err != nil {
+		logger.Error("Error recording the batch decision", "error", err)
+		if decision == batchCommitted {
+			// not recorded means not committed
+			record.Decision, record.Items = batchAborted, nil
+			record.Reason = fmt.Sprintf("decision not recorded: %v", err)
+			decision, reason = record.Decision, record.Reason
+			st.log.append(record)
+		}
+	}
+	st.mu.Lock()
+	batch.status, batch.reason = decision, reason
+	if decision != batchCommitted {
+		batch.items = nil
+	}
+	st.mu.Unlock()
+	if decision == batchCommitted {
+		s.metrics.batchesCommitted.Add(1)
+	} else {
+		s.metrics.batchesAborted.Add(1)
+	}
+	logger.Info("Batch decided", "decision", decision, "reason", reason)
+
+	// phase 2, the workers that cannot be reached get the decision later
+	s.deliverBatchDecision(batch)
+	status, _ := s.batchStatus(batch.id)
+	return status, nil
+}
+
+// sendBatchMessage sends a batch operation to a worker
+func (s *Server) sendBatchMessage(worker *workerNode, op string, msg batchMessage, timeout time.Duration) (GenericResponse, error) {
+	input, _ := json.Marshal(msg)
+	response, _, err := s.forwardToWorker(worker, GenericRequest{Op: op, Input: input}, timeout)
+	if err != nil {
+		return response, err
+	}
+	if response.Status != "success" {
+		return response, fmt.Errorf("%s: %s", response.Code, response.Error)
+	}
+	return response, nil
+}
+
+// deliverBatchDecision sends the decision to the workers that did not acknowledge it,
+// the batch ends when every worker did
+func (s *Server) deliverBatchDecision(batch *coordinatorBatch) {
+	st := s.batches
+	config := s.activeConfig()
+	st.mu.Lock()
+	op := "commit_batch"
+	if batch.status == batchAborted {
+		op = "abort_batch"
+	}
+	st.mu.Unlock()
+	timeout := time.Duration(config.Batches.PrepareTimeoutSeconds) * time.Second
+
+	acked := 0
+	for _, participant := range batch.participants {
+		st.mu.Lock()
+		delivered := participant.acked
+		st.mu.Unlock()
+		if !delivered {
+			worker := s.coordinator.node(participant.NodeID, participant.Address)
+			msg := batchMessage{Token: config.Cluster.Token, BatchID: batch.id}
+			if _, err := s.sendBatchMessage(worker, op, msg, timeout); err != nil {
+				s.logger.Debug("Batch decision not delivered", "batch_id", batch.id, "worker", participant.NodeID, "error", err)
+				continue
+			}
+			st.mu.Lock()
+			participant.acked = true
+			st.mu.Unlock()
+		}
+		acked++
+	}
+	if acked < len(batch.participants) {
+		return
+	}
+	if err := st.log.append(decisionRecord{BatchID: batch.id, Decision: batchEnded, Time: time.Now()}); err != nil {
+		s.logger.Warn("Error recording the end of the batch", "batch_id", batch.id, "error", err)
+		return
+	}
+	st.mu.Lock()
+	batch.ended = true
+	st.mu.Unlock()
+}
+
+// node returns the registered worker with the id, or a worker built from the address
+// recorded with a batch when it is not registered at that address
+func (c *coordinator) node(id, address string) *workerNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if worker, ok := c.workers[id]; ok && worker.address == address {
+		return worker
+	}
+	// no idle connections are kept for a worker that is not registered
+	return &workerNode{id: id, address: address, idle: make(chan *workerConn)}
+}
+
+// runBatchDelivery sends the decisions the workers did not acknowledge yet, also the
+// ones recorded before the coordinator restarted
+func (s *Server) runBatchDelivery() {
+	st := s.batches
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(time.Duration(s.activeConfig().Batches.RetryIntervalMilliseconds) * time.Millisecond):
+		}
+
+		st.mu.Lock()
+		var pending []*coordinatorBatch
+		for _, batch := range st.coordinated {
+			if !batch.ended && batch.status != batchPreparing {
+				pending = append(pending, batch)
+			}
+		}
+		st.mu.Unlock()
+		for _, batch := range pending {
+			s.deliverBatchDecision(batch)
+		}
+	}
+}
+
+// batchDecision answers a worker asking about a batch it prepared; a batch the
+// coordinator does not know was never decided, so it is aborted and recorded as such
+func (s *Server) batchDecision(id string) string {
+	st := s.batches
+	if st == nil {
+		return batchAborted
+	}
+	st.mu.Lock()
+	batch, ok := st.coordinated[id]
+	var status string
+	if ok {
+		status = batch.status
+	}
+	st.mu.Unlock()
+	if ok {
+		return status
+	}
+
+	reason := "no decision recorded before the coordinator restarted"
+	if err := st.log.append(decisionRecord{BatchID: id, Decision: batchAborted, Reason: reason, Time: time.Now()}); err != nil {
+		s.logger.Warn("Error recording the batch decision", "batch_id", id, "error", err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if batch, ok := st.coordinated[id]; ok {
+		return batch.status
+	}
+	// the workers that prepared it ask in turn, nothing is delivered
+	st.coordinated[id] = &coordinatorBatch{id: id, status: batchAborted, reason: reason, ended: true}
+	s.metrics.batchesAborted.Add(1)
+	s.logger.Info("Batch aborted, it was not decided before a restart", "batch_id", id)
+	return batchAborted
+}
+
+// prepareBatch runs the tasks of the worker and records the results before voting;
+// a prepare repeated after the worker voted gets the same vote
+func (s *Server) prepareBatch(msg batchMessage) (participantBatch, error) {
+	st := s.batches
+	st.mu.Lock()
+	part, ok := st.parts[msg.BatchID]
+	st.mu.Unlock()
+	if ok {
+		if part.State == batchAborted {
+			return participantBatch{}, errors.New("batch already aborted")
+		}
+		return *part, nil
+	}
+
+	items := make([]batchItem, len(msg.Items))
+	for i, item := range msg.Items {
+		s.metrics.inFlight.Add(1)
+		result, err := s.handleTask(item.TaskNumber, item.Input)
+		s.metrics.inFlight.Add(-1)
+		if err != nil {
+			// nothing was recorded, the batch is aborted whatever the coordinator decides
+			s.recordBatchPart(participantBatch{BatchID: msg.BatchID, State: batchAborted, Time: time.Now()})
+			return participantBatch{}, fmt.Errorf("task %d at index %d failed: %v", item.TaskNumber, item.Index, err)
+		}
+		items[i] = batchItem{Index: item.Index, TaskNumber: item.TaskNumber, Input: item.Input, Result: result}
+	}
+
+	prepared := participantBatch{BatchID: msg.BatchID, State: batchPrepared, Items: items, Time: time.Now()}
+	st.mu.Lock()
+	// a decision may have arrived while the tasks were running
+	if part, ok := st.parts[msg.BatchID]; ok {
+		st.mu.Unlock()
+		if part.State == batchAborted {
+			return participantBatch{}, errors.New("batch aborted while preparing")
+		}
+		return *part, nil
+	}
+	st.mu.Unlock()
+	if err := s.recordBatchPart(prepared); err != nil {
+		return participantBatch{}, fmt.Errorf("results not recorded: %v", err)
+	}
+	s.logger.Info("Batch prepared", "batch_id", msg.BatchID, "tasks", len(items))
+	return prepared, nil
+}
+
+// recordBatchPart logs the new state of a part of a batch, then applies it
+func (s *Server) recordBatchPart(part participantBatch) error {
+	st := s.batches
+	if err := st.log.append(part); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if previous, ok := st.parts[part.BatchID]; ok && part.Items == nil {
+		part.Items = previous.Items
+	}
+	st.parts[part.BatchID] = &part
+	return nil
+}
+
+// finishBatch applies the decision of the coordinator to the part of the worker, a
+// decision for an unknown batch is remembered so that a late prepare is refused
+func (s *Server) finishBatch(id, state string) error {
+	st := s.batches
+	st.mu.Lock()
+	part, ok := st.parts[id]
+	st.mu.Unlock()
+	if ok && part.State == state {
+		return nil
+	}
+	if ok && part.State != batchPrepared {
+		return fmt.Errorf("batch already %s", part.State)
+	}
+	if err := s.recordBatchPart(participantBatch{BatchID: id, State: state, Time: time.Now()}); err != nil {
+		return err
+	}
+	s.logger.Info("Batch finished", "batch_id", id, "state", state)
+	return nil
+}
+
+// runBatchRecovery asks the coordinator about the batches prepared on this worker that
+// are still waiting for a decision, also the ones prepared before a restart
+func (s *Server) runBatchRecovery() {
+	st := s.batches
+	for {
+		interval := time.Duration(s.activeConfig().Batches.RetryIntervalMilliseconds) * time.Millisecond
+		select {
+		case <-s.done:
+			return
+		case <-time.After(interval):
+		}
+
+		st.mu.Lock()
+		var waiting []string
+		for id, part := range st.parts {
+			// the decision usually arrives right after the vote
+			if part.State == batchPrepared && time.Since(part.Time) > interval {
+				waiting = append(waiting, id)
+			}
+		}
+		st.mu.Unlock()
+		sort.Strings(waiting)
+
+		for _, id := range waiting {
+			decision, err := s.askBatchDecision(id)
+			if err != nil {
+				s.logger.Debug("Coordinator unreachable, batch still in doubt", "batch_id", id, "error", err)
+				break
+			}
+			if decision == batchCommitted || decision == batchAborted {
+				s.logger.Info("Learned the batch decision from the coordinator", "batch_id", id, "decision", decision)
+				s.finishBatch(id, decision)
+			}
+		}
+	}
+}
+
+// askBatchDecision asks the coordinator on its cluster address how a batch was decided
+func (s *Server) askBatchDecision(id string) (string, error) {
+	response, err := s.callCoordinator(clusterMessage{Op: "batch_decision", BatchID: id})
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Decision string `json:"decision"`
+	}
+	err = json.Unmarshal(response.Result, &result)
+	return result.Decision, err
+}
+
+// batchesStatus is returned by the "batches" admin operation
+type batchesStatus struct {
+	Enabled bool           `json:"enabled"`
+	States  map[string]int `json:"states,omitempty"`
+	InDoubt []string       `json:"in_doubt,omitempty"` // decided batches not acknowledged by every worker, or prepared parts without a decision
+}
+
+func (s *Server) batchesStatus() batchesStatus {
+	st := s.batches
+	if st == nil {
+		return batchesStatus{}
+	}
+	status := batchesStatus{Enabled: true, States: make(map[string]int)}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, batch := range st.coordinated {
+		status.States[batch.status]++
+		if !batch.ended && batch.status != batchPreparing {
+			status.InDoubt = append(status.InDoubt, id)
+		}
+	}
+	for id, part := range st.parts {
+		status.States[part.State]++
+		if part.State == batchPrepared {
+			status.InDoubt = append(status.InDoubt, id)
+		}
+	}
+	sort.Strings(status.InDoubt)
+	return status
+}
@@ -0,0 +1,520 @@
+package taskserver
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/gossip"
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/hashring"
+)
+
+// name of the built-in middleware answering tasks from the result cache
+const CacheMiddleware = "cache"
+
+// cluster-wide result cache configuration, disabled when Address is empty
+//
+// Results are keyed by task and canonical input and stored on the ReplicationFactor
+// nodes owning the key on a consistent hash ring. The ring holds the gossip members
+// announcing a cache address, or only this server without gossip; when the members
+// change the keys are handed off to their new owners.
+type CacheConfig struct {
+	Address          string `json:"Address"`          // tcp address of the lookups and stores of the other nodes
+	AdvertiseAddress string `json:"AdvertiseAddress"` // announced to the others, default Address
+	Token            string `json:"Token"`            // required from the other nodes when set
+	Tasks            []int  `json:"Tasks"`            // tasks whose results are cached, every task when empty; exclusive tasks never are
+
+	ReplicationFactor   int `json:"ReplicationFactor"` // nodes storing each result
+	VirtualNodes        int `json:"VirtualNodes"`      // points of every node on the ring
+	TTLSeconds          int `json:"TTLSeconds"`
+	MaxEntries          int `json:"MaxEntries"`          // stored on this node, the least recently used are evicted
+	TimeoutMilliseconds int `json:"TimeoutMilliseconds"` // of a lookup or store on another node
+}
+
+// cacheEntry is a result stored on this node
+type cacheEntry struct {
+	key     string
+	value   json.RawMessage
+	expires time.Time
+}
+
+// resultCache holds the results owned by this server and the ring placing the keys
+type resultCache struct {
+	config CacheConfig
+	self   string // name of this server on the ring
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // values are *cacheEntry
+	lru     list.List                // most recently used first
+
+	ringMu    sync.RWMutex
+	ring      *hashring.Ring
+	addresses map[string]string // cache address of every node on the ring
+
+	peersMu sync.Mutex
+	peers   map[string]*cachePeer // by address
+
+	changed chan struct{} // signaled when the membership changes
+}
+
+func newResultCache(config CacheConfig, self string) *resultCache {
+	if config.Address == "" {
+		return nil
+	}
+	c := &resultCache{
+		config:    config,
+		self:      self,
+		entries:   make(map[string]*list.Element),
+		ring:      hashring.New(config.VirtualNodes),
+		addresses: map[string]string{self: config.AdvertiseAddress},
+		peers:     make(map[string]*cachePeer),
+		changed:   make(chan struct{}, 1),
+	}
+	c.ring.Add(self)
+	return c
+}
+
+// cacheKey identifies a result by task and input, inputs differing only in spacing or
+// in the order of object keys share the key
+func cacheKey(task int, input json.RawMessage) (string, bool) {
+	// numbers are kept as written, large integers must not collide once rounded
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return "", false
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(append([]byte(fmt.Sprintf("%d:", task)), canonical...))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// get returns a stored result that has not expired
+func (c *resultCache) get(key string, now time.Time) (json.RawMessage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if now.After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.value, true
+}
+
+// put stores a result, evicting the least recently used ones above MaxEntries
+func (c *resultCache) put(key string, value json.RawMessage, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.value, entry.expires = value, expires
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	for len(c.entries) > c.config.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *resultCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// stored returns a copy of the entries that have not expired
+func (c *resultCache) stored(now time.Time) []cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]cacheEntry, 0, len(c.entries))
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		if entry := element.Value.(*cacheEntry); now.Before(entry.expires) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+func (c *resultCache) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// owners returns the nodes storing a key and their cache addresses
+func (c *resultCache) owners(key string) ([]string, map[string]string) {
+	c.ringMu.RLock()
+	defer c.ringMu.RUnlock()
+	return c.ring.GetN(key, c.config.ReplicationFactor), c.addresses
+}
+
+// cacheMessage is a lookup or store sent to the node owning a key
+type cacheMessage struct {
+	Op        string          `json:"op"` // "get" or "put"
+	Token     string          `json:"token,omitempty"`
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	ExpiresAt time.Time       `json:"expires_at,omitempty"`
+}
+
+// cacheReply answers a cacheMessage, Found and Value are set by a successful lookup
+type cacheReply struct {
+	Status string          `json:"status"`
+	Found  bool            `json:"found,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Code   string          `json:"code,omitempty"`
+}
+
+// cachePeer keeps idle connections to the cache of another node
+type cachePeer struct {
+	address string
+	mu      sync.Mutex
+	idle    []*cacheConn
+}
+
+type cacheConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// idle connections kept for every peer
+const maxIdleCacheConns = 4
+
+// call sends a message on an idle connection or a new one; an idle connection closed by
+// the other side is replaced once
+func (p *cachePeer) call(msg cacheMessage, timeout time.Duration) (cacheReply, error) {
+	p.mu.Lock()
+	var conn *cacheConn
+	if n := len(p.idle); n > 0 {
+		conn, p.idle = p.idle[n-1], p.idle[:n-1]
+	}
+	p.mu.Unlock()
+	if conn != nil {
+		reply, err := p.exchange(conn, msg, timeout)
+		if err == nil {
+			return reply, p.check(reply)
+		}
+	}
+
+	raw, err := net.DialTimeout("tcp", p.address, timeout)
+	if err != nil {
+		return cacheReply{}, err
+	}
+	reply, err := p.exchange(&cacheConn{Conn: raw, reader: bufio.NewReader(raw)}, msg, timeout)
+	if err != nil {
+		return reply, err
+	}
+	return reply, p.check(reply)
+}
+
+// exchange writes a message and reads the reply, the connection is kept for the next
+// call unless it failed or the other side closes it after an error
+func (p *cachePeer) exchange(conn *cacheConn, msg cacheMessage, timeout time.Duration) (cacheReply, error) {
+	var reply cacheReply
+	encoded, _ := json.Marshal(msg)
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err := conn.Write(append(encoded, '\n'))
+	var line []byte
+	if err == nil {
+		line, err = conn.reader.ReadBytes('\n')
+	}
+	if err == nil {
+		err = json.Unmarshal(line, &reply)
+	}
+	if err != nil || reply.Status != "success" {
+		conn.Close()
+		return reply, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) < maxIdleCacheConns {
+		p.idle = append(p.idle, conn)
+	} else {
+		conn.Close()
+	}
+	return reply, nil
+}
+
+func (p *cachePeer) check(reply cacheReply) error {
+	if reply.Status != "success" {
+		return fmt.Errorf("%s: %s", reply.Code, reply.Error)
+	}
+	return nil
+}
+
+// send delivers a message to the cache listening on address
+func (c *resultCache) send(address string, msg cacheMessage) (cacheReply, error) {
+	c.peersMu.Lock()
+	peer, ok := c.peers[address]
+	if !ok {
+		peer = &cachePeer{address: address}
+		c.peers[address] = peer
+	}
+	c.peersMu.Unlock()
+	msg.Token = c.config.Token
+	return peer.call(msg, time.Duration(c.config.TimeoutMilliseconds)*time.Millisecond)
+}
+
+// cacheable reports whether the results of a task are cached
+func (c *resultCache) cacheable(task int) bool {
+	return len(c.config.Tasks) == 0 || slices.Contains(c.config.Tasks, task)
+}
+
+// cacheResults answers a task from the node owning its result, or executes it and
+// stores the result on the owners
+func (s *Server) cacheResults(next Handler) Handler {
+	c := s.cache
+	return func(req *Request) (json.RawMessage, error) {
+		// an exclusive task runs under its lock every time, a cached answer would bypass it
+		if !c.cacheable(req.TaskNumber) || s.exclusiveTask(req.TaskNumber) {
+			return next(req)
+		}
+		key, ok := cacheKey(req.TaskNumber, req.Input)
+		if !ok {
+			// invalid input, the task reports the error
+			return next(req)
+		}
+		owners, addresses := c.owners(key)
+		if value, owner, found := s.cacheLookup(key, owners, addresses); found {
+			req.Logger.Debug("Result served from the cache", "owner", owner)
+			return value, nil
+		}
+		s.metrics.cacheMisses.Add(1)
+
+		result, err := next(req)
+		if err == nil {
+			expires := time.Now().Add(time.Duration(c.config.TTLSeconds) * time.Second)
+			go s.cacheStore(key, result, expires, owners, addresses)
+		}
+		return result, err
+	}
+}
+
+// cacheLookup asks the owners of a key in ring order, an owner that cannot be reached is skipped
+func (s *Server) cacheLookup(key string, owners []string, addresses map[string]string) (json.RawMessage, string, bool) {
+	c := s.cache
+	// a copy left here by a rebalance that has not finished is as good as the owner's
+	if value, ok := c.get(key, time.Now()); ok {
+		s.metrics.cacheHits.Add(1)
+		return value, c.self, true
+	}
+	for _, owner := range owners {
+		if owner == c.self {
+			continue
+		}
+		reply, err := c.send(addresses[owner], cacheMessage{Op: "get", Key: key})
+		if err != nil {
+			s.logger.Debug("Cache lookup failed", "owner", owner, "error", err)
+			continue
+		}
+		if reply.Found {
+			s.metrics.cacheRemoteHits.Add(1)
+			return reply.Value, owner, true
+		}
+	}
+	return nil, "", false
+}
+
+// cacheStore stores a result on every owner of its key, best effort
+func (s *Server) cacheStore(key string, value json.RawMessage, expires time.Time, owners []string, addresses map[string]string) {
+	c := s.cache
+	for _, owner := range owners {
+		if owner == c.self {
+			c.put(key, value, expires)
+			continue
+		}
+		if _, err := c.send(addresses[owner], cacheMessage{Op: "put", Key: key, Value: value, ExpiresAt: expires}); err != nil {
+			s.logger.Debug("Cache store failed", "owner", owner, "error", err)
+		}
+	}
+}
+
+// startCacheListener accepts the lookups and stores of the other nodes
+func (s *Server) startCacheListener(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.addCloser(listener)
+	s.logger.Info("Result cache listening", "address", listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Error("Cache listener stopped", "error", err)
+				}
+				return
+			}
+			go s.handleCacheConnection(conn)
+		}
+	}()
+	return nil
+}
+
+// idle cache connections are closed after this long
+const cacheIdleTimeout = time.Minute
+
+// handleCacheConnection answers the messages of another node until it disconnects
+func (s *Server) handleCacheConnection(conn net.Conn) {
+	defer conn.Close()
+	c := s.cache
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(cacheIdleTimeout))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var msg cacheMessage
+		reply := cacheReply{Status: "success"}
+		switch {
+		case json.Unmarshal(line, &msg) != nil:
+			reply = cacheReply{Status: "error", Error: "Invalid JSON", Code: errInvalidJSON}
+		case c.config.Token != "" && subtle.ConstantTimeCompare([]byte(msg.Token), []byte(c.config.Token)) != 1:
+			s.logger.Warn("Rejected cache request with invalid token", "remote", conn.RemoteAddr().String())
+			reply = cacheReply{Status: "error", Error: "Invalid cache token", Code: errInvalidToken}
+		case msg.Op == "get":
+			reply.Value, reply.Found = c.get(msg.Key, time.Now())
+		case msg.Op == "put" && msg.Value != nil:
+			c.put(msg.Key, msg.Value, msg.ExpiresAt)
+		default:
+			reply = cacheReply{Status: "error", Error: "Unknown operation", Code: errUnknownOp}
+		}
+
+		encoded, _ := json.Marshal(reply)
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(append(encoded, '\n')); err != nil || reply.Status != "success" {
+			return
+		}
+	}
+}
+
+// cacheMembershipChanged is called by the gossip membership, it must not block
+func (s *Server) cacheMembershipChanged(gossip.Event) {
+	select {
+	case s.cache.changed <- struct{}{}:
+	default:
+	}
+}
+
+// the ring is also checked this often, in case a change was missed
+const cacheRingCheckInterval = 5 * time.Second
+
+// runCacheRebalance rebuilds the ring when the membership changes
+func (s *Server) runCacheRebalance() {
+	ticker := time.NewTicker(cacheRingCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.cache.changed:
+		case <-ticker.C:
+		}
+		s.rebalanceCache(s.Members())
+	}
+}
+
+// rebalanceCache places the live members announcing a cache on the ring, pushes the
+// local results to the nodes that became their owners and drops the ones this server
+// no longer owns
+func (s *Server) rebalanceCache(members []gossip.Member) {
+	c := s.cache
+	addresses := map[string]string{c.self: c.config.AdvertiseAddress}
+	for _, member := range members {
+		// a suspect member keeps its keys, it is probably still there
+		address := member.Meta["cache_address"]
+		if address != "" && (member.State == gossip.Alive || member.State == gossip.Suspect) {
+			addresses[member.Name] = address
+		}
+	}
+	ring := hashring.New(c.config.VirtualNodes)
+	for name := range addresses {
+		ring.Add(name)
+	}
+
+	c.ringMu.Lock()
+	previous := c.ring
+	if slices.Equal(previous.Nodes(), ring.Nodes()) {
+		c.ringMu.Unlock()
+		return
+	}
+	c.ring, c.addresses = ring, addresses
+	c.ringMu.Unlock()
+	s.logger.Info("Cache ring changed", "nodes", ring.Nodes())
+
+	moved, dropped := 0, 0
+	for _, entry := range c.stored(time.Now()) {
+		before := previous.GetN(entry.key, c.config.ReplicationFactor)
+		after := ring.GetN(entry.key, c.config.ReplicationFactor)
+		for _, owner := range after {
+			if owner == c.self || slices.Contains(before, owner) {
+				continue
+			}
+			_, err := c.send(addresses[owner], cacheMessage{Op: "put", Key: entry.key, Value: entry.value, ExpiresAt: entry.expires})
+			if err != nil {
+				s.logger.Debug("Cache handoff failed", "owner", owner, "error", err)
+				continue
+			}
+			moved++
+		}
+		if !slices.Contains(after, c.self) {
+			c.remove(entry.key)
+			dropped++
+		}
+	}
+	s.metrics.cacheHandoffs.Add(uint64(moved))
+	if moved > 0 || dropped > 0 {
+		s.logger.Info("Cache rebalanced", "handed_off", moved, "dropped", dropped)
+	}
+}
+
+// cacheStatus is returned by the "cache" admin operation
+type cacheStatus struct {
+	Enabled           bool     `json:"enabled"`
+	Node              string   `json:"node,omitempty"`
+	Ring              []string `json:"ring,omitempty"`
+	Entries           int      `json:"entries"`
+	ReplicationFactor int      `json:"replication_factor,omitempty"`
+}
+
+func (s *Server) cacheStatus() cacheStatus {
+	c := s.cache
+	if c == nil {
+		return cacheStatus{}
+	}
+	c.ringMu.RLock()
+	ring := c.ring.Nodes()
+	c.ringMu.RUnlock()
+	return cacheStatus{Enabled: true, Node: c.self, Ring: ring, Entries: c.count(), ReplicationFactor: c.config.ReplicationFactor}
+}
@@ -0,0 +1,563 @@
+package taskserver
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cluster roles
+const (
+	RoleStandalone  = ""
+	RoleCoordinator = "coordinator"
+	RoleWorker      = "worker"
+)
+
+// cluster configuration
+//
+// A coordinator accepts client connections like a standalone server but forwards
+// every task to one of the workers registered on its cluster Address. A worker is a
+// normal server that also registers with CoordinatorAddress and reports its load.
+type ClusterConfig struct {
+	Role                     string `json:"Role"`                     // empty for a standalone server, coordinator or worker
+	NodeID                   string `json:"NodeID"`                   // unique name of the node, defaults to Host:Port
+	Address                  string `json:"Address"`                  // coordinator: tcp address workers register on
+	CoordinatorAddress       string `json:"CoordinatorAddress"`       // worker: cluster address of the coordinator
+	AdvertiseAddress         string `json:"AdvertiseAddress"`         // worker: task address the coordinator forwards to, defaults to Host:Port
+	Token                    string `json:"Token"`                    // shared secret required to register, optional
+	HeartbeatIntervalSeconds int    `json:"HeartbeatIntervalSeconds"` // how often workers report their load
+	WorkerTimeoutSeconds     int    `json:"WorkerTimeoutSeconds"`     // a silent worker gets no tasks after this long
+	ForwardTimeoutSeconds    int    `json:"ForwardTimeoutSeconds"`    // coordinator: time a worker has to answer a task
+}
+
+// message sent by a worker on the cluster channel, one JSON object per line
+type clusterMessage struct {
+	Op      string `json:"op"` // register, heartbeat, batch_decision, snapshot_marker or snapshot_state
+	NodeID  string `json:"node_id"`
+	Address string `json:"address,omitempty"` // used by register
+	Tasks   []int  `json:"tasks,omitempty"`   // used by register
+	Load    int64  `json:"load"`              // tasks being executed by the worker
+	Token   string `json:"token,omitempty"`
+	BatchID string `json:"batch_id,omitempty"` // used by batch_decision
+
+	Marker *snapshotMarker `json:"marker,omitempty"` // used by snapshot_marker
+	State  *nodeSnapshot   `json:"state,omitempty"`  // used by snapshot_state
+}
+
+// workerNode is a worker as seen by the coordinator
+type workerNode struct {
+	id      string
+	address string
+	tasks   map[int]bool
+
+	// updated by heartbeats
+	load          atomic.Int64
+	lastHeartbeat atomic.Int64 // unix nanoseconds
+
+	outstanding atomic.Int64 // tasks forwarded and not answered yet
+	failures    atomic.Int64 // consecutive forwarding failures
+	forwarded   atomic.Uint64
+
+	idle chan *workerConn // connections ready for the next task
+}
+
+// workerConn is a connection from the coordinator to the task listener of a worker
+type workerConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// workers with this many consecutive failures are skipped until their next heartbeat
+const maxWorkerFailures = 3
+
+// idle connections kept for every worker
+const workerPoolSize = 16
+
+// coordinator keeps the registered workers and dispatches tasks to them
+type coordinator struct {
+	mu      sync.Mutex
+	workers map[string]*workerNode
+}
+
+func newCoordinator() *coordinator {
+	return &coordinator{workers: make(map[string]*workerNode)}
+}
+
+// healthy reports whether the worker can receive tasks
+func (w *workerNode) healthy(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, w.lastHeartbeat.Load())) <= timeout && w.failures.Load() < maxWorkerFailures
+}
+
+// register adds a worker or updates the one with the same id
+func (c *coordinator) register(msg clusterMessage) *workerNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	worker, ok := c.workers[msg.NodeID]
+	if !ok || worker.address != msg.Address {
+		if ok {
+			worker.closeIdle()
+		}
+		worker = &workerNode{id: msg.NodeID, address: msg.Address, idle: make(chan *workerConn, workerPoolSize)}
+		c.workers[msg.NodeID] = worker
+	}
+	worker.tasks = make(map[int]bool, len(msg.Tasks))
+	for _, task := range msg.Tasks {
+		worker.tasks[task] = true
+	}
+	worker.heartbeat(msg.Load)
+	return worker
+}
+
+// heartbeat records the load reported by the worker
+func (w *workerNode) heartbeat(load int64) {
+	w.load.Store(load)
+	w.lastHeartbeat.Store(time.Now().UnixNano())
+	w.failures.Store(0)
+}
+
+// pick returns the healthy worker running the task with the lowest load, excluding the ones already tried
+func (c *coordinator) pick(task int, timeout time.Duration, tried map[string]bool) *workerNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var best *workerNode
+	var bestLoad int64
+	for _, worker := range c.workers {
+		if tried[worker.id] || !worker.tasks[task] || !worker.healthy(timeout) {
+			continue
+		}
+		// the reported load lags behind, the tasks forwarded since then are added to it
+		load := worker.load.Load() + worker.outstanding.Load()
+		// between equally loaded workers the one that got fewer tasks spreads them evenly
+		if best == nil || load < bestLoad || (load == bestLoad && worker.forwarded.Load() < best.forwarded.Load()) {
+			best, bestLoad = worker, load
+		}
+	}
+	return best
+}
+
+// forward sends a request to the worker and returns its response; sent reports whether
+// the request may have reached the worker
+func (w *workerNode) forward(req GenericRequest, timeout time.Duration) (response GenericResponse, sent bool, err error) {
+	wc, err := w.conn(timeout)
+	if err != nil {
+		return response, false, err
+	}
+	if err := wc.send(req, timeout); err != nil {
+		return response, false, err
+	}
+	response, err = w.receive(wc)
+	return response, true, err
+}
+
+// conn returns a pooled connection to the worker or opens a new one
+func (w *workerNode) conn(timeout time.Duration) (*workerConn, error) {
+	if wc := w.idleConn(); wc != nil {
+		return wc, nil
+	}
+	conn, err := net.DialTimeout("tcp", w.address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	wc := &workerConn{conn: conn, reader: bufio.NewReader(conn)}
+	// the welcome message is not a response
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := wc.reader.ReadString('\n'); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return wc, nil
+}
+
+// send writes a request, the connection is closed if it fails
+func (wc *workerConn) send(req GenericRequest, timeout time.Duration) error {
+	encoded, _ := json.Marshal(req)
+	wc.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := wc.conn.Write(append(encoded, '\n')); err != nil {
+		// a pooled connection may have been closed by the worker while idle
+		wc.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// receive reads the response to the request sent on the connection and returns the
+// connection to the pool
+func (w *workerNode) receive(wc *workerConn) (response GenericResponse, err error) {
+	line, err := wc.reader.ReadString('\n')
+	if err == nil {
+		err = json.Unmarshal([]byte(line), &response)
+	}
+	if err != nil {
+		wc.conn.Close()
+		return response, err
+	}
+
+	select {
+	case w.idle <- wc:
+	default:
+		wc.conn.Close()
+	}
+	return response, nil
+}
+
+// idleConn returns a pooled connection still open on the worker side, nil if there is none
+func (w *workerNode) idleConn() *workerConn {
+	for {
+		select {
+		case wc := <-w.idle:
+			// the worker closes connections idle for too long
+			if !peerClosed(wc.conn, wc.reader) {
+				return wc
+			}
+			wc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// closeIdle closes the pooled connections of a worker that left or moved
+func (w *workerNode) closeIdle() {
+	for {
+		select {
+		case wc := <-w.idle:
+			wc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// dispatch is the task handler of a coordinator, it forwards the request to the least
+// loaded worker; a request that reached a failing worker is only retried elsewhere if
+// it carries an idempotency key
+func (s *Server) dispatch(req *Request) (json.RawMessage, error) {
+	config := s.activeConfig()
+	workerTimeout := time.Duration(config.Cluster.WorkerTimeoutSeconds) * time.Second
+	forwardTimeout := time.Duration(config.Cluster.ForwardTimeoutSeconds) * time.Second
+
+	forwarded := req.GenericRequest
+	forwarded.Op, forwarded.AuthToken, forwarded.SessionID = "", "", ""
+	// the worker scopes the idempotency key by the client, not by the pooled connection
+	forwarded.ForwardedScope = req.Scope
+	// the trace context is the execute span of this server, set in handleConnection
+
+	tried := make(map[string]bool)
+	for {
+		worker := s.coordinator.pick(req.TaskNumber, workerTimeout, tried)
+		if worker == nil {
+			if len(tried) == 0 {
+				return nil, &TaskError{Code: errNoWorkers, Message: "No worker available for the task"}
+			}
+			return nil, &TaskError{Code: errWorkerFailed, Message: "Workers failed to execute the task"}
+		}
+		tried[worker.id] = true
+
+		worker.outstanding.Add(1)
+		response, sent, err := s.forwardToWorker(worker, forwarded, forwardTimeout)
+		worker.outstanding.Add(-1)
+		if err == nil {
+			worker.failures.Store(0)
+			worker.forwarded.Add(1)
+			req.Logger.Debug("Task forwarded", "worker", worker.id)
+			if response.Status != "success" {
+				if response.Code == "" {
+					response.Code = errTaskFailed
+				}
+				return nil, &TaskError{Code: response.Code, Message: response.Error}
+			}
+			return response.Result, nil
+		}
+
+		worker.failures.Add(1)
+		req.Logger.Warn("Error forwarding task", "worker", worker.id, "error", err)
+		if sent && req.IdempotencyKey == "" {
+			return nil, &TaskError{Code: errWorkerFailed, Message: "Worker failed while executing the task"}
+		}
+	}
+}
+
+// workerSummary is a worker as shown by the "workers" admin operation
+type workerSummary struct {
+	ID            string  `json:"node_id"`
+	Address       string  `json:"address"`
+	Tasks         []int   `json:"tasks"`
+	Healthy       bool    `json:"healthy"`
+	Load          int64   `json:"load"`
+	Outstanding   int64   `json:"outstanding"`
+	Failures      int64   `json:"failures"`
+	Forwarded     uint64  `json:"forwarded"`
+	LastHeartbeat float64 `json:"seconds_since_heartbeat"`
+}
+
+// list returns a summary of every registered worker
+func (c *coordinator) list(timeout time.Duration) []workerSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	summaries := make([]workerSummary, 0, len(c.workers))
+	for _, worker := range c.workers {
+		tasks := make([]int, 0, len(worker.tasks))
+		for task := range worker.tasks {
+			tasks = append(tasks, task)
+		}
+		sort.Ints(tasks)
+		summaries = append(summaries, workerSummary{
+			ID:            worker.id,
+			Address:       worker.address,
+			Tasks:         tasks,
+			Healthy:       worker.healthy(timeout),
+			Load:          worker.load.Load(),
+			Outstanding:   worker.outstanding.Load(),
+			Failures:      worker.failures.Load(),
+			Forwarded:     worker.forwarded.Load(),
+			LastHeartbeat: time.Since(time.Unix(0, worker.lastHeartbeat.Load())).Seconds(),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+	return summaries
+}
+
+// startClusterListener accepts worker registrations on the coordinator, it is closed by Shutdown
+func (s *Server) startClusterListener(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.addCloser(listener)
+	s.logger.Info("Cluster coordinator listening", "address", listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					s.logger.Error("Cluster listener stopped", "error", err)
+				}
+				return
+			}
+			go s.handleWorkerConnection(conn)
+		}
+	}()
+	return nil
+}
+
+// handleWorkerConnection reads the registration and heartbeats of a worker
+func (s *Server) handleWorkerConnection(conn net.Conn) {
+	defer conn.Close()
+	logger := s.logger.With("worker_remote", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+
+	// the workers notice the coordinator is gone and register again once it is back
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	var worker *workerNode
+	for {
+		// a worker that stops sending heartbeats is not removed, it just stops being healthy
+		config := s.activeConfig().Cluster
+		conn.SetReadDeadline(time.Now().Add(time.Duration(config.WorkerTimeoutSeconds) * time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if worker != nil {
+				logger.Warn("Worker disconnected")
+			}
+			return
+		}
+
+		var msg clusterMessage
+		var response GenericResponse
+		switch {
+		case json.Unmarshal([]byte(line), &msg) != nil:
+			response = GenericResponse{Status: "error", Error: "Invalid JSON", Code: errInvalidJSON}
+		case config.Token != "" && subtle.ConstantTimeCompare([]byte(msg.Token), []byte(config.Token)) != 1:
+			logger.Warn("Rejected worker with invalid token", "worker", msg.NodeID)
+			response = GenericResponse{Status: "error", Error: "Invalid cluster token", Code: errInvalidToken}
+		case msg.Op == "batch_decision" && msg.BatchID != "":
+			// a worker asking about a batch it prepared, on a connection of its own
+			result, _ := json.Marshal(map[string]string{"decision": s.batchDecision(msg.BatchID)})
+			response = GenericResponse{Status: "success", Result: result}
+		case msg.Op == "snapshot_marker" && msg.Marker != nil && s.snapshots != nil:
+			// markers and states of the snapshots also come on connections of their own
+			s.receiveMarker(*msg.Marker)
+			response = GenericResponse{Status: "success"}
+		case msg.Op == "snapshot_state" && msg.State != nil && s.snapshots != nil:
+			s.snapshots.collect(*msg.State)
+			response = GenericResponse{Status: "success"}
+		case msg.Op == "register" && msg.NodeID != "" && msg.Address != "":
+			worker = s.coordinator.register(msg)
+			logger = logger.With("worker", worker.id)
+			logger.Info("Worker registered", "address", msg.Address, "tasks", msg.Tasks)
+			// the worker only accepts forwarded requests tagged with this id
+			result, _ := json.Marshal(map[string]string{"node_id": config.NodeID})
+			response = GenericResponse{Status: "success", Result: result}
+		case msg.Op == "heartbeat" && worker != nil && msg.NodeID == worker.id:
+			worker.heartbeat(msg.Load)
+			response = GenericResponse{Status: "success"}
+		default:
+			response = GenericResponse{Status: "error", Error: "Unknown operation", Code: errUnknownOp}
+		}
+
+		if err := sendResponse(conn, response, 5*time.Second); err != nil || response.Status != "success" {
+			return
+		}
+	}
+}
+
+// joinCluster registers the worker with the coordinator and sends heartbeats until
+// the server shuts down, reconnecting when the coordinator is unreachable
+func (s *Server) joinCluster() {
+	for {
+		err := s.sendHeartbeatsToCoordinator()
+		interval := time.Duration(s.activeConfig().Cluster.HeartbeatIntervalSeconds) * time.Second
+		if err != nil {
+			s.logger.Warn("Lost connection to the coordinator, retrying", "error", err)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sendHeartbeatsToCoordinator registers on a new connection and reports the load on it
+func (s *Server) sendHeartbeatsToCoordinator() error {
+	config := s.activeConfig()
+	conn, err := net.DialTimeout("tcp", config.Cluster.CoordinatorAddress, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		// closing the connection ends the loop when the server shuts down
+		<-s.done
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+
+	msg := clusterMessage{
+		Op:      "register",
+		NodeID:  config.Cluster.NodeID,
+		Address: config.Cluster.AdvertiseAddress,
+		Tasks:   s.taskNumbers(),
+		Token:   config.Cluster.Token,
+	}
+	for {
+		msg.Load = s.metrics.inFlight.Load()
+		encoded, _ := json.Marshal(msg)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(append(encoded, '\n')); err != nil {
+			return err
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		var response GenericResponse
+		if err := json.Unmarshal([]byte(line), &response); err != nil {
+			return err
+		}
+		if response.Status != "success" {
+			return fmt.Errorf("coordinator rejected %s: %s", msg.Op, response.Error)
+		}
+		if msg.Op == "register" {
+			var registered struct {
+				NodeID string `json:"node_id"`
+			}
+			json.Unmarshal(response.Result, &registered)
+			if s.snapshots != nil {
+				s.snapshots.setCoordinator(registered.NodeID)
+			}
+			s.logger.Info("Registered with the coordinator", "coordinator", config.Cluster.CoordinatorAddress, "node_id", msg.NodeID, "coordinator_id", registered.NodeID)
+		}
+
+		msg = clusterMessage{Op: "heartbeat", NodeID: msg.NodeID, Token: msg.Token}
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(time.Duration(s.activeConfig().Cluster.HeartbeatIntervalSeconds) * time.Second):
+		}
+	}
+}
+
+// callCoordinator sends a message to the cluster address of the coordinator on a
+// connection of its own and returns the response
+func (s *Server) callCoordinator(msg clusterMessage) (GenericResponse, error) {
+	var response GenericResponse
+	config := s.activeConfig().Cluster
+	conn, err := net.DialTimeout("tcp", config.CoordinatorAddress, 5*time.Second)
+	if err != nil {
+		return response, err
+	}
+	defer conn.Close()
+	msg.NodeID, msg.Token = config.NodeID, config.Token
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	encoded, _ := json.Marshal(msg)
+	if _, err := conn.Write(append(encoded, '\n')); err != nil {
+		return response, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return response, err
+	}
+	if err := json.Unmarshal(line, &response); err != nil {
+		return response, err
+	}
+	if response.Status != "success" {
+		return response, fmt.Errorf("%s: %s", response.Code, response.Error)
+	}
+	return response, nil
+}
+
+// checkClusterToken verifies the cluster token sent by the coordinator
+func (s *Server) checkClusterToken(token string) bool {
+	expected := s.activeConfig().Cluster.Token
+	return expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// taskNumbers returns the registered task numbers in order
+func (s *Server) taskNumbers() []int {
+	s.tasksMu.RLock()
+	defer s.tasksMu.RUnlock()
+	numbers := make([]int, 0, len(s.tasks))
+	for number := range s.tasks {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// clusterWorkers returns the workers registered with a coordinator, nil on other nodes
+func (s *Server) clusterWorkers() []workerSummary {
+	if s.coordinator == nil {
+		return nil
+	}
+	return s.coordinator.list(time.Duration(s.activeConfig().Cluster.WorkerTimeoutSeconds) * time.Second)
+}
+
+// healthyWorkers returns the number of workers that can receive tasks
+func (c *coordinator) healthyWorkers(timeout time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	healthy := 0
+	for _, worker := range c.workers {
+		if worker.healthy(timeout) {
+			healthy++
+		}
+	}
+	return healthy
+}
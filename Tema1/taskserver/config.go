@@ -0,0 +1,462 @@
+package taskserver
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configuration structure
+//
+// Fields missing from the file (or set to zero) get these defaults:
+//
+//	Host                                   localhost
+//	Port                                   8080
+//	WelcomeMessage                         Connection successful!
+//	MaxMessageSize                         1024
+//	MaxConcurrentConnections               20
+//	ConnectionIdleTimeoutSeconds           60
+//	ShutdownTimeoutSeconds                 30
+//	Heartbeat.IntervalSeconds              15
+//	Heartbeat.MissedPings                  3
+//	SlowClients.RequestReadTimeoutSeconds  10
+//	SlowClients.MinReadBytesPerSecond      64
+//	SlowClients.WriteTimeoutSeconds        10
+//	Logging.Level / Format                 info / text
+//	Logging.PayloadMaxBytes                256
+//	Tracing.ServiceName                    tema1-server
+//	Tracing.FlushIntervalSeconds           5
+//	Idempotency.WindowSeconds              300
+//	Idempotency.MaxKeys                    10000
+//	Sessions.TTLSeconds                    300
+//	Sessions.MaxPending                    100
+//	Cluster.NodeID / AdvertiseAddress      Host:Port
+//	Cluster.HeartbeatIntervalSeconds       2
+//	Cluster.WorkerTimeoutSeconds           6
+//	Cluster.ForwardTimeoutSeconds          30
+//	Registry.Service                       tema1
+//	Registry.InstanceID / AdvertiseAddress Host:Port
+//	Registry.HeartbeatIntervalSeconds      3
+//	Registry.TTLSeconds                    10
+//	Election.HeartbeatIntervalSeconds      1
+//	Election.TimeoutSeconds                3
+//	Gossip.Name                            Host:Port
+//	Gossip.ClientAddress                   Host:Port, see gossipClientAddress
+//	Gossip.ProbeIntervalMilliseconds       1000
+//	Gossip.ProbeTimeoutMilliseconds        500
+//	Gossip.IndirectProbes                  3
+//	Gossip.SuspicionTimeoutMilliseconds    5000
+//	Jobs.Dir                               jobs-<ID>
+//	Jobs.HeartbeatIntervalMilliseconds     50
+//	Jobs.ElectionTimeoutMilliseconds       300
+//	Jobs.SnapshotThreshold                 1000
+//	Mutex.AcquireTimeoutMilliseconds       5000
+//	Batches.PrepareTimeoutSeconds          10
+//	Batches.RetryIntervalMilliseconds      500
+//	Snapshots.Dir                          snapshots
+//	Snapshots.TimeoutSeconds               10
+//	Cache.AdvertiseAddress                 Cache.Address
+//	Cache.ReplicationFactor                2
+//	Cache.VirtualNodes                     100
+//	Cache.TTLSeconds                       300
+//	Cache.MaxEntries                       10000
+//	Cache.TimeoutMilliseconds              500
+//
+// Values are applied in this order, later ones win: defaults, config file,
+// TEMA1_* environment variables, command-line flags (see configOverrides).
+type Config struct {
+	Host                         string `json:"Host"`
+	Port                         string `json:"Port"`
+	WelcomeMessage               string `json:"WelcomeMessage"`
+	MaxMessageSize               int    `json:"MaxMessageSize"`
+	MaxConcurrentConnections     int    `json:"MaxConcurrentConnections"`
+	ConnectionIdleTimeoutSeconds int    `json:"ConnectionIdleTimeoutSeconds"` // for clients that do not answer pings
+
+	// heartbeats replace the idle timeout for clients that support them
+	Heartbeat HeartbeatConfig `json:"Heartbeat"`
+
+	SlowClients SlowClientConfig `json:"SlowClients"`
+
+	// TCP keepalive probe period, 0 for the Go default (15s) and -1 to disable keepalives
+	TCPKeepAliveSeconds int `json:"TCPKeepAliveSeconds"`
+
+	// the server always listens on Host:Port, these are additional listeners
+	Listeners []ListenerConfig `json:"Listeners"`
+
+	Logging LoggingConfig `json:"Logging"`
+	Audit   AuditConfig   `json:"Audit"`
+	Tracing TracingConfig `json:"Tracing"`
+
+	// address of the HTTP server exposing /metrics, /stats, /healthz and /readyz, empty to disable
+	HTTPAddress string `json:"HTTPAddress"`
+
+	Admin AdminConfig `json:"Admin"`
+
+	Middleware  MiddlewareConfig  `json:"Middleware"`
+	Idempotency IdempotencyConfig `json:"Idempotency"`
+	Sessions    SessionConfig     `json:"Sessions"`
+
+	// coordinator/worker mode, a standalone server when Role is empty
+	Cluster ClusterConfig `json:"Cluster"`
+
+	Registry RegistryConfig `json:"Registry"`
+	Election ElectionConfig `json:"Election"`
+	Jobs     JobsConfig     `json:"Jobs"`
+	Gossip   GossipConfig   `json:"Gossip"`
+	Cache    CacheConfig    `json:"Cache"`
+	Mutex    MutexConfig    `json:"Mutex"`
+	Batches  BatchConfig    `json:"Batches"`
+
+	Snapshots SnapshotConfig `json:"Snapshots"`
+
+	// how long a graceful shutdown waits for open connections before closing them
+	ShutdownTimeoutSeconds int `json:"ShutdownTimeoutSeconds"`
+}
+
+// ApplyDefaults fills the fields left empty
+func ApplyDefaults(config *Config) {
+	setDefault(&config.Host, "localhost")
+	setDefault(&config.Port, "8080")
+	setDefault(&config.WelcomeMessage, "Connection successful!")
+	setDefault(&config.MaxMessageSize, 1024)
+	setDefault(&config.MaxConcurrentConnections, 20)
+	setDefault(&config.ConnectionIdleTimeoutSeconds, 60)
+	setDefault(&config.ShutdownTimeoutSeconds, 30)
+	setDefault(&config.Heartbeat.IntervalSeconds, 15)
+	setDefault(&config.Heartbeat.MissedPings, 3)
+	setDefault(&config.SlowClients.RequestReadTimeoutSeconds, 10)
+	setDefault(&config.SlowClients.MinReadBytesPerSecond, 64)
+	setDefault(&config.SlowClients.WriteTimeoutSeconds, 10)
+	setDefault(&config.Logging.Level, "info")
+	setDefault(&config.Logging.Format, "text")
+	setDefault(&config.Logging.PayloadMaxBytes, 256)
+	setDefault(&config.Tracing.ServiceName, "tema1-server")
+	setDefault(&config.Tracing.FlushIntervalSeconds, 5)
+	setDefault(&config.Idempotency.WindowSeconds, 300)
+	setDefault(&config.Idempotency.MaxKeys, 10000)
+	setDefault(&config.Sessions.TTLSeconds, 300)
+	setDefault(&config.Sessions.MaxPending, 100)
+	setDefault(&config.Cluster.NodeID, net.JoinHostPort(config.Host, config.Port))
+	setDefault(&config.Cluster.AdvertiseAddress, net.JoinHostPort(config.Host, config.Port))
+	setDefault(&config.Cluster.HeartbeatIntervalSeconds, 2)
+	setDefault(&config.Cluster.WorkerTimeoutSeconds, 3*config.Cluster.HeartbeatIntervalSeconds)
+	setDefault(&config.Cluster.ForwardTimeoutSeconds, 30)
+	setDefault(&config.Registry.Service, "tema1")
+	setDefault(&config.Registry.InstanceID, net.JoinHostPort(config.Host, config.Port))
+	setDefault(&config.Registry.AdvertiseAddress, net.JoinHostPort(config.Host, config.Port))
+	setDefault(&config.Registry.HeartbeatIntervalSeconds, 3)
+	setDefault(&config.Registry.TTLSeconds, 10)
+	setDefault(&config.Election.HeartbeatIntervalSeconds, 1)
+	setDefault(&config.Election.TimeoutSeconds, 3*config.Election.HeartbeatIntervalSeconds)
+	setDefault(&config.Gossip.Name, net.JoinHostPort(config.Host, config.Port))
+	setDefault(&config.Gossip.ClientAddress, gossipClientAddress(*config))
+	setDefault(&config.Gossip.ProbeIntervalMilliseconds, 1000)
+	setDefault(&config.Gossip.ProbeTimeoutMilliseconds, config.Gossip.ProbeIntervalMilliseconds/2)
+	setDefault(&config.Gossip.IndirectProbes, 3)
+	setDefault(&config.Gossip.SuspicionTimeoutMilliseconds, 5*config.Gossip.ProbeIntervalMilliseconds)
+	setDefault(&config.Jobs.Dir, fmt.Sprintf("jobs-%d", config.Jobs.ID))
+	setDefault(&config.Jobs.HeartbeatIntervalMilliseconds, 50)
+	setDefault(&config.Jobs.ElectionTimeoutMilliseconds, 6*config.Jobs.HeartbeatIntervalMilliseconds)
+	setDefault(&config.Jobs.SnapshotThreshold, 1000)
+	setDefault(&config.Mutex.AcquireTimeoutMilliseconds, 5000)
+	setDefault(&config.Batches.PrepareTimeoutSeconds, 10)
+	setDefault(&config.Batches.RetryIntervalMilliseconds, 500)
+	setDefault(&config.Snapshots.Dir, "snapshots")
+	setDefault(&config.Snapshots.TimeoutSeconds, 10)
+	setDefault(&config.Cache.AdvertiseAddress, config.Cache.Address)
+	setDefault(&config.Cache.ReplicationFactor, 2)
+	setDefault(&config.Cache.VirtualNodes, 100)
+	setDefault(&config.Cache.TTLSeconds, 300)
+	setDefault(&config.Cache.MaxEntries, 10000)
+	setDefault(&config.Cache.TimeoutMilliseconds, 500)
+	for i := range config.Listeners {
+		setDefault(&config.Listeners[i].Network, "tcp")
+	}
+}
+
+func setDefault[T comparable](field *T, value T) {
+	var zero T
+	if *field == zero {
+		*field = value
+	}
+}
+
+// configOverride is a setting that can be given as an environment variable or a flag
+type configOverride struct {
+	flag  string
+	env   string
+	usage string
+	apply func(config *Config, value string) error
+}
+
+func stringSetting(field func(*Config) *string) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		*field(config) = value
+		return nil
+	}
+}
+
+func intSetting(field func(*Config) *int) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*field(config) = number
+		return nil
+	}
+}
+
+// settings that can be overridden without editing the file
+var configOverrides = []configOverride{
+	{"host", "TEMA1_HOST", "host of the main listener", stringSetting(func(c *Config) *string { return &c.Host })},
+	{"port", "TEMA1_PORT", "port of the main listener", stringSetting(func(c *Config) *string { return &c.Port })},
+	{"welcome-message", "TEMA1_WELCOME_MESSAGE", "message sent to new connections", stringSetting(func(c *Config) *string { return &c.WelcomeMessage })},
+	{"max-message-size", "TEMA1_MAX_MESSAGE_SIZE", "maximum request size in bytes", intSetting(func(c *Config) *int { return &c.MaxMessageSize })},
+	{"max-connections", "TEMA1_MAX_CONCURRENT_CONNECTIONS", "maximum concurrent connections", intSetting(func(c *Config) *int { return &c.MaxConcurrentConnections })},
+	{"idle-timeout", "TEMA1_CONNECTION_IDLE_TIMEOUT_SECONDS", "connection idle timeout in seconds", intSetting(func(c *Config) *int { return &c.ConnectionIdleTimeoutSeconds })},
+	{"shutdown-timeout", "TEMA1_SHUTDOWN_TIMEOUT_SECONDS", "graceful shutdown timeout in seconds", intSetting(func(c *Config) *int { return &c.ShutdownTimeoutSeconds })},
+	{"http-address", "TEMA1_HTTP_ADDRESS", "address of the metrics and health HTTP server", stringSetting(func(c *Config) *string { return &c.HTTPAddress })},
+	{"admin-address", "TEMA1_ADMIN_ADDRESS", "address of the admin interface", stringSetting(func(c *Config) *string { return &c.Admin.Address })},
+	{"admin-token", "TEMA1_ADMIN_TOKEN", "token required by the admin interface", stringSetting(func(c *Config) *string { return &c.Admin.Token })},
+	{"registry-token", "TEMA1_REGISTRY_TOKEN", "token required by the service registry", stringSetting(func(c *Config) *string { return &c.Registry.Token })},
+	{"log-level", "TEMA1_LOG_LEVEL", "log level: debug, info, warn or error", stringSetting(func(c *Config) *string { return &c.Logging.Level })},
+	{"log-format", "TEMA1_LOG_FORMAT", "log format: text or json", stringSetting(func(c *Config) *string { return &c.Logging.Format })},
+	{"log-file", "TEMA1_LOG_FILE", "log file, empty for stderr", stringSetting(func(c *Config) *string { return &c.Logging.File })},
+	{"audit-file", "TEMA1_AUDIT_FILE", "audit log file, empty to disable", stringSetting(func(c *Config) *string { return &c.Audit.File })},
+	{"trace-file", "TEMA1_TRACE_FILE", "OTLP JSON span file, empty to disable", stringSetting(func(c *Config) *string { return &c.Tracing.File })},
+}
+
+// ConfigFlags holds the override flags defined on a flag set
+type ConfigFlags struct {
+	flags  *flag.FlagSet
+	values map[string]*string // by flag name
+}
+
+// RegisterConfigFlags defines a flag for every override, to be called before the flags are parsed
+func RegisterConfigFlags(flags *flag.FlagSet) *ConfigFlags {
+	cf := &ConfigFlags{flags: flags, values: make(map[string]*string)}
+	for _, override := range configOverrides {
+		cf.values[override.flag] = flags.String(override.flag, "", override.usage+" (env "+override.env+")")
+	}
+	return cf
+}
+
+// Overrides returns the override flags that were given explicitly, by flag name
+func (cf *ConfigFlags) Overrides() map[string]string {
+	given := make(map[string]string)
+	cf.flags.Visit(func(f *flag.Flag) {
+		if value, ok := cf.values[f.Name]; ok {
+			given[f.Name] = *value
+		}
+	})
+	return given
+}
+
+// applyOverrides applies the environment variables, then the command-line overrides
+func applyOverrides(config *Config, commandLineOverrides map[string]string) error {
+	var problems []error
+	for _, override := range configOverrides {
+		if value, ok := os.LookupEnv(override.env); ok {
+			if err := override.apply(config, value); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", override.env, err))
+			}
+		}
+	}
+	for _, override := range configOverrides {
+		if value, ok := commandLineOverrides[override.flag]; ok {
+			if err := override.apply(config, value); err != nil {
+				problems = append(problems, fmt.Errorf("-%s: %w", override.flag, err))
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// LoadConfig reads the configuration file and applies the overrides, then the defaults so
+// that the ones derived from Host:Port use the overridden address; the overrides are flag
+// values by flag name as returned by ConfigFlags.Overrides
+func LoadConfig(filename string, overrides map[string]string) (Config, error) {
+	// open and read the config file
+	var config Config
+	configFile, err := os.Open(filename)
+	if err != nil {
+		return config, err
+	}
+	defer configFile.Close()
+
+	// unknown fields are rejected so a typo does not silently fall back to a default
+	jsonParser := json.NewDecoder(configFile)
+	jsonParser.DisallowUnknownFields()
+	if err := jsonParser.Decode(&config); err != nil {
+		return config, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+
+	err = applyOverrides(&config, overrides)
+	ApplyDefaults(&config)
+	return config, err
+}
+
+// ValidateConfig checks every field, all problems are reported together
+func ValidateConfig(config Config) error {
+	var problems []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(config.Port)
+	check(err == nil && port >= 0 && port <= 65535, "Port must be a number between 0 and 65535, got %q", config.Port)
+	check(config.MaxMessageSize >= 64 && config.MaxMessageSize <= 16<<20, "MaxMessageSize must be between 64 bytes and 16 MiB, got %d", config.MaxMessageSize)
+	check(config.MaxConcurrentConnections >= 1 && config.MaxConcurrentConnections <= 100000, "MaxConcurrentConnections must be between 1 and 100000, got %d", config.MaxConcurrentConnections)
+	check(config.ConnectionIdleTimeoutSeconds >= 1 && config.ConnectionIdleTimeoutSeconds <= 86400, "ConnectionIdleTimeoutSeconds must be between 1 and 86400, got %d", config.ConnectionIdleTimeoutSeconds)
+	check(config.ShutdownTimeoutSeconds >= 0, "ShutdownTimeoutSeconds must not be negative, got %d", config.ShutdownTimeoutSeconds)
+	check(config.Heartbeat.IntervalSeconds >= 1 && config.Heartbeat.IntervalSeconds <= 3600, "Heartbeat.IntervalSeconds must be between 1 and 3600, got %d", config.Heartbeat.IntervalSeconds)
+	check(config.Heartbeat.MissedPings >= 1 && config.Heartbeat.MissedPings <= 100, "Heartbeat.MissedPings must be between 1 and 100, got %d", config.Heartbeat.MissedPings)
+	check(config.SlowClients.RequestReadTimeoutSeconds >= 1, "SlowClients.RequestReadTimeoutSeconds must be at least 1, got %d", config.SlowClients.RequestReadTimeoutSeconds)
+	check(config.SlowClients.MinReadBytesPerSecond >= 1, "SlowClients.MinReadBytesPerSecond must be at least 1, got %d", config.SlowClients.MinReadBytesPerSecond)
+	check(config.SlowClients.WriteTimeoutSeconds >= 1, "SlowClients.WriteTimeoutSeconds must be at least 1, got %d", config.SlowClients.WriteTimeoutSeconds)
+	check(config.SlowClients.WriteBufferBytes >= 0, "SlowClients.WriteBufferBytes must not be negative")
+	check(config.TCPKeepAliveSeconds >= -1, "TCPKeepAliveSeconds must be -1, 0 or a period in seconds, got %d", config.TCPKeepAliveSeconds)
+
+	names := make(map[string]bool)
+	for i, lc := range listenerConfigs(config) {
+		// the first listener is the main one built from Host and Port
+		label := "Host:Port"
+		if i > 0 {
+			label = fmt.Sprintf("Listeners[%d]", i-1)
+		}
+		check(!names[lc.name()], "listener %s is configured twice", lc.name())
+		names[lc.name()] = true
+		check(lc.Address != "", "%s has no Address", label)
+		switch lc.Network {
+		case "tcp", "tcp4", "tcp6":
+			_, _, err := net.SplitHostPort(lc.Address)
+			check(err == nil, "%s address %q is not host:port", label, lc.Address)
+		case "unix":
+			if lc.SocketMode != "" {
+				_, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+				check(err == nil, "%s SocketMode %q is not an octal mode", label, lc.SocketMode)
+			}
+		default:
+			check(false, "%s has unsupported Network %q", label, lc.Network)
+		}
+		check((lc.TLSCertFile == "") == (lc.TLSKeyFile == ""), "%s needs both TLSCertFile and TLSKeyFile", label)
+		check(!lc.RequireAuth || len(lc.AuthTokens) > 0, "%s requires auth but has no AuthTokens", label)
+	}
+
+	if _, err := parseLevel(config.Logging.Level); err != nil {
+		problems = append(problems, err)
+	}
+	format := strings.ToLower(config.Logging.Format)
+	check(format == "text" || format == "json", "Logging.Format must be text or json, got %q", config.Logging.Format)
+	check(config.Logging.PayloadMaxBytes >= 0, "Logging.PayloadMaxBytes must not be negative")
+	check(config.Logging.FileMaxSizeMB >= 0 && config.Logging.FileMaxBackups >= 0, "Logging file rotation settings must not be negative")
+	check(config.Audit.MaxSizeMB >= 0 && config.Audit.MaxAgeHours >= 0 && config.Audit.MaxBackups >= 0, "Audit rotation settings must not be negative")
+	check(config.Tracing.FlushIntervalSeconds >= 1, "Tracing.FlushIntervalSeconds must be at least 1")
+	check(config.Admin.Address == "" || config.Admin.Token != "", "Admin.Token is required when Admin.Address is set")
+	check(config.Idempotency.WindowSeconds >= 0 && config.Idempotency.MaxKeys >= 0, "Idempotency settings must not be negative")
+	check(config.Sessions.TTLSeconds >= 1 && config.Sessions.MaxPending >= 1, "Sessions.TTLSeconds and Sessions.MaxPending must be at least 1")
+	switch config.Cluster.Role {
+	case RoleStandalone:
+	case RoleCoordinator:
+		check(config.Cluster.Address != "", "Cluster.Address is required for a coordinator")
+	case RoleWorker:
+		check(config.Cluster.CoordinatorAddress != "", "Cluster.CoordinatorAddress is required for a worker")
+	default:
+		check(false, "Cluster.Role must be empty, %s or %s, got %q", RoleCoordinator, RoleWorker, config.Cluster.Role)
+	}
+	check(config.Cluster.HeartbeatIntervalSeconds >= 1, "Cluster.HeartbeatIntervalSeconds must be at least 1")
+	check(config.Cluster.WorkerTimeoutSeconds > config.Cluster.HeartbeatIntervalSeconds, "Cluster.WorkerTimeoutSeconds must be longer than Cluster.HeartbeatIntervalSeconds")
+	check(config.Cluster.ForwardTimeoutSeconds >= 1, "Cluster.ForwardTimeoutSeconds must be at least 1")
+	check(config.Registry.Address == "" || config.Registry.Token != "", "Registry.Token is required when Registry.Address is set")
+	check(config.Registry.HeartbeatIntervalSeconds >= 1, "Registry.HeartbeatIntervalSeconds must be at least 1")
+	check(config.Registry.TTLSeconds > config.Registry.HeartbeatIntervalSeconds, "Registry.TTLSeconds must be longer than Registry.HeartbeatIntervalSeconds")
+	if config.Election.Address != "" {
+		check(config.Election.ID >= 1, "Election.ID must be at least 1, got %d", config.Election.ID)
+		ids := map[int]bool{config.Election.ID: true}
+		for _, peer := range config.Election.Peers {
+			check(peer.ID >= 1 && peer.Address != "", "Election peer %d needs an ID of at least 1 and an Address", peer.ID)
+			check(!ids[peer.ID], "Election ID %d is used twice", peer.ID)
+			ids[peer.ID] = true
+		}
+	}
+	check(config.Election.HeartbeatIntervalSeconds >= 1, "Election.HeartbeatIntervalSeconds must be at least 1")
+	check(config.Election.TimeoutSeconds > config.Election.HeartbeatIntervalSeconds, "Election.TimeoutSeconds must be longer than Election.HeartbeatIntervalSeconds")
+	if config.Jobs.Address != "" {
+		check(config.Jobs.ID >= 1, "Jobs.ID must be at least 1, got %d", config.Jobs.ID)
+		ids := map[int]bool{config.Jobs.ID: true}
+		for _, peer := range config.Jobs.Peers {
+			check(peer.ID >= 1 && peer.Address != "", "Jobs peer %d needs an ID of at least 1 and an Address", peer.ID)
+			check(!ids[peer.ID], "Jobs ID %d is used twice", peer.ID)
+			ids[peer.ID] = true
+		}
+	}
+	check(config.Jobs.HeartbeatIntervalMilliseconds >= 10, "Jobs.HeartbeatIntervalMilliseconds must be at least 10")
+	check(config.Jobs.ElectionTimeoutMilliseconds >= 2*config.Jobs.HeartbeatIntervalMilliseconds, "Jobs.ElectionTimeoutMilliseconds must be at least twice Jobs.HeartbeatIntervalMilliseconds")
+	check(config.Jobs.SnapshotThreshold >= 1, "Jobs.SnapshotThreshold must be at least 1")
+	if config.Gossip.BindAddress != "" {
+		host, _, err := net.SplitHostPort(config.Gossip.ClientAddress)
+		ip := net.ParseIP(host)
+		check(err == nil && host != "" && (ip == nil || !ip.IsUnspecified()), "Gossip.ClientAddress must be an address the other members can dial, got %q", config.Gossip.ClientAddress)
+	}
+	check(config.Gossip.ProbeIntervalMilliseconds >= 10, "Gossip.ProbeIntervalMilliseconds must be at least 10")
+	check(config.Gossip.ProbeTimeoutMilliseconds >= 1 && config.Gossip.ProbeTimeoutMilliseconds < config.Gossip.ProbeIntervalMilliseconds, "Gossip.ProbeTimeoutMilliseconds must be shorter than Gossip.ProbeIntervalMilliseconds")
+	check(config.Gossip.IndirectProbes >= 1, "Gossip.IndirectProbes must be at least 1")
+	check(config.Gossip.SuspicionTimeoutMilliseconds > config.Gossip.ProbeIntervalMilliseconds, "Gossip.SuspicionTimeoutMilliseconds must be longer than Gossip.ProbeIntervalMilliseconds")
+	if config.Mutex.Address != "" {
+		check(config.Mutex.ID >= 1, "Mutex.ID must be at least 1, got %d", config.Mutex.ID)
+		ids := map[int]bool{config.Mutex.ID: true}
+		for _, peer := range config.Mutex.Peers {
+			check(peer.ID >= 1 && peer.Address != "", "Mutex peer %d needs an ID of at least 1 and an Address", peer.ID)
+			check(!ids[peer.ID], "Mutex ID %d is used twice", peer.ID)
+			ids[peer.ID] = true
+		}
+	}
+	check(config.Mutex.AcquireTimeoutMilliseconds >= 1, "Mutex.AcquireTimeoutMilliseconds must be at least 1")
+	check(config.Batches.PrepareTimeoutSeconds >= 1, "Batches.PrepareTimeoutSeconds must be at least 1")
+	check(config.Batches.RetryIntervalMilliseconds >= 10, "Batches.RetryIntervalMilliseconds must be at least 10")
+	check(config.Snapshots.TimeoutSeconds >= 1, "Snapshots.TimeoutSeconds must be at least 1")
+	check(config.Cache.ReplicationFactor >= 1, "Cache.ReplicationFactor must be at least 1")
+	check(config.Cache.VirtualNodes >= 1, "Cache.VirtualNodes must be at least 1")
+	check(config.Cache.TTLSeconds >= 1, "Cache.TTLSeconds must be at least 1")
+	check(config.Cache.MaxEntries >= 1, "Cache.MaxEntries must be at least 1")
+	check(config.Cache.TimeoutMilliseconds >= 1, "Cache.TimeoutMilliseconds must be at least 1")
+	check(config.Middleware.RateLimit.RequestsPerSecond >= 0 && config.Middleware.RateLimit.Burst >= 0, "Middleware.RateLimit settings must not be negative")
+
+	return errors.Join(problems...)
+}
+
+// PrintConfig writes the configuration as JSON, with secrets masked
+func PrintConfig(w io.Writer, config Config) {
+	mask := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "********"
+	}
+	config.Admin.Token = mask(config.Admin.Token)
+	config.Cluster.Token = mask(config.Cluster.Token)
+	config.Cache.Token = mask(config.Cache.Token)
+	config.Registry.Token = mask(config.Registry.Token)
+	listeners := make([]ListenerConfig, len(config.Listeners))
+	for i, lc := range config.Listeners {
+		tokens := make([]string, len(lc.AuthTokens))
+		for j, token := range lc.AuthTokens {
+			tokens[j] = mask(token)
+		}
+		lc.AuthTokens = tokens
+		listeners[i] = lc
+	}
+	config.Listeners = listeners
+
+	encoded, _ := json.MarshalIndent(config, "", "  ")
+	fmt.Fprintln(w, string(encoded))
+}
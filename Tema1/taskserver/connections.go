@@ -0,0 +1,101 @@
+package taskserver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connectionInfo describes an open client connection
+type connectionInfo struct {
+	id          string
+	conn        net.Conn
+	listener    string
+	connectedAt time.Time
+	busy        atomic.Bool // a request is being processed
+
+	// shown by the admin interface
+	clientID     atomic.Int64  // client id of the last request
+	requests     atomic.Uint64 // requests received on the connection
+	lastActivity atomic.Int64  // unix nanoseconds of the last request
+	kicked       atomic.Bool   // closed by an admin
+	heartbeats   atomic.Bool   // the client answers pings
+}
+
+// connectionRegistry keeps track of the open connections
+type connectionRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*connectionInfo
+	wg    sync.WaitGroup
+}
+
+// add registers a new connection
+func (r *connectionRegistry) add(info *connectionInfo) {
+	r.mu.Lock()
+	r.conns[info.id] = info
+	r.mu.Unlock()
+	r.wg.Add(1)
+}
+
+// remove unregisters a closed connection
+func (r *connectionRegistry) remove(id string) {
+	r.mu.Lock()
+	_, ok := r.conns[id]
+	delete(r.conns, id)
+	r.mu.Unlock()
+	if ok {
+		r.wg.Done()
+	}
+}
+
+// interruptIdle wakes up the handlers waiting for a request, so they can notice the server is draining
+func (r *connectionRegistry) interruptIdle() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, info := range r.conns {
+		if !info.busy.Load() {
+			info.conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// wait blocks until every connection is closed or the timeout expires, it reports whether all closed
+func (r *connectionRegistry) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// waitContext blocks until every connection is closed or ctx is done, it reports whether all closed
+func (r *connectionRegistry) waitContext(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// closeAll closes every remaining connection
+func (r *connectionRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, info := range r.conns {
+		info.conn.Close()
+	}
+}
@@ -0,0 +1,147 @@
+package taskserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// status of a single listener
+type listenerStatus struct {
+	Name  string `json:"name"`
+	Up    bool   `json:"up"`
+	Error string `json:"error,omitempty"`
+}
+
+// serverState is the information reported by the health checks
+type serverState struct {
+	startedAt      time.Time
+	configLoadedAt atomic.Int64 // unix nanoseconds, 0 until the configuration is loaded
+	draining       atomic.Bool
+
+	mu        sync.Mutex
+	listeners []listenerStatus
+}
+
+// setConfigLoaded records when the configuration was (re)loaded
+func (s *serverState) setConfigLoaded(at time.Time) {
+	s.configLoadedAt.Store(at.UnixNano())
+}
+
+// setListener records whether a listener is accepting connections
+func (s *serverState) setListener(name string, up bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := listenerStatus{Name: name, Up: up}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	for i := range s.listeners {
+		if s.listeners[i].Name == name {
+			s.listeners[i] = status
+			return
+		}
+	}
+	s.listeners = append(s.listeners, status)
+}
+
+// healthReport is returned by the "health" operation and the HTTP probes
+type healthReport struct {
+	Status            string            `json:"status"` // ok, degraded or draining
+	Live              bool              `json:"live"`
+	Ready             bool              `json:"ready"`
+	Draining          bool              `json:"draining"`
+	Paused            bool              `json:"paused"` // accepting paused by an admin
+	Listeners         []listenerStatus  `json:"listeners"`
+	ActiveConnections int64             `json:"active_connections"`
+	PoolCapacity      int64             `json:"pool_capacity"`
+	PoolInUse         int64             `json:"pool_in_use"`
+	PoolSaturation    float64           `json:"pool_saturation"`
+	ConfigLoadedAt    *time.Time        `json:"config_loaded_at,omitempty"`
+	UptimeSeconds     float64           `json:"uptime_seconds"`
+	Leader            *leaderStatus     `json:"leader,omitempty"`  // only with leader election
+	Jobs              *jobsStatus       `json:"jobs,omitempty"`    // only with the replicated job queue
+	Members           *membershipStatus `json:"members,omitempty"` // only with gossip membership
+}
+
+// healthReport builds the current health report
+func (s *Server) healthReport() healthReport {
+	state := s.state
+	state.mu.Lock()
+	listeners := append([]listenerStatus(nil), state.listeners...)
+	state.mu.Unlock()
+
+	report := healthReport{
+		Draining:          state.draining.Load(),
+		Paused:            s.gate.isPaused(),
+		Listeners:         listeners,
+		ActiveConnections: s.metrics.activeConnections.Load(),
+		PoolCapacity:      s.metrics.semaphoreCapacity.Load(),
+		PoolInUse:         s.metrics.semaphoreInUse.Load(),
+		UptimeSeconds:     time.Since(state.startedAt).Seconds(),
+	}
+	if s.election != nil {
+		leader := s.leaderStatus()
+		report.Leader = &leader
+	}
+	if s.membership != nil {
+		members := s.membershipStatus()
+		report.Members = &members
+	}
+	if s.jobLog != nil {
+		jobs := s.jobsStatus()
+		report.Jobs = &jobs
+	}
+	if report.PoolCapacity > 0 {
+		report.PoolSaturation = float64(report.PoolInUse) / float64(report.PoolCapacity)
+	}
+	if loadedAt := state.configLoadedAt.Load(); loadedAt != 0 {
+		t := time.Unix(0, loadedAt)
+		report.ConfigLoadedAt = &t
+	}
+
+	// live while at least one listener accepts connections (or while draining on purpose)
+	listenersUp := len(listeners) > 0
+	anyUp := false
+	for _, listener := range listeners {
+		listenersUp = listenersUp && listener.Up
+		anyUp = anyUp || listener.Up
+	}
+	report.Live = anyUp || report.Draining
+
+	// ready when accepting on every listener, the configuration is loaded and a connection slot is free
+	report.Ready = !report.Draining && !report.Paused && listenersUp && report.ConfigLoadedAt != nil && report.PoolInUse < report.PoolCapacity
+
+	switch {
+	case report.Draining:
+		report.Status = "draining"
+	case report.Ready:
+		report.Status = "ok"
+	default:
+		report.Status = "degraded"
+	}
+	return report
+}
+
+// writeProbe answers an HTTP probe with the health report, 503 when the check fails
+func writeProbe(w http.ResponseWriter, ok bool, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// registerHealthHandlers adds the liveness and readiness probes to the HTTP server
+func (s *Server) registerHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := s.healthReport()
+		writeProbe(w, report.Live, report)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := s.healthReport()
+		writeProbe(w, report.Ready, report)
+	})
+}
@@ -0,0 +1,91 @@
+package taskserver
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// heartbeat configuration
+//
+// A client opts in by sending {"op":"ping"}, the server answers {"status":"pong"}
+// and from then on sends {"status":"ping"} whenever the connection is quiet for
+// IntervalSeconds; the client answers with {"op":"pong"}. A connection that answers
+// pings is never closed for being idle, only after MissedPings unanswered pings.
+// Clients that never ping keep the ConnectionIdleTimeoutSeconds read deadline.
+type HeartbeatConfig struct {
+	IntervalSeconds int `json:"IntervalSeconds"` // quiet time before the server sends a ping
+	MissedPings     int `json:"MissedPings"`     // unanswered pings before the peer is considered dead
+}
+
+// heartbeat frames sent by the server
+var (
+	pingFrame = GenericResponse{Status: "ping"}
+	pongFrame = GenericResponse{Status: "pong"}
+)
+
+// deadline returns how long a heartbeat connection may stay silent
+func (h HeartbeatConfig) deadline() time.Duration {
+	return time.Duration(h.IntervalSeconds*(h.MissedPings+1)) * time.Second
+}
+
+// sendHeartbeats pings the client while the connection is quiet, until stop is closed
+func (s *Server) sendHeartbeats(conn net.Conn, info *connectionInfo, stop <-chan struct{}) {
+	for {
+		interval := time.Duration(s.activeConfig().Heartbeat.IntervalSeconds) * time.Second
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		// no ping while a request is being processed or right after a frame from the client
+		if info.busy.Load() || time.Since(time.Unix(0, info.lastActivity.Load())) < interval {
+			continue
+		}
+		if err := sendResponse(conn, pingFrame, s.activeConfig().SlowClients.writeTimeout()); err != nil {
+			return
+		}
+		s.metrics.pingsSent.Add(1)
+	}
+}
+
+// frameConn serializes the writes of the handler and the heartbeat goroutine,
+// every frame is written with a single Write call
+type frameConn struct {
+	net.Conn
+	mu *sync.Mutex
+}
+
+func (c frameConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// rawConn returns the connection under a TLS connection
+func rawConn(conn net.Conn) net.Conn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return tlsConn.NetConn()
+	}
+	return conn
+}
+
+// setKeepAlive applies the TCP keepalive setting to an accepted connection,
+// seconds is the probe period, 0 keeps the Go default and a negative value disables it
+func setKeepAlive(conn net.Conn, seconds int) {
+	if seconds == 0 {
+		return
+	}
+	tcpConn, ok := rawConn(conn).(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if seconds < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(time.Duration(seconds) * time.Second)
+}
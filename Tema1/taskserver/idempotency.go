@@ -0,0 +1,126 @@
+package taskserver
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// name of the built-in middleware answering retried requests
+const IdempotencyMiddleware = "idempotency"
+
+// idempotency configuration, requests carrying an idempotency_key are executed once
+// per client scope and key within the window, the scope is the session, the auth token or
+// the connection of the client; add "idempotency" to Middleware.Disabled to turn it off
+type IdempotencyConfig struct {
+	WindowSeconds int `json:"WindowSeconds"` // how long a response is kept for retries
+	MaxKeys       int `json:"MaxKeys"`       // keys kept at once, requests above it are not deduplicated
+}
+
+// idempotencyEntry is the outcome of the first request with a key
+type idempotencyEntry struct {
+	task      int
+	inputHash string
+	done      chan struct{} // closed when the original request finishes
+	result    json.RawMessage
+	err       error
+	expires   time.Time // set when done
+}
+
+// idempotencyStore remembers the responses of requests with an idempotency key
+type idempotencyStore struct {
+	mu      sync.Mutex
+	config  IdempotencyConfig
+	entries map[string]*idempotencyEntry
+	pruned  time.Time
+	replays func() // called for every response served from the store
+}
+
+func newIdempotencyStore(config IdempotencyConfig, replays func()) *idempotencyStore {
+	return &idempotencyStore{config: config, entries: make(map[string]*idempotencyEntry), pruned: time.Now(), replays: replays}
+}
+
+// setConfig changes the window and the limit, stored responses keep their expiry
+func (st *idempotencyStore) setConfig(config IdempotencyConfig) {
+	st.mu.Lock()
+	st.config = config
+	st.mu.Unlock()
+}
+
+// prune forgets the expired responses, the caller holds the lock
+func (st *idempotencyStore) prune(now time.Time) {
+	for key, entry := range st.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(st.entries, key)
+		}
+	}
+	st.pruned = now
+}
+
+// secretScope is the idempotency scope of a client identified by a secret, a session id
+// or an auth token; the secret is hashed since the scope is forwarded to other servers
+func secretScope(kind, secret string) string {
+	return kind + "/" + hashInput(json.RawMessage(secret))[:16]
+}
+
+// middleware executes a request with a key once, a retry gets the stored response
+// or waits for the original request if it is still running
+func (st *idempotencyStore) middleware(next Handler) Handler {
+	return func(req *Request) (json.RawMessage, error) {
+		if req.IdempotencyKey == "" {
+			return next(req)
+		}
+		// the client_id is chosen by the client and would let it read the responses of
+		// another, keys are scoped by what the client proved instead
+		key := req.Scope + "/" + req.IdempotencyKey
+		inputHash := hashInput(req.Input)
+		now := time.Now()
+
+		st.mu.Lock()
+		if now.Sub(st.pruned) > time.Second {
+			st.prune(now)
+		}
+		entry, ok := st.entries[key]
+		if ok && !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(st.entries, key)
+			ok = false
+		}
+
+		if ok {
+			st.mu.Unlock()
+			if entry.task != req.TaskNumber || entry.inputHash != inputHash {
+				return nil, &TaskError{Code: errIdempotencyConflict, Message: "Idempotency key was used for a different request"}
+			}
+			<-entry.done
+			req.Logger.Info("Replaying stored response", "idempotency_key", req.IdempotencyKey)
+			st.replays()
+			req.Replayed = true
+			return entry.result, entry.err
+		}
+
+		if st.config.MaxKeys > 0 && len(st.entries) >= st.config.MaxKeys {
+			st.mu.Unlock()
+			req.Logger.Warn("Idempotency store is full, executing without deduplication", "idempotency_key", req.IdempotencyKey)
+			return next(req)
+		}
+		entry = &idempotencyEntry{task: req.TaskNumber, inputHash: inputHash, done: make(chan struct{})}
+		st.entries[key] = entry
+		st.mu.Unlock()
+
+		result, err := next(req)
+
+		st.mu.Lock()
+		var taskErr *TaskError
+		if errors.As(err, &taskErr) {
+			// requests rejected by a policy (e.g. the rate limit) can be retried
+			delete(st.entries, key)
+		} else {
+			entry.expires = time.Now().Add(time.Duration(st.config.WindowSeconds) * time.Second)
+		}
+		entry.result, entry.err = result, err
+		st.mu.Unlock()
+		close(entry.done)
+		return result, err
+	}
+}
@@ -0,0 +1,336 @@
+package taskserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/raft"
+)
+
+// replicated job queue configuration, disabled when Address is empty
+//
+// Replicas listing each other as Peers keep the queue in a raft log: a job submitted
+// to the leader is stored by a majority before it is acknowledged, so it survives the
+// loss of any minority of the replicas. The leader runs the pending jobs and records
+// their results in the log; followers redirect clients to it.
+type JobsConfig struct {
+	ID      int        `json:"ID"`      // unique among the replicas
+	Address string     `json:"Address"` // tcp address of the raft listener
+	Peers   []JobsPeer `json:"Peers"`
+	Dir     string     `json:"Dir"` // where the log and the snapshots are kept
+
+	HeartbeatIntervalMilliseconds int `json:"HeartbeatIntervalMilliseconds"`
+	ElectionTimeoutMilliseconds   int `json:"ElectionTimeoutMilliseconds"` // randomized up to twice as long
+	SnapshotThreshold             int `json:"SnapshotThreshold"`           // log entries kept before compacting them into a snapshot
+}
+
+// JobsPeer is another replica of the job queue
+type JobsPeer struct {
+	ID            int    `json:"ID"`
+	Address       string `json:"Address"`       // tcp address of its raft listener
+	ClientAddress string `json:"ClientAddress"` // where clients reach it, sent when redirecting to it
+}
+
+// job states
+const (
+	jobPending = "pending"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Job is a task submitted with "submit_job", run later by the leader
+type Job struct {
+	ID          int             `json:"job_id"`
+	TaskNumber  int             `json:"task"`
+	Input       json.RawMessage `json:"input,omitempty"`
+	ClientID    int             `json:"client_id"`
+	Status      string          `json:"status"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	SubmittedAt time.Time       `json:"submitted_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// jobCommand is an entry of the raft log
+type jobCommand struct {
+	Op string `json:"op"` // "submit" or "complete"
+
+	// submit, the time is chosen by the leader so every replica stores the same job
+	TaskNumber int             `json:"task,omitempty"`
+	Input      json.RawMessage `json:"input,omitempty"`
+	ClientID   int             `json:"client_id,omitempty"`
+	Time       time.Time       `json:"time"`
+
+	// complete
+	JobID  int             `json:"job_id,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// jobQueue is the state machine replicated by raft
+type jobQueue struct {
+	mu     sync.Mutex
+	jobs   map[int]*Job
+	nextID int
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{jobs: make(map[int]*Job), nextID: 1}
+}
+
+// Apply executes a committed command and returns the job it changed
+func (q *jobQueue) Apply(command []byte) []byte {
+	var cmd jobCommand
+	if err := json.Unmarshal(command, &cmd); err != nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var job *Job
+	switch cmd.Op {
+	case "submit":
+		job = &Job{
+			ID:          q.nextID,
+			TaskNumber:  cmd.TaskNumber,
+			Input:       cmd.Input,
+			ClientID:    cmd.ClientID,
+			Status:      jobPending,
+			SubmittedAt: cmd.Time,
+		}
+		q.jobs[job.ID] = job
+		q.nextID++
+	case "complete":
+		job = q.jobs[cmd.JobID]
+		// a job run again by a new leader keeps its first result
+		if job == nil || job.Status != jobPending {
+			break
+		}
+		job.Status, job.Result, job.Error = jobDone, cmd.Result, cmd.Error
+		if cmd.Error != "" {
+			job.Status = jobFailed
+		}
+		completed := cmd.Time
+		job.CompletedAt = &completed
+	}
+	if job == nil {
+		return nil
+	}
+	encoded, _ := json.Marshal(job)
+	return encoded
+}
+
+type jobQueueSnapshot struct {
+	NextID int    `json:"next_id"`
+	Jobs   []*Job `json:"jobs"`
+}
+
+func (q *jobQueue) Snapshot() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	snapshot := jobQueueSnapshot{NextID: q.nextID}
+	for _, job := range q.jobs {
+		snapshot.Jobs = append(snapshot.Jobs, job)
+	}
+	return json.Marshal(snapshot)
+}
+
+func (q *jobQueue) Restore(data []byte) error {
+	var snapshot jobQueueSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = make(map[int]*Job, len(snapshot.Jobs))
+	for _, job := range snapshot.Jobs {
+		q.jobs[job.ID] = job
+	}
+	q.nextID = snapshot.NextID
+	return nil
+}
+
+// get returns a copy of a job
+func (q *jobQueue) get(id int) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// pending returns the pending jobs, oldest first
+func (q *jobQueue) pending() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var jobs []Job
+	for _, job := range q.jobs {
+		if job.Status == jobPending {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+func (q *jobQueue) count() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// newJobLog creates the raft node replicating the job queue, nil when the queue is disabled
+func (s *Server) newJobLog(config JobsConfig) (*raft.Node, error) {
+	if config.Address == "" {
+		return nil, nil
+	}
+	peers := make([]raft.Peer, len(config.Peers))
+	for i, peer := range config.Peers {
+		peers[i] = raft.Peer{ID: peer.ID, Address: peer.Address}
+	}
+	return raft.New(raft.Config{
+		ID:                config.ID,
+		Address:           config.Address,
+		Peers:             peers,
+		Dir:               config.Dir,
+		HeartbeatInterval: time.Duration(config.HeartbeatIntervalMilliseconds) * time.Millisecond,
+		ElectionTimeout:   time.Duration(config.ElectionTimeoutMilliseconds) * time.Millisecond,
+		SnapshotThreshold: uint64(config.SnapshotThreshold),
+		StateMachine:      s.jobs,
+		Logger:            s.logger,
+	})
+}
+
+// how long a client waits for its job to be committed
+const jobProposeTimeout = 5 * time.Second
+
+// proposeJob appends a command to the job log and returns the job it changed once committed
+func (s *Server) proposeJob(cmd jobCommand) (json.RawMessage, error) {
+	encoded, _ := json.Marshal(cmd)
+	ctx, cancel := context.WithTimeout(context.Background(), jobProposeTimeout)
+	defer cancel()
+	return s.jobLog.Propose(ctx, encoded)
+}
+
+// notLeaderResult tells the client where the leader of the job queue is
+type notLeaderResult struct {
+	LeaderID      int    `json:"leader_id,omitempty"`
+	LeaderAddress string `json:"leader_address,omitempty"`
+}
+
+// handleJobRequest executes the "submit_job" and "job_status" operations
+func (s *Server) handleJobRequest(req GenericRequest) GenericResponse {
+	if s.jobLog == nil {
+		return GenericResponse{Status: "error", Error: "Job queue not configured", Code: errUnknownOp, RequestID: req.RequestID}
+	}
+	fail := func(code, message string) GenericResponse {
+		return GenericResponse{Status: "error", Error: message, Code: code, RequestID: req.RequestID}
+	}
+	// status is read from the leader too, a follower may not have applied the latest results
+	if !s.jobLog.IsLeader() {
+		return s.redirectToJobLeader(req)
+	}
+
+	switch req.Op {
+	case "submit_job":
+		result, err := s.proposeJob(jobCommand{Op: "submit", TaskNumber: req.TaskNumber, Input: req.Input, ClientID: req.ClientID, Time: time.Now()})
+		var notLeader *raft.NotLeaderError
+		switch {
+		case errors.As(err, &notLeader):
+			return s.redirectToJobLeader(req)
+		case err != nil:
+			return fail(errJobsUnavailable, fmt.Sprintf("Job not committed: %v", err))
+		}
+		s.metrics.jobsSubmitted.Add(1)
+		return GenericResponse{Status: "success", Result: result, RequestID: req.RequestID}
+	default:
+		var input struct {
+			JobID int `json:"job_id"`
+		}
+		if err := json.Unmarshal(req.Input, &input); err != nil || input.JobID <= 0 {
+			return fail(errInvalidArgument, `Input must be {"job_id": N}`)
+		}
+		job, ok := s.jobs.get(input.JobID)
+		if !ok {
+			return fail(errUnknownJob, fmt.Sprintf("Unknown job %d", input.JobID))
+		}
+		result, _ := json.Marshal(job)
+		return GenericResponse{Status: "success", Result: result, RequestID: req.RequestID}
+	}
+}
+
+// redirectToJobLeader answers with the leader the client should retry on
+func (s *Server) redirectToJobLeader(req GenericRequest) GenericResponse {
+	leader, _ := s.jobLog.Leader()
+	redirect := notLeaderResult{LeaderID: leader}
+	for _, peer := range s.activeConfig().Jobs.Peers {
+		if peer.ID == leader {
+			redirect.LeaderAddress = peer.ClientAddress
+		}
+	}
+	message := "Not the job queue leader, no leader elected"
+	if leader != 0 {
+		message = fmt.Sprintf("Not the job queue leader, the leader is %d", leader)
+	}
+	result, _ := json.Marshal(redirect)
+	return GenericResponse{Status: "error", Error: message, Code: errNotLeader, Result: result, RequestID: req.RequestID}
+}
+
+// how often the leader looks for pending jobs
+const jobPollInterval = 200 * time.Millisecond
+
+// runJobs executes the pending jobs while the server leads the job queue; a job whose
+// leader fails before committing the result is run again by the next leader
+func (s *Server) runJobs() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, job := range s.jobs.pending() {
+			if !s.jobLog.IsLeader() {
+				break
+			}
+			s.metrics.inFlight.Add(1)
+			result, err := s.handleTask(job.TaskNumber, job.Input)
+			s.metrics.inFlight.Add(-1)
+			cmd := jobCommand{Op: "complete", JobID: job.ID, Result: result, Time: time.Now()}
+			if err != nil {
+				cmd.Error = err.Error()
+			}
+			if _, err := s.proposeJob(cmd); err != nil {
+				s.logger.Warn("Error recording the job result", "job_id", job.ID, "error", err)
+				break
+			}
+			s.metrics.jobsCompleted.Add(1)
+			s.logger.Info("Job completed", "job_id", job.ID, "task", job.TaskNumber, "failed", cmd.Error != "")
+		}
+	}
+}
+
+// jobsStatus is returned by the "jobs" admin operation
+type jobsStatus struct {
+	Enabled bool         `json:"enabled"`
+	Raft    *raft.Status `json:"raft,omitempty"`
+	Jobs    int          `json:"jobs"`
+	Pending int          `json:"pending"`
+}
+
+func (s *Server) jobsStatus() jobsStatus {
+	if s.jobLog == nil {
+		return jobsStatus{}
+	}
+	status := s.jobLog.Status()
+	return jobsStatus{Enabled: true, Raft: &status, Jobs: s.jobs.count(), Pending: len(s.jobs.pending())}
+}
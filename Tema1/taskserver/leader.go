@@ -0,0 +1,89 @@
+package taskserver
+
+import (
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/election"
+)
+
+// leader election configuration, disabled when Address is empty
+//
+// Replicas listing each other as Peers elect one leader with the bully algorithm,
+// the replica with the highest ID among the live ones. A server without election
+// is always its own leader.
+type ElectionConfig struct {
+	ID                       int             `json:"ID"`      // unique among the replicas, the highest live ID leads
+	Address                  string          `json:"Address"` // tcp address of the election listener
+	Peers                    []election.Peer `json:"Peers"`
+	HeartbeatIntervalSeconds int             `json:"HeartbeatIntervalSeconds"` // how often the leader announces itself
+	TimeoutSeconds           int             `json:"TimeoutSeconds"`           // silence after which a new leader is elected
+}
+
+// LeaderChange describes a new leader or term, passed to the WithLeaderChange callbacks
+type LeaderChange struct {
+	Leader   int    // ID of the leader
+	Term     uint64 // increases with every election
+	IsLeader bool   // this server is the leader
+}
+
+// WithLeaderChange registers a callback called when a leader is elected, for starting
+// and stopping work only the leader does; it must not block
+func WithLeaderChange(callback func(LeaderChange)) Option {
+	return func(s *Server) {
+		s.leaderCallbacks = append(s.leaderCallbacks, callback)
+	}
+}
+
+// newElection creates the election node of the server, nil when election is disabled
+func (s *Server) newElection(config ElectionConfig) (*election.Node, error) {
+	if config.Address == "" {
+		return nil, nil
+	}
+	return election.New(election.Config{
+		ID:                config.ID,
+		Address:           config.Address,
+		Peers:             config.Peers,
+		HeartbeatInterval: time.Duration(config.HeartbeatIntervalSeconds) * time.Second,
+		Timeout:           time.Duration(config.TimeoutSeconds) * time.Second,
+		Logger:            s.logger,
+		OnLeaderChange: func(leader int, term uint64) {
+			change := LeaderChange{Leader: leader, Term: term, IsLeader: leader == config.ID}
+			s.metrics.leaderChanges.Add(1)
+			s.logger.Info("Leader changed", "leader", leader, "term", term, "is_leader", change.IsLeader)
+			for _, callback := range s.leaderCallbacks {
+				callback(change)
+			}
+		},
+	})
+}
+
+// IsLeader reports whether the server is the elected leader, always true without election
+func (s *Server) IsLeader() bool {
+	return s.election == nil || s.election.IsLeader()
+}
+
+// Leader returns the ID of the leader, 0 before the first election ends or without election, and the term
+func (s *Server) Leader() (leader int, term uint64) {
+	if s.election == nil {
+		return 0, 0
+	}
+	return s.election.Leader()
+}
+
+// leaderStatus is returned by the "leader" admin operation
+type leaderStatus struct {
+	Enabled  bool   `json:"enabled"`
+	ID       int    `json:"id,omitempty"`
+	Leader   int    `json:"leader"`
+	Term     uint64 `json:"term"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+func (s *Server) leaderStatus() leaderStatus {
+	leader, term := s.Leader()
+	status := leaderStatus{Enabled: s.election != nil, Leader: leader, Term: term, IsLeader: s.IsLeader()}
+	if s.election != nil {
+		status.ID = s.election.ID()
+	}
+	return status
+}
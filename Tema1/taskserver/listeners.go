@@ -0,0 +1,153 @@
+package taskserver
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// listener configuration, one entry for every address the server accepts connections on
+type ListenerConfig struct {
+	Network     string   `json:"Network"`     // tcp, tcp4, tcp6 or unix
+	Address     string   `json:"Address"`     // host:port for tcp, socket path for unix
+	SocketMode  string   `json:"SocketMode"`  // octal file permissions for unix sockets, e.g. "0660"
+	TLSCertFile string   `json:"TLSCertFile"` // TLS is enabled when both files are set
+	TLSKeyFile  string   `json:"TLSKeyFile"`
+	RequireAuth bool     `json:"RequireAuth"` // clients must send an "auth" request before any task
+	AuthTokens  []string `json:"AuthTokens"`
+}
+
+// name returns a printable identifier for the listener
+func (lc ListenerConfig) name() string {
+	return lc.Network + "://" + lc.Address
+}
+
+// checkToken reports whether the token is accepted by the listener
+func (lc ListenerConfig) checkToken(token string) bool {
+	for _, accepted := range lc.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(accepted), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerConfigs returns the main Host:Port listener followed by the additional ones
+func listenerConfigs(config Config) []ListenerConfig {
+	main := ListenerConfig{
+		Network: "tcp",
+		Address: net.JoinHostPort(config.Host, config.Port),
+	}
+	return append([]ListenerConfig{main}, config.Listeners...)
+}
+
+// openListener creates the listener described by lc
+func openListener(lc ListenerConfig) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+
+	switch lc.Network {
+	case "tcp", "tcp4", "tcp6":
+		listener, err = net.Listen(lc.Network, lc.Address)
+	case "unix":
+		listener, err = listenUnix(lc)
+	default:
+		return nil, fmt.Errorf("unsupported network %q for listener %s", lc.Network, lc.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// wrapping the listener in TLS if a certificate is configured
+	if lc.TLSCertFile != "" || lc.TLSKeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(lc.TLSCertFile, lc.TLSKeyFile)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("loading TLS certificate for %s: %w", lc.name(), err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+	return listener, nil
+}
+
+// listenUnix creates a unix domain socket, removing a stale socket file left by a
+// previous run; a socket another server still accepts on is an error
+func listenUnix(lc ListenerConfig) (net.Listener, error) {
+	if info, err := os.Lstat(lc.Address); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", lc.Address)
+		}
+		conn, err := net.DialTimeout("unix", lc.Address, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by a running server", lc.Address)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("checking whether %s is stale: %w", lc.Address, err)
+		}
+		if err := os.Remove(lc.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	// the socket is private until it gets SocketMode, nobody connects in between
+	listener, err := listenPrivate(lc.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if lc.SocketMode != "" {
+		mode, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("invalid SocketMode %q for %s", lc.SocketMode, lc.Address)
+		}
+		if err := os.Chmod(lc.Address, os.FileMode(mode)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// serveListener accepts connections on a single listener until it is closed
+func (s *Server) serveListener(listener net.Listener, lc ListenerConfig) error {
+	for {
+		// an admin may have paused accepting
+		s.gate.wait()
+
+		connection, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if s.state.draining.Load() {
+				return nil
+			}
+			s.logger.Warn("Error accepting connection", "listener", lc.name(), "error", err)
+			continue
+		}
+
+		// selecting a slot in the semaphore
+		s.metrics.acquireSlot(s.semaphore)
+
+		// the server may have started draining while waiting for the slot
+		if s.state.draining.Load() {
+			connection.Close()
+			s.metrics.releaseSlot(s.semaphore)
+			continue
+		}
+
+		// handling the connection in a new goroutine
+		go s.handleConnection(connection, lc)
+	}
+}
@@ -0,0 +1,121 @@
+package taskserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/mutex"
+)
+
+// distributed lock configuration, disabled when Address is empty
+//
+// Servers listing each other as Peers share named locks with the Ricart–Agrawala
+// algorithm. Task handlers take them with Server.Lock; the tasks declared exclusive,
+// in ExclusiveTasks or with RegisterExclusiveTask, run under a lock named after the
+// task, so no two servers run them at once. Without Address the locks only exclude
+// the requests of this server.
+type MutexConfig struct {
+	ID      int          `json:"ID"`      // unique among the servers, breaks ties between requests
+	Address string       `json:"Address"` // tcp address of the lock listener
+	Peers   []mutex.Peer `json:"Peers"`
+
+	AcquireTimeoutMilliseconds int   `json:"AcquireTimeoutMilliseconds"` // an exclusive task waiting longer fails with lock_timeout
+	ExclusiveTasks             []int `json:"ExclusiveTasks"`
+}
+
+// newMutex creates the lock node of the server, nil when distributed locks are disabled
+func (s *Server) newMutex(config MutexConfig) (*mutex.Node, error) {
+	if config.Address == "" {
+		return nil, nil
+	}
+	return mutex.New(mutex.Config{
+		ID:      config.ID,
+		Address: config.Address,
+		Peers:   config.Peers,
+		Logger:  s.logger,
+	})
+}
+
+// Lock takes a lock shared with the other servers, waiting until ctx is done; the
+// returned function releases it
+func (s *Server) Lock(ctx context.Context, name string) (unlock func(), err error) {
+	start := time.Now()
+	defer func() {
+		s.metrics.lockWaitMicros.Add(uint64(time.Since(start).Microseconds()))
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.metrics.lockTimeouts.Add(1)
+		}
+		if err == nil {
+			s.metrics.lockAcquisitions.Add(1)
+		}
+	}()
+
+	if s.mutex != nil {
+		if err := s.mutex.Acquire(ctx, name); err != nil {
+			return nil, err
+		}
+		return func() { s.mutex.Release(name) }, nil
+	}
+
+	s.localLocksMu.Lock()
+	local, ok := s.localLocks[name]
+	if !ok {
+		local = make(chan struct{}, 1)
+		s.localLocks[name] = local
+	}
+	s.localLocksMu.Unlock()
+	select {
+	case local <- struct{}{}:
+		return func() { <-local }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RegisterExclusiveTask adds or replaces a task that never runs on two servers at once
+func (s *Server) RegisterExclusiveTask(taskNumber int, handler TaskHandler) {
+	s.tasksMu.Lock()
+	defer s.tasksMu.Unlock()
+	s.tasks[taskNumber] = handler
+	s.exclusive[taskNumber] = true
+}
+
+// exclusiveTask reports whether a task runs under its distributed lock
+func (s *Server) exclusiveTask(taskNumber int) bool {
+	s.tasksMu.RLock()
+	defer s.tasksMu.RUnlock()
+	return s.exclusive[taskNumber]
+}
+
+// exclusiveLockName is the lock held while an exclusive task runs
+func exclusiveLockName(taskNumber int) string {
+	return fmt.Sprintf("task-%d", taskNumber)
+}
+
+// lockExclusiveTask takes the lock of an exclusive task, waiting at most AcquireTimeoutMilliseconds
+func (s *Server) lockExclusiveTask(taskNumber int) (func(), error) {
+	timeout := time.Duration(s.activeConfig().Mutex.AcquireTimeoutMilliseconds) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	unlock, err := s.Lock(ctx, exclusiveLockName(taskNumber))
+	if err != nil {
+		return nil, &TaskError{Code: errLockTimeout, Message: fmt.Sprintf("Task %d is exclusive and its lock was not acquired: %v", taskNumber, err)}
+	}
+	return unlock, nil
+}
+
+// locksStatus is returned by the "locks" admin operation
+type locksStatus struct {
+	Enabled bool               `json:"enabled"`
+	Clock   uint64             `json:"clock,omitempty"` // Lamport clock of the server
+	Locks   []mutex.LockStatus `json:"locks,omitempty"`
+}
+
+func (s *Server) locksStatus() locksStatus {
+	if s.mutex == nil {
+		return locksStatus{}
+	}
+	return locksStatus{Enabled: true, Clock: s.mutex.Clock(), Locks: s.mutex.Locks()}
+}
@@ -0,0 +1,78 @@
+package taskserver
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logging configuration
+type LoggingConfig struct {
+	Level           string `json:"Level"`           // debug, info, warn or error
+	Format          string `json:"Format"`          // text or json
+	Payloads        bool   `json:"Payloads"`        // log request and response bodies at debug level
+	PayloadMaxBytes int    `json:"PayloadMaxBytes"` // payloads longer than this are truncated, 0 for no limit
+	File            string `json:"File"`            // log file, empty for stderr
+	FileMaxSizeMB   int    `json:"FileMaxSizeMB"`   // rotate the log file above this size, 0 to never rotate
+	FileMaxBackups  int    `json:"FileMaxBackups"`  // rotated files to keep, 0 to keep all
+}
+
+// parseLevel converts a level name from the configuration
+func parseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", name)
+	}
+	return level, nil
+}
+
+// NewLogger creates the logger described by the configuration, its level is kept in
+// levelVar so it can be changed while the server is running; the returned closer
+// releases the log file
+func NewLogger(config LoggingConfig, levelVar *slog.LevelVar) (*slog.Logger, io.Closer, error) {
+	level, err := parseLevel(config.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	levelVar.Set(level)
+
+	var output io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+	if config.File != "" {
+		writer, err := newRotatingWriter(config.File, rotateOptions{
+			MaxSize:    int64(config.FileMaxSizeMB) * 1024 * 1024,
+			MaxBackups: config.FileMaxBackups,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		output, closer = writer, writer
+	}
+
+	options := &slog.HandlerOptions{Level: levelVar}
+	var handler slog.Handler
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(output, options)
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	default:
+		closer.Close()
+		return nil, nil, fmt.Errorf("invalid log format %q", config.Format)
+	}
+	return slog.New(handler), closer, nil
+}
+
+// payload returns the attribute for a request or response body, truncated to the configured size
+func payload(config LoggingConfig, key string, body []byte) slog.Attr {
+	text := strings.TrimRight(string(body), "\r\n")
+	if config.PayloadMaxBytes > 0 && len(text) > config.PayloadMaxBytes {
+		text = fmt.Sprintf("%s... (%d bytes truncated)", text[:config.PayloadMaxBytes], len(text)-config.PayloadMaxBytes)
+	}
+	return slog.String(key, text)
+}
@@ -0,0 +1,102 @@
+package taskserver
+
+import (
+	"net"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/gossip"
+)
+
+// gossip membership configuration, disabled when BindAddress is empty
+//
+// Servers find each other through Seeds instead of static peer lists and keep a
+// membership view with failure detection; the client address of every member is
+// announced in its metadata.
+type GossipConfig struct {
+	Name             string   `json:"Name"`             // unique in the cluster
+	BindAddress      string   `json:"BindAddress"`      // udp address of the gossip listener
+	AdvertiseAddress string   `json:"AdvertiseAddress"` // announced to the others, default BindAddress
+	ClientAddress    string   `json:"ClientAddress"`    // client address in the metadata, see gossipClientAddress
+	Seeds            []string `json:"Seeds"`            // gossip addresses of members to join through
+
+	ProbeIntervalMilliseconds    int `json:"ProbeIntervalMilliseconds"`
+	ProbeTimeoutMilliseconds     int `json:"ProbeTimeoutMilliseconds"` // wait for a direct ack before probing indirectly
+	IndirectProbes               int `json:"IndirectProbes"`
+	SuspicionTimeoutMilliseconds int `json:"SuspicionTimeoutMilliseconds"` // time a suspect member has to refute before it is dead
+}
+
+// WithMembershipChange registers a callback called when a member joins, becomes
+// suspect, dies or leaves; it must not block
+func WithMembershipChange(callback func(gossip.Event)) Option {
+	return func(s *Server) {
+		s.membershipCallbacks = append(s.membershipCallbacks, callback)
+	}
+}
+
+// newMembership creates the gossip node of the server, nil when gossip is disabled
+func (s *Server) newMembership(config Config) (*gossip.Node, error) {
+	if config.Gossip.BindAddress == "" {
+		return nil, nil
+	}
+	meta := map[string]string{"client_address": config.Gossip.ClientAddress}
+	if config.Cache.Address != "" {
+		meta["cache_address"] = config.Cache.AdvertiseAddress
+	}
+	return gossip.New(gossip.Config{
+		Name:             config.Gossip.Name,
+		BindAddress:      config.Gossip.BindAddress,
+		AdvertiseAddress: config.Gossip.AdvertiseAddress,
+		Seeds:            config.Gossip.Seeds,
+		Meta:             meta,
+		ProbeInterval:    time.Duration(config.Gossip.ProbeIntervalMilliseconds) * time.Millisecond,
+		ProbeTimeout:     time.Duration(config.Gossip.ProbeTimeoutMilliseconds) * time.Millisecond,
+		IndirectProbes:   config.Gossip.IndirectProbes,
+		SuspicionTimeout: time.Duration(config.Gossip.SuspicionTimeoutMilliseconds) * time.Millisecond,
+		Logger:           s.logger,
+		OnChange: func(event gossip.Event) {
+			s.metrics.membershipChanges.Add(1)
+			for _, callback := range s.membershipCallbacks {
+				callback(event)
+			}
+		},
+	})
+}
+
+// gossipClientAddress is the default client address announced to the other members,
+// Host:Port unless Host listens on every interface, then the host the others reach the
+// gossip listener at
+func gossipClientAddress(config Config) string {
+	host := config.Host
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		advertise := config.Gossip.AdvertiseAddress
+		if advertise == "" {
+			advertise = config.Gossip.BindAddress
+		}
+		if advertiseHost, _, err := net.SplitHostPort(advertise); err == nil {
+			host = advertiseHost
+		}
+	}
+	return net.JoinHostPort(host, config.Port)
+}
+
+// Members returns the membership view including this server, nil without gossip
+func (s *Server) Members() []gossip.Member {
+	if s.membership == nil {
+		return nil
+	}
+	return s.membership.Members()
+}
+
+// membershipStatus is part of the health report, the number of members in each state
+type membershipStatus struct {
+	Name   string         `json:"name"`
+	States map[string]int `json:"states"`
+}
+
+func (s *Server) membershipStatus() membershipStatus {
+	status := membershipStatus{Name: s.membership.LocalMember().Name, States: make(map[string]int)}
+	for _, member := range s.membership.Members() {
+		status.States[member.State]++
+	}
+	return status
+}
@@ -0,0 +1,422 @@
+package taskserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/gossip"
+)
+
+// error codes sent to clients and used as metric labels
+const (
+	errInvalidJSON  = "invalid_json"
+	errUnknownOp    = "unknown_op"
+	errAuthRequired = "auth_required"
+	errInvalidToken = "invalid_token"
+	errTaskFailed   = "task_failed"
+	errRateLimited  = "rate_limited"
+
+	errMessageTooLarge = "message_too_large"
+
+	// a retry whose task or input differs from the request that first used the idempotency key
+	errIdempotencyConflict = "idempotency_conflict"
+
+	// cluster errors, returned by a coordinator
+	errNoWorkers    = "no_workers"
+	errWorkerFailed = "worker_failed"
+
+	// replicated job queue errors
+	errNotLeader       = "not_leader" // the result names the leader to retry on
+	errUnknownJob      = "unknown_job"
+	errJobsUnavailable = "jobs_unavailable"
+
+	// atomic batch errors
+	errBatchAborted = "batch_aborted" // the result has the id and state of the batch
+	errUnknownBatch = "unknown_batch"
+
+	// an exclusive task whose lock was not acquired in time
+	errLockTimeout = "lock_timeout"
+
+	// admin interface errors
+	errUnknownConnection  = "unknown_connection"
+	errInvalidArgument    = "invalid_argument"
+	errSnapshotInProgress = "snapshot_in_progress"
+)
+
+// upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// histogram with cumulative buckets, as expected by Prometheus
+type histogram struct {
+	counts []uint64 // one per bucket, plus +Inf at the end
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(latencyBuckets)]++
+	h.sum += value
+	h.count++
+}
+
+// label of the requests for task numbers that are not registered, the clients choose the
+// number and must not be able to create a series for each one
+const unknownTask = "unknown"
+
+// serverMetrics holds every counter exported by the server
+type serverMetrics struct {
+	mu        sync.Mutex
+	requests  map[string]uint64     // by task
+	errors    map[string]uint64     // by error code
+	latencies map[string]*histogram // by task
+	slowClose map[string]uint64     // connections closed for being slow, by reason
+
+	connectionsTotal    atomic.Uint64
+	activeConnections   atomic.Int64
+	semaphoreCapacity   atomic.Int64
+	semaphoreInUse      atomic.Int64
+	semaphoreSaturated  atomic.Uint64 // accepts that had to wait for a free slot
+	semaphoreWaitMicros atomic.Uint64
+	bytesReceived       atomic.Uint64
+	bytesSent           atomic.Uint64
+	idempotentReplays   atomic.Uint64 // responses served from the idempotency store
+	pingsSent           atomic.Uint64
+	deadConnections     atomic.Uint64 // closed after unanswered pings
+	inFlight            atomic.Int64  // tasks being executed, reported to the coordinator as the load
+	leaderChanges       atomic.Uint64
+	jobsSubmitted       atomic.Uint64
+	jobsCompleted       atomic.Uint64
+	membershipChanges   atomic.Uint64
+	cacheHits           atomic.Uint64 // results found on this server
+	cacheRemoteHits     atomic.Uint64 // results found on another owner
+	cacheMisses         atomic.Uint64
+	cacheHandoffs       atomic.Uint64 // results pushed to a new owner after the ring changed
+	lockAcquisitions    atomic.Uint64
+	lockTimeouts        atomic.Uint64 // lock requests whose deadline passed before the lock was acquired
+	lockWaitMicros      atomic.Uint64
+	batchesCommitted    atomic.Uint64
+	batchesAborted      atomic.Uint64
+	snapshotsTaken      atomic.Uint64
+	snapshotsIncomplete atomic.Uint64 // written with missing states or channels
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:  make(map[string]uint64),
+		errors:    make(map[string]uint64),
+		latencies: make(map[string]*histogram),
+		slowClose: make(map[string]uint64),
+	}
+}
+
+// observeRequest records a processed task request and its duration, label is the task
+// number or unknownTask
+func (m *serverMetrics) observeRequest(label string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[label]++
+	h, ok := m.latencies[label]
+	if !ok {
+		h = &histogram{}
+		m.latencies[label] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// observeError records an error response sent to a client
+func (m *serverMetrics) observeError(code string) {
+	m.mu.Lock()
+	m.errors[code]++
+	m.mu.Unlock()
+}
+
+// observeSlowClose records a connection closed by the slow client protection
+func (m *serverMetrics) observeSlowClose(reason string) {
+	m.mu.Lock()
+	m.slowClose[reason]++
+	m.mu.Unlock()
+}
+
+// acquireSlot takes a semaphore slot, recording whether the server was saturated
+func (m *serverMetrics) acquireSlot(semaphore *connectionSemaphore) {
+	if !semaphore.tryAcquire() {
+		// every slot is taken, the listener waits here
+		m.semaphoreSaturated.Add(1)
+		start := time.Now()
+		semaphore.acquire()
+		m.semaphoreWaitMicros.Add(uint64(time.Since(start).Microseconds()))
+	}
+	m.semaphoreInUse.Add(1)
+}
+
+// releaseSlot gives a semaphore slot back
+func (m *serverMetrics) releaseSlot(semaphore *connectionSemaphore) {
+	semaphore.release()
+	m.semaphoreInUse.Add(-1)
+}
+
+// countingConn counts the bytes going through a connection
+type countingConn struct {
+	net.Conn
+	metrics *serverMetrics
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+// sortedKeys returns the keys of a map in a stable order
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writePrometheus writes all metrics in the Prometheus text exposition format
+func (m *serverMetrics) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP tema1_requests_total Task requests processed, by task.")
+	fmt.Fprintln(w, "# TYPE tema1_requests_total counter")
+	for _, task := range sortedKeys(m.requests) {
+		fmt.Fprintf(w, "tema1_requests_total{task=%q} %d\n", task, m.requests[task])
+	}
+
+	fmt.Fprintln(w, "# HELP tema1_errors_total Error responses sent, by error code.")
+	fmt.Fprintln(w, "# TYPE tema1_errors_total counter")
+	for _, code := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "tema1_errors_total{code=%q} %d\n", code, m.errors[code])
+	}
+
+	fmt.Fprintln(w, "# HELP tema1_slow_connections_closed_total Connections closed for sending or reading too slowly, by reason.")
+	fmt.Fprintln(w, "# TYPE tema1_slow_connections_closed_total counter")
+	for _, reason := range sortedKeys(m.slowClose) {
+		fmt.Fprintf(w, "tema1_slow_connections_closed_total{reason=%q} %d\n", reason, m.slowClose[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP tema1_request_duration_seconds Task execution latency, by task.")
+	fmt.Fprintln(w, "# TYPE tema1_request_duration_seconds histogram")
+	for _, task := range sortedKeys(m.latencies) {
+		h := m.latencies[task]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "tema1_request_duration_seconds_bucket{task=%q,le=\"%g\"} %d\n", task, bound, h.counts[i])
+		}
+		fmt.Fprintf(w, "tema1_request_duration_seconds_bucket{task=%q,le=\"+Inf\"} %d\n", task, h.counts[len(latencyBuckets)])
+		fmt.Fprintf(w, "tema1_request_duration_seconds_sum{task=%q} %g\n", task, h.sum)
+		fmt.Fprintf(w, "tema1_request_duration_seconds_count{task=%q} %d\n", task, h.count)
+	}
+
+	writeSample(w, "tema1_connections_total", "counter", "Connections accepted.", m.connectionsTotal.Load())
+	writeSample(w, "tema1_active_connections", "gauge", "Connections currently open.", m.activeConnections.Load())
+	writeSample(w, "tema1_semaphore_capacity", "gauge", "Maximum concurrent connections.", m.semaphoreCapacity.Load())
+	writeSample(w, "tema1_semaphore_in_use", "gauge", "Semaphore slots currently taken.", m.semaphoreInUse.Load())
+	writeSample(w, "tema1_semaphore_saturated_total", "counter", "Accepts that waited for a free semaphore slot.", m.semaphoreSaturated.Load())
+	writeSample(w, "tema1_semaphore_wait_seconds_total", "counter", "Time spent waiting for a free semaphore slot.", float64(m.semaphoreWaitMicros.Load())/1e6)
+	writeSample(w, "tema1_bytes_received_total", "counter", "Bytes read from clients.", m.bytesReceived.Load())
+	writeSample(w, "tema1_bytes_sent_total", "counter", "Bytes written to clients.", m.bytesSent.Load())
+	writeSample(w, "tema1_heartbeat_pings_total", "counter", "Heartbeat pings sent to clients.", m.pingsSent.Load())
+	writeSample(w, "tema1_dead_connections_total", "counter", "Connections closed after unanswered heartbeat pings.", m.deadConnections.Load())
+	writeSample(w, "tema1_idempotent_replays_total", "counter", "Retried requests answered with a stored response.", m.idempotentReplays.Load())
+	writeSample(w, "tema1_tasks_in_flight", "gauge", "Tasks being executed or forwarded.", m.inFlight.Load())
+	writeSample(w, "tema1_election_leader_changes_total", "counter", "Leaders or terms accepted by the election.", m.leaderChanges.Load())
+	writeSample(w, "tema1_jobs_submitted_total", "counter", "Jobs committed to the replicated queue by this server.", m.jobsSubmitted.Load())
+	writeSample(w, "tema1_gossip_membership_changes_total", "counter", "Membership changes seen by the gossip protocol.", m.membershipChanges.Load())
+	writeSample(w, "tema1_jobs_completed_total", "counter", "Jobs run by this server while it led the queue.", m.jobsCompleted.Load())
+	writeSample(w, "tema1_cache_hits_total", "counter", "Task results found in the local cache.", m.cacheHits.Load())
+	writeSample(w, "tema1_cache_remote_hits_total", "counter", "Task results found in the cache of another node.", m.cacheRemoteHits.Load())
+	writeSample(w, "tema1_cache_misses_total", "counter", "Cacheable tasks executed because no owner had the result.", m.cacheMisses.Load())
+	writeSample(w, "tema1_cache_handoffs_total", "counter", "Cached results pushed to a new owner after the ring changed.", m.cacheHandoffs.Load())
+	writeSample(w, "tema1_batches_committed_total", "counter", "Batches committed by this coordinator.", m.batchesCommitted.Load())
+	writeSample(w, "tema1_batches_aborted_total", "counter", "Batches aborted by this coordinator.", m.batchesAborted.Load())
+	writeSample(w, "tema1_snapshots_total", "counter", "Cluster snapshots written by this coordinator.", m.snapshotsTaken.Load())
+	writeSample(w, "tema1_snapshots_incomplete_total", "counter", "Cluster snapshots written without some states or channels.", m.snapshotsIncomplete.Load())
+	writeSample(w, "tema1_lock_acquisitions_total", "counter", "Distributed locks acquired.", m.lockAcquisitions.Load())
+	writeSample(w, "tema1_lock_timeouts_total", "counter", "Distributed lock requests given up before the lock was acquired.", m.lockTimeouts.Load())
+	writeSample(w, "tema1_lock_wait_seconds_total", "counter", "Time spent waiting for distributed locks.", float64(m.lockWaitMicros.Load())/1e6)
+}
+
+// counters returns the totals recorded in a snapshot of the server state
+func (m *serverMetrics) counters() map[string]int64 {
+	counters := map[string]int64{
+		"connections_total":  int64(m.connectionsTotal.Load()),
+		"active_connections": m.activeConnections.Load(),
+		"tasks_in_flight":    m.inFlight.Load(),
+		"jobs_submitted":     int64(m.jobsSubmitted.Load()),
+		"jobs_completed":     int64(m.jobsCompleted.Load()),
+		"batches_committed":  int64(m.batchesCommitted.Load()),
+		"batches_aborted":    int64(m.batchesAborted.Load()),
+		"idempotent_replays": int64(m.idempotentReplays.Load()),
+		"cache_hits":         int64(m.cacheHits.Load() + m.cacheRemoteHits.Load()),
+		"cache_misses":       int64(m.cacheMisses.Load()),
+		"lock_acquisitions":  int64(m.lockAcquisitions.Load()),
+		"requests_total":     0,
+		"error_responses":    0,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, count := range m.requests {
+		counters["requests_total"] += int64(count)
+	}
+	for _, count := range m.errors {
+		counters["error_responses"] += int64(count)
+	}
+	return counters
+}
+
+// writeSample writes a metric without labels, with its HELP and TYPE lines
+func writeSample(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// stats is the JSON view of the metrics
+type stats struct {
+	Requests           map[string]uint64  `json:"requests"`
+	Errors             map[string]uint64  `json:"errors"`
+	AverageLatencyMs   map[string]float64 `json:"average_latency_ms"`
+	ConnectionsTotal   uint64             `json:"connections_total"`
+	ActiveConnections  int64              `json:"active_connections"`
+	SemaphoreCapacity  int64              `json:"semaphore_capacity"`
+	SemaphoreInUse     int64              `json:"semaphore_in_use"`
+	SemaphoreSaturated uint64             `json:"semaphore_saturated"`
+	BytesReceived      uint64             `json:"bytes_received"`
+	BytesSent          uint64             `json:"bytes_sent"`
+}
+
+// snapshot returns a copy of the metrics for the JSON view
+func (m *serverMetrics) snapshot() stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := stats{
+		Requests:           make(map[string]uint64, len(m.requests)),
+		Errors:             make(map[string]uint64, len(m.errors)),
+		AverageLatencyMs:   make(map[string]float64, len(m.latencies)),
+		ConnectionsTotal:   m.connectionsTotal.Load(),
+		ActiveConnections:  m.activeConnections.Load(),
+		SemaphoreCapacity:  m.semaphoreCapacity.Load(),
+		SemaphoreInUse:     m.semaphoreInUse.Load(),
+		SemaphoreSaturated: m.semaphoreSaturated.Load(),
+		BytesReceived:      m.bytesReceived.Load(),
+		BytesSent:          m.bytesSent.Load(),
+	}
+	for task, count := range m.requests {
+		s.Requests[task] = count
+	}
+	for code, count := range m.errors {
+		s.Errors[code] = count
+	}
+	for task, h := range m.latencies {
+		if h.count > 0 {
+			s.AverageLatencyMs[task] = h.sum / float64(h.count) * 1000
+		}
+	}
+	return s
+}
+
+// HTTPHandler returns the handlers served on HTTPAddress, metrics and health probes,
+// for embedding them in an HTTP server of the caller
+func (s *Server) HTTPHandler() http.Handler {
+	metrics := s.metrics
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writePrometheus(w)
+		if s.election != nil {
+			leader, term := s.Leader()
+			isLeader := 0
+			if s.IsLeader() {
+				isLeader = 1
+			}
+			writeSample(w, "tema1_election_leader", "gauge", "ID of the elected leader, 0 before the first election.", leader)
+			writeSample(w, "tema1_election_term", "gauge", "Current election term.", term)
+			writeSample(w, "tema1_election_is_leader", "gauge", "1 if this server is the leader.", isLeader)
+		}
+		if s.jobLog != nil {
+			status := s.jobsStatus()
+			isLeader := 0
+			if s.jobLog.IsLeader() {
+				isLeader = 1
+			}
+			writeSample(w, "tema1_jobs_raft_term", "gauge", "Current term of the job queue log.", status.Raft.Term)
+			writeSample(w, "tema1_jobs_raft_is_leader", "gauge", "1 if this server leads the job queue.", isLeader)
+			writeSample(w, "tema1_jobs_raft_commit_index", "gauge", "Index of the last committed entry of the job queue log.", status.Raft.CommitIndex)
+			writeSample(w, "tema1_jobs_pending", "gauge", "Jobs waiting to be run.", status.Pending)
+		}
+		if s.membership != nil {
+			status := s.membershipStatus()
+			fmt.Fprintln(w, "# HELP tema1_gossip_members Members of the gossip membership view, by state.")
+			fmt.Fprintln(w, "# TYPE tema1_gossip_members gauge")
+			for _, state := range []string{gossip.Alive, gossip.Suspect, gossip.Dead, gossip.Left} {
+				fmt.Fprintf(w, "tema1_gossip_members{state=%q} %d\n", state, status.States[state])
+			}
+		}
+		if s.mutex != nil {
+			writeSample(w, "tema1_mutex_lamport_clock", "gauge", "Lamport clock of the distributed locks.", s.mutex.Clock())
+		}
+		if s.cache != nil {
+			status := s.cacheStatus()
+			writeSample(w, "tema1_cache_entries", "gauge", "Results stored in the cache of this server.", status.Entries)
+			writeSample(w, "tema1_cache_ring_nodes", "gauge", "Nodes on the cache ring.", len(status.Ring))
+		}
+		if s.coordinator != nil {
+			timeout := time.Duration(s.activeConfig().Cluster.WorkerTimeoutSeconds) * time.Second
+			writeSample(w, "tema1_cluster_workers_healthy", "gauge", "Registered workers that can receive tasks.", s.coordinator.healthyWorkers(timeout))
+		}
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(metrics.snapshot())
+	})
+	s.registerHealthHandlers(mux)
+	return mux
+}
+
+// startHTTPServer serves the metrics endpoints in the background, it is closed by Shutdown
+func (s *Server) startHTTPServer(address string) error {
+	if strings.TrimSpace(address) == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.addCloser(listener)
+	s.logger.Info("Metrics available", "url", "http://"+listener.Addr().String()+"/metrics")
+	go func() {
+		if err := http.Serve(listener, s.HTTPHandler()); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error("HTTP server stopped", "error", err)
+		}
+	}()
+	return nil
+}
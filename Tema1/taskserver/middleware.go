@@ -0,0 +1,239 @@
+package taskserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// names of the built-in middlewares, in the order they wrap a task
+const (
+	LoggingMiddleware   = "logging"
+	RateLimitMiddleware = "ratelimit"
+)
+
+// middleware configuration
+type MiddlewareConfig struct {
+	Disabled  []string        `json:"Disabled"` // names of middlewares to skip, built-in or registered from code
+	RateLimit RateLimitConfig `json:"RateLimit"`
+}
+
+// rate limit applied to task requests, disabled when RequestsPerSecond is 0
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"RequestsPerSecond"` // sustained rate allowed for every remote host
+	Burst             int     `json:"Burst"`             // requests allowed at once above the rate
+}
+
+// ConnInfo describes the connection a request arrived on
+type ConnInfo struct {
+	ID          string
+	Remote      string
+	Listener    string
+	ConnectedAt time.Time
+}
+
+// Request is a task request as seen by the middlewares
+type Request struct {
+	GenericRequest
+	ID     string       // request id, also found in the logs and the audit log
+	Conn   ConnInfo     // connection the request arrived on
+	Scope  string       // idempotency scope of the client, see secretScope
+	Logger *slog.Logger // carries the connection and request ids
+
+	// set by the idempotency middleware when the task was not executed again
+	Replayed bool
+}
+
+// Handler executes a task request and returns the encoded result
+type Handler func(req *Request) (json.RawMessage, error)
+
+// Middleware wraps a handler, it can inspect or reject the request before calling
+// next and inspect the result after it
+type Middleware func(next Handler) Handler
+
+// TaskError is an error with the code and message sent to the client, any other
+// error returned by a handler is reported as an internal error
+type TaskError struct {
+	Code    string
+	Message string
+}
+
+func (e *TaskError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// errorResponse returns the code and message sent to the client for a handler error
+func errorResponse(err error) (code, message string) {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr.Code, taskErr.Message
+	}
+	return errTaskFailed, "Internal server error"
+}
+
+// namedMiddleware is a middleware registered on the server, the name is used by MiddlewareConfig.Disabled
+type namedMiddleware struct {
+	name string
+	wrap Middleware
+}
+
+// WithMiddleware appends a middleware to the chain, after the built-in ones
+func WithMiddleware(name string, middleware Middleware) Option {
+	return func(s *Server) {
+		s.middlewares = append(s.middlewares, namedMiddleware{name, middleware})
+	}
+}
+
+// Use appends a middleware to the chain, it applies to the requests received after the call
+func (s *Server) Use(name string, middleware Middleware) {
+	s.chainMu.Lock()
+	s.middlewares = append(s.middlewares, namedMiddleware{name, middleware})
+	s.chainMu.Unlock()
+	s.buildChain()
+}
+
+// buildChain composes the enabled middlewares around the task handler, the first
+// registered middleware is the outermost one
+func (s *Server) buildChain() {
+	s.chainMu.Lock()
+	defer s.chainMu.Unlock()
+	config := s.activeConfig().Middleware
+
+	// a coordinator forwards the task to a worker instead of running it
+	var handler Handler = func(req *Request) (json.RawMessage, error) {
+		s.metrics.inFlight.Add(1)
+		defer s.metrics.inFlight.Add(-1)
+		if s.coordinator != nil {
+			return s.dispatch(req)
+		}
+		return s.handleTask(req.TaskNumber, req.Input)
+	}
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		if !contains(config.Disabled, s.middlewares[i].name) {
+			handler = s.middlewares[i].wrap(handler)
+		}
+	}
+	s.chain = handler
+}
+
+// execute runs a request through the middleware chain
+func (s *Server) execute(req *Request) (json.RawMessage, error) {
+	s.chainMu.RLock()
+	handler := s.chain
+	s.chainMu.RUnlock()
+	return handler(req)
+}
+
+// builtinMiddlewares returns the middlewares every server starts with
+func (s *Server) builtinMiddlewares() []namedMiddleware {
+	middlewares := []namedMiddleware{
+		{LoggingMiddleware, s.logRequests},
+		{IdempotencyMiddleware, s.idempotency.middleware},
+		{RateLimitMiddleware, s.rateLimiter.middleware},
+	}
+	if s.cache != nil {
+		middlewares = append(middlewares, namedMiddleware{CacheMiddleware, s.cacheResults})
+	}
+	return middlewares
+}
+
+// logRequests logs the outcome and duration of every task
+func (s *Server) logRequests(next Handler) Handler {
+	return func(req *Request) (json.RawMessage, error) {
+		start := time.Now()
+		result, err := next(req)
+		duration := time.Since(start)
+		if err != nil {
+			req.Logger.Warn("Error handling task", "error", err, "duration", duration)
+			return result, err
+		}
+		req.Logger.Info("Request processed", "duration", duration)
+		if logging := s.activeConfig().Logging; logging.Payloads {
+			req.Logger.Debug("Response sent", payload(logging, "payload", result))
+		}
+		return result, nil
+	}
+}
+
+// rateLimiter keeps a token bucket for every remote host
+type rateLimiter struct {
+	mu      sync.Mutex
+	config  RateLimitConfig
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// buckets unused for this long are forgotten
+const rateLimitBucketTTL = time.Minute
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	return &rateLimiter{config: config, buckets: make(map[string]*tokenBucket), pruned: time.Now()}
+}
+
+// setConfig changes the limits, the buckets are kept
+func (l *rateLimiter) setConfig(config RateLimitConfig) {
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	l.mu.Lock()
+	l.config = config
+	l.mu.Unlock()
+}
+
+// allow takes a token from the bucket of key, it reports whether one was available
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.config.RequestsPerSecond <= 0 {
+		return true
+	}
+
+	// forgetting the hosts that stopped sending requests
+	if now.Sub(l.pruned) > rateLimitBucketTTL {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.last) > rateLimitBucketTTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.config.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = min(float64(l.config.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.config.RequestsPerSecond)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// middleware rejects the requests of a host above the configured rate
+func (l *rateLimiter) middleware(next Handler) Handler {
+	return func(req *Request) (json.RawMessage, error) {
+		// every connection from the same host shares a bucket, unix sockets share one per listener
+		key := req.Conn.Listener
+		if host, _, err := net.SplitHostPort(req.Conn.Remote); err == nil {
+			key = host
+		}
+		if !l.allow(key, time.Now()) {
+			return nil, &TaskError{Code: errRateLimited, Message: "Rate limit exceeded"}
+		}
+		return next(req)
+	}
+}
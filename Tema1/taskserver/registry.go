@@ -0,0 +1,128 @@
+package taskserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// service registry configuration, the server does not register when Address is empty
+//
+// The server registers its address and tasks with the registry, renews the
+// registration with a heartbeat carrying its load and deregisters on shutdown;
+// the registry drops an instance silent for TTLSeconds.
+type RegistryConfig struct {
+	Address                  string `json:"Address"`                  // tcp address of the registry
+	Service                  string `json:"Service"`                  // name clients look the server up by
+	Token                    string `json:"Token"`                    // shared token the registry requires to register
+	InstanceID               string `json:"InstanceID"`               // unique name of this server, defaults to Host:Port
+	AdvertiseAddress         string `json:"AdvertiseAddress"`         // address clients connect to, defaults to Host:Port
+	HeartbeatIntervalSeconds int    `json:"HeartbeatIntervalSeconds"` // how often the registration is renewed
+	TTLSeconds               int    `json:"TTLSeconds"`               // silence after which the registry drops the server
+}
+
+// request sent to the registry, one JSON object per line; the registry answers with a GenericResponse
+type registryRequest struct {
+	Op          string `json:"op"` // register, heartbeat or deregister
+	Token       string `json:"token"`
+	Service     string `json:"service,omitempty"`
+	ID          string `json:"id"`
+	Address     string `json:"address,omitempty"`
+	Tasks       []int  `json:"tasks,omitempty"`
+	Load        int64  `json:"load"`        // tasks being executed
+	Connections int64  `json:"connections"` // open client connections
+	TTLSeconds  int    `json:"ttl_seconds,omitempty"`
+}
+
+// registerWithRegistry keeps the server registered until it shuts down, reconnecting
+// when the registry is unreachable
+func (s *Server) registerWithRegistry() {
+	failures := 0
+	for {
+		registered, err := s.renewRegistration()
+		if err == nil {
+			return
+		}
+		// a registry that is down is reported once, not on every retry
+		if registered {
+			failures = 0
+		}
+		failures++
+		if failures == 1 {
+			s.logger.Warn("Lost connection to the registry, retrying", "error", err)
+		} else {
+			s.logger.Debug("Registry still unreachable", "error", err)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(time.Duration(s.activeConfig().Registry.HeartbeatIntervalSeconds) * time.Second):
+		}
+	}
+}
+
+// renewRegistration registers on a new connection and sends heartbeats on it,
+// it deregisters and returns a nil error when the server shuts down
+func (s *Server) renewRegistration() (registered bool, err error) {
+	config := s.activeConfig().Registry
+	conn, err := net.DialTimeout("tcp", config.Address, 5*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(req registryRequest) error {
+		encoded, _ := json.Marshal(req)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(append(encoded, '\n')); err != nil {
+			return err
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		var response GenericResponse
+		if err := json.Unmarshal([]byte(line), &response); err != nil {
+			return err
+		}
+		if response.Status != "success" {
+			return fmt.Errorf("registry rejected %s: %s", req.Op, response.Error)
+		}
+		return nil
+	}
+
+	req := registryRequest{
+		Op:         "register",
+		Token:      config.Token,
+		Service:    config.Service,
+		ID:         config.InstanceID,
+		Address:    config.AdvertiseAddress,
+		Tasks:      s.taskNumbers(),
+		TTLSeconds: config.TTLSeconds,
+	}
+	for {
+		req.Load = s.metrics.inFlight.Load()
+		req.Connections = s.metrics.activeConnections.Load()
+		if err := send(req); err != nil {
+			return registered, err
+		}
+		if req.Op == "register" {
+			registered = true
+			s.logger.Info("Registered with the registry", "registry", config.Address, "service", config.Service, "instance", config.InstanceID)
+		}
+
+		req = registryRequest{Op: "heartbeat", Token: config.Token, Service: config.Service, ID: config.InstanceID}
+		select {
+		case <-s.done:
+			// the registry stops handing out the server now instead of after the TTL
+			if err := send(registryRequest{Op: "deregister", Token: config.Token, Service: config.Service, ID: config.InstanceID}); err != nil {
+				s.logger.Warn("Error deregistering from the registry", "error", err)
+			}
+			return registered, nil
+		case <-time.After(time.Duration(s.activeConfig().Registry.HeartbeatIntervalSeconds) * time.Second):
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package taskserver
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how often the configuration file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// activeListenerConfig returns the current settings of a listener, falling back to
+// the ones it was started with if it was removed from the file
+func (s *Server) activeListenerConfig(started ListenerConfig) ListenerConfig {
+	for _, lc := range listenerConfigs(*s.activeConfig()) {
+		if lc.name() == started.name() {
+			return lc
+		}
+	}
+	return started
+}
+
+// WatchConfig reloads the configuration file on SIGHUP and whenever it changes, until
+// the server shuts down; overrides are applied on top of the file as in LoadConfig
+func (s *Server) WatchConfig(path string, overrides map[string]string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	lastModified, lastSize := fileVersion(path)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-hangup:
+			lastModified, lastSize = fileVersion(path)
+			s.logger.Info("SIGHUP received, reloading configuration", "file", path)
+		case <-ticker.C:
+			modified, size := fileVersion(path)
+			if modified.Equal(lastModified) && size == lastSize {
+				continue
+			}
+			lastModified, lastSize = modified, size
+			s.logger.Info("Configuration file changed, reloading", "file", path)
+		}
+
+		// an invalid file is rejected and the previous configuration stays in effect
+		config, err := LoadConfig(path, overrides)
+		if err == nil {
+			err = s.Reload(config)
+		}
+		if err != nil {
+			s.logger.Error("Rejected new configuration, keeping the previous one", "file", path, "error", err)
+			continue
+		}
+		s.logger.Info("Configuration reloaded", "file", path)
+	}
+}
+
+// fileVersion returns the modification time and size used to detect changes
+func fileVersion(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
+
+// Reload applies the fields of config that can change at runtime, the other ones
+// are logged and keep their value until a restart
+func (s *Server) Reload(config Config) error {
+	ApplyDefaults(&config)
+	if err := ValidateConfig(config); err != nil {
+		return err
+	}
+
+	old := s.activeConfig()
+	for _, field := range restartRequiredChanges(*old, config) {
+		s.logger.Warn("Configuration change requires a restart to take effect", "field", field)
+	}
+	keepRestartRequired(*old, &config)
+	if err := ValidateConfig(config); err != nil {
+		return err
+	}
+
+	// applying the safe fields, everything else is read per connection or per request
+	if config.MaxConcurrentConnections != old.MaxConcurrentConnections {
+		s.semaphore.resize(config.MaxConcurrentConnections)
+		s.metrics.semaphoreCapacity.Store(int64(config.MaxConcurrentConnections))
+	}
+	if config.Logging.Level != old.Logging.Level {
+		level, _ := parseLevel(config.Logging.Level)
+		s.logLevel.Set(level)
+	}
+
+	s.rateLimiter.setConfig(config.Middleware.RateLimit)
+	s.idempotency.setConfig(config.Idempotency)
+
+	s.config.Store(&config)
+	s.state.setConfigLoaded(time.Now())
+
+	// the chain is rebuilt after the new configuration is in effect
+	if !reflect.DeepEqual(config.Middleware.Disabled, old.Middleware.Disabled) {
+		s.buildChain()
+	}
+	return nil
+}
+
+// restartRequiredFields are only read at startup, a reload keeps their running value
+var restartRequiredFields = []string{
+	"Host",
+	"Port",
+	"HTTPAddress",
+	"Admin.Address",
+	"Logging.Format",
+	"Logging.File",
+	"Audit",
+	"Tracing",
+	"Cluster.Role",
+	"Cluster.NodeID",
+	"Cluster.Address",
+	"Cluster.CoordinatorAddress",
+	"Cluster.AdvertiseAddress",
+	"Registry.Address",
+	"Registry.Service",
+	"Registry.InstanceID",
+	"Registry.AdvertiseAddress",
+	"Election",
+	"Jobs",
+	"Gossip",
+	"Cache",
+	"Mutex",
+	"Batches.Dir",
+}
+
+// configField returns the field of config named by a dotted path
+func configField(config *Config, path string) reflect.Value {
+	field := reflect.ValueOf(config).Elem()
+	for _, name := range strings.Split(path, ".") {
+		field = field.FieldByName(name)
+	}
+	return field
+}
+
+// listenerAddresses returns the listeners without their auth settings, the only ones
+// that can change at runtime
+func listenerAddresses(config Config) []ListenerConfig {
+	var addresses []ListenerConfig
+	for _, lc := range config.Listeners {
+		addresses = append(addresses, ListenerConfig{
+			Network:     lc.Network,
+			Address:     lc.Address,
+			SocketMode:  lc.SocketMode,
+			TLSCertFile: lc.TLSCertFile,
+			TLSKeyFile:  lc.TLSKeyFile,
+		})
+	}
+	return addresses
+}
+
+// restartRequiredChanges lists the changed fields that are only read at startup
+func restartRequiredChanges(old, new Config) []string {
+	var changed []string
+	for _, path := range restartRequiredFields {
+		if !reflect.DeepEqual(configField(&old, path).Interface(), configField(&new, path).Interface()) {
+			changed = append(changed, path)
+		}
+	}
+	if !reflect.DeepEqual(listenerAddresses(old), listenerAddresses(new)) {
+		changed = append(changed, "Listeners")
+	}
+	return changed
+}
+
+// keepRestartRequired copies the fields only read at startup from old to config, so a
+// reload does not run with part of the new values; the listeners that are running
+// keep their addresses and take the auth settings of the listener with the same name
+func keepRestartRequired(old Config, config *Config) {
+	for _, path := range restartRequiredFields {
+		configField(config, path).Set(configField(&old, path))
+	}
+	listeners := slices.Clone(old.Listeners)
+	for i, running := range listeners {
+		for _, lc := range config.Listeners {
+			if lc.name() == running.name() {
+				listeners[i].RequireAuth, listeners[i].AuthTokens = lc.RequireAuth, lc.AuthTokens
+			}
+		}
+	}
+	config.Listeners = listeners
+}
@@ -0,0 +1,193 @@
+package taskserver
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotation settings, zero values disable the corresponding rotation
+type rotateOptions struct {
+	MaxSize    int64         // rotate when the file would grow past this many bytes
+	MaxAge     time.Duration // rotate when the file has been open for this long
+	MaxBackups int           // rotated files to keep
+	Compress   bool          // gzip rotated files
+}
+
+// rotatingWriter is an append-only file that is rotated by size or age,
+// keeping at most MaxBackups old files named <path>.<timestamp>[.gz]
+type rotatingWriter struct {
+	mu      sync.Mutex
+	path    string
+	options rotateOptions
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// newRotatingWriter opens (or creates) the file at path for appending
+func newRotatingWriter(path string, options rotateOptions) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, options: options}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	if dir := filepath.Dir(w.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	w.openedAt = time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating first if p would not fit
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := w.options.MaxSize > 0 && w.size+int64(len(p)) > w.options.MaxSize
+	tooOld := w.options.MaxAge > 0 && time.Since(w.openedAt) > w.options.MaxAge
+	if w.size > 0 && (tooBig || tooOld) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and starts a new one, the caller holds the lock
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	backup := fmt.Sprintf("%s.%s", w.path, time.Now().Format("20060102-150405.000000"))
+	if err := os.Rename(w.path, backup); err != nil {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	// compressing in the background so writers are not blocked
+	if w.options.Compress {
+		go func() {
+			if err := compressFile(backup); err != nil {
+				slog.Warn("Error compressing rotated file", "file", backup, "error", err)
+			}
+			w.mu.Lock()
+			w.removeOldBackups()
+			w.mu.Unlock()
+		}()
+	} else {
+		w.removeOldBackups()
+	}
+	return nil
+}
+
+// compressFile replaces path with path.gz
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(target)
+	if _, err := io.Copy(gz, source); err != nil {
+		target.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		target.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := target.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeOldBackups deletes the oldest rotated files above maxBackups
+func (w *rotatingWriter) removeOldBackups() {
+	if w.options.MaxBackups <= 0 {
+		return
+	}
+	backups := rotatedFiles(w.path)
+	for len(backups) > w.options.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// Close closes the underlying file
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotatedFiles lists the rotated files of path, oldest first
+func rotatedFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	backups := make([]string, 0, len(matches))
+	for _, match := range matches {
+		// a file still being compressed appears twice, only the .gz is listed
+		if !strings.HasSuffix(match, ".gz") && contains(matches, match+".gz") {
+			continue
+		}
+		backups = append(backups, match)
+	}
+	// the timestamp suffix sorts chronologically
+	sort.Strings(backups)
+	return backups
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
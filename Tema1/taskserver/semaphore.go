@@ -0,0 +1,56 @@
+package taskserver
+
+import "sync"
+
+// connectionSemaphore limits the number of concurrent connections,
+// unlike a buffered channel its capacity can change while the server runs
+type connectionSemaphore struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	capacity int
+	inUse    int
+}
+
+func newConnectionSemaphore(capacity int) *connectionSemaphore {
+	s := &connectionSemaphore{capacity: capacity}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// tryAcquire takes a slot if one is free
+func (s *connectionSemaphore) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inUse >= s.capacity {
+		return false
+	}
+	s.inUse++
+	return true
+}
+
+// acquire waits for a free slot and takes it
+func (s *connectionSemaphore) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.inUse >= s.capacity {
+		s.cond.Wait()
+	}
+	s.inUse++
+}
+
+// release gives a slot back
+func (s *connectionSemaphore) release() {
+	s.mu.Lock()
+	s.inUse--
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// resize changes the capacity, connections above a lowered capacity are not closed
+// but no new ones are accepted until enough of them finish
+func (s *connectionSemaphore) resize(capacity int) {
+	s.mu.Lock()
+	s.capacity = capacity
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
@@ -0,0 +1,913 @@
+// Package taskserver implements the Tema1 task server: clients connect over TCP
+// (or a unix socket), receive a welcome line and then exchange newline separated
+// JSON requests and responses.
+//
+// A server is created with New, started with ListenAndServe (or Serve for a
+// listener created by the caller) and stopped with Shutdown.
+package taskserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/election"
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/gossip"
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/mutex"
+	"github.com/alex6damian/Sisteme-Distribuite/Lab5/Tema1/raft"
+)
+
+// request and response structures
+type GenericRequest struct {
+	TaskNumber int             `json:"task"`
+	Input      json.RawMessage `json:"input"`
+	ClientID   int             `json:"client_id"`
+	Op         string          `json:"op,omitempty"`         // empty for task requests, the others are handled in handleConnection
+	AuthToken  string          `json:"auth_token,omitempty"` // used by the "auth" operation
+	TraceID    string          `json:"trace_id,omitempty"`   // trace context propagated by the caller
+	SpanID     string          `json:"span_id,omitempty"`    // span of the caller, parent of the server span
+
+	// retries with the same key get the response of the first attempt
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	RequestID string `json:"request_id,omitempty"` // chosen by the client, echoed in the response
+	SessionID string `json:"session_id,omitempty"` // session to resume, used by the "hello" operation
+
+	// idempotency scope of the client a coordinator or proxy forwards the request for
+	ForwardedScope string `json:"forwarded_scope,omitempty"`
+
+	Channel *channelTag `json:"channel,omitempty"` // set on the requests a coordinator forwards
+}
+
+type GenericResponse struct {
+	Status  string          `json:"status"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Code    string          `json:"code,omitempty"` // machine readable error code
+	TraceID string          `json:"trace_id,omitempty"`
+
+	RequestID string `json:"request_id,omitempty"`
+
+	Channel *channelTag `json:"channel,omitempty"` // set on the responses to forwarded requests
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown
+var ErrServerClosed = errors.New("taskserver: server closed")
+
+// Server is a task server, it must be created with New
+type Server struct {
+	config    atomic.Pointer[Config] // replaced on every reload
+	logger    *slog.Logger
+	logLevel  *slog.LevelVar
+	logCloser io.Closer
+
+	tasksMu   sync.RWMutex
+	tasks     map[int]TaskHandler
+	exclusive map[int]bool // tasks run under their distributed lock
+
+	chainMu     sync.RWMutex
+	middlewares []namedMiddleware
+	chain       Handler // middlewares around handleTask, rebuilt when they change
+	rateLimiter *rateLimiter
+	idempotency *idempotencyStore
+	sessions    *sessionStore
+	coordinator *coordinator // workers of a coordinator, nil on other nodes
+
+	election        *election.Node // nil without leader election
+	leaderCallbacks []func(LeaderChange)
+
+	membership          *gossip.Node // nil without gossip membership
+	membershipCallbacks []func(gossip.Event)
+
+	cache *resultCache // nil without the result cache
+
+	batches *batchStore // nil without atomic batches
+
+	snapshots *snapshotter // nil on a standalone server
+
+	mutex        *mutex.Node // nil without distributed locks
+	localLocksMu sync.Mutex
+	localLocks   map[string]chan struct{} // locks of a server without distributed locks
+
+	jobs   *jobQueue  // replicated by jobLog, empty without it
+	jobLog *raft.Node // nil without the replicated job queue
+
+	semaphore   *connectionSemaphore
+	metrics     *serverMetrics
+	connections *connectionRegistry
+	state       *serverState
+	gate        *acceptGate
+	audit       *auditLog
+	tracer      *tracer
+
+	// connection ids are unique for the lifetime of the server
+	lastConnectionID atomic.Uint64
+
+	mu        sync.Mutex
+	listeners []net.Listener // listeners being served
+	closers   []io.Closer    // HTTP and admin listeners
+	done      chan struct{}  // closed by Shutdown
+	left      chan struct{}  // closed after deregistering from the registry
+	closed    bool
+}
+
+// Option customizes a server created by New
+type Option func(*Server)
+
+// WithLogger makes the server log to logger instead of creating one from Config.Logging
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithTask registers a task, replacing the built-in one with the same number
+func WithTask(taskNumber int, handler TaskHandler) Option {
+	return func(s *Server) {
+		s.tasks[taskNumber] = handler
+	}
+}
+
+// New creates a server from the configuration, missing fields get their defaults
+func New(config Config, options ...Option) (*Server, error) {
+	ApplyDefaults(&config)
+	if err := ValidateConfig(config); err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		logLevel:    new(slog.LevelVar),
+		tasks:       defaultTasks(),
+		exclusive:   make(map[int]bool),
+		localLocks:  make(map[string]chan struct{}),
+		semaphore:   newConnectionSemaphore(config.MaxConcurrentConnections),
+		metrics:     newServerMetrics(),
+		connections: &connectionRegistry{conns: make(map[string]*connectionInfo)},
+		state:       &serverState{startedAt: time.Now()},
+		gate:        &acceptGate{},
+		sessions:    newSessionStore(),
+		jobs:        newJobQueue(),
+		done:        make(chan struct{}),
+	}
+	s.config.Store(&config)
+	s.state.setConfigLoaded(time.Now())
+	s.metrics.semaphoreCapacity.Store(int64(config.MaxConcurrentConnections))
+	s.rateLimiter = newRateLimiter(config.Middleware.RateLimit)
+	s.idempotency = newIdempotencyStore(config.Idempotency, func() { s.metrics.idempotentReplays.Add(1) })
+	for _, task := range config.Mutex.ExclusiveTasks {
+		s.exclusive[task] = true
+	}
+	s.cache = newResultCache(config.Cache, config.Gossip.Name)
+	s.middlewares = s.builtinMiddlewares()
+	if config.Cluster.Role == RoleCoordinator {
+		s.coordinator = newCoordinator()
+	}
+	if config.Cluster.Role != RoleStandalone {
+		s.snapshots = newSnapshotter()
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.buildChain()
+
+	// setting up structured logging before anything else is logged
+	if s.logger == nil {
+		logger, closer, err := NewLogger(config.Logging, s.logLevel)
+		if err != nil {
+			return nil, err
+		}
+		s.logger, s.logCloser = logger, closer
+	} else {
+		level, _ := parseLevel(config.Logging.Level)
+		s.logLevel.Set(level)
+	}
+
+	// opening the audit log
+	var err error
+	s.audit, err = openAuditLog(config.Audit, s.logger)
+	if err != nil {
+		s.closeResources()
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+
+	// starting the span exporter
+	s.tracer, err = newTracer(config.Tracing, s.logger)
+	if err != nil {
+		s.closeResources()
+		return nil, fmt.Errorf("starting tracing: %w", err)
+	}
+
+	// joining the leader election, started by ListenAndServe
+	s.election, err = s.newElection(config.Election)
+	if err != nil {
+		s.closeResources()
+		return nil, fmt.Errorf("configuring leader election: %w", err)
+	}
+
+	// restoring the batches decided or prepared before a restart
+	s.batches, err = openBatchStore(config)
+	if err != nil {
+		s.closeResources()
+		return nil, fmt.Errorf("opening the batch log: %w", err)
+	}
+
+	// joining the distributed locks, started by ListenAndServe
+	s.mutex, err = s.newMutex(config.Mutex)
+	if err != nil {
+		s.closeResources()
+		return nil, fmt.Errorf("configuring distributed locks: %w", err)
+	}
+
+	// joining the gossip membership, started by ListenAndServe
+	s.membership, err = s.newMembership(config)
+	if err != nil {
+		s.closeResources()
+		return nil, fmt.Errorf("configuring gossip membership: %w", err)
+	}
+	if s.cache != nil && s.membership != nil {
+		s.membershipCallbacks = append(s.membershipCallbacks, s.cacheMembershipChanged)
+	}
+
+	// restoring the job queue from its log, replication starts with ListenAndServe
+	s.jobLog, err = s.newJobLog(config.Jobs)
+	if err != nil {
+		s.closeResources()
+		return nil, fmt.Errorf("configuring the job queue: %w", err)
+	}
+	go s.expireSessions()
+	return s, nil
+}
+
+// Config returns the configuration currently in effect
+func (s *Server) Config() Config {
+	return *s.activeConfig()
+}
+
+// Logger returns the logger used by the server
+func (s *Server) Logger() *slog.Logger {
+	return s.logger
+}
+
+// activeConfig returns the configuration currently in effect
+func (s *Server) activeConfig() *Config {
+	return s.config.Load()
+}
+
+// ListenAndServe opens every configured listener, the HTTP server and the admin
+// interface, and serves until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	config := s.activeConfig()
+
+	// exposing metrics over HTTP
+	if err := s.startHTTPServer(config.HTTPAddress); err != nil {
+		return fmt.Errorf("starting HTTP server: %w", err)
+	}
+
+	// starting the admin interface
+	if err := s.startAdminServer(config.Admin); err != nil {
+		return fmt.Errorf("starting admin interface: %w", err)
+	}
+
+	if s.election != nil {
+		if err := s.election.Start(); err != nil {
+			return fmt.Errorf("starting leader election: %w", err)
+		}
+	}
+	if s.mutex != nil {
+		if err := s.mutex.Start(); err != nil {
+			return fmt.Errorf("starting distributed locks: %w", err)
+		}
+	}
+	if s.membership != nil {
+		if err := s.membership.Start(); err != nil {
+			return fmt.Errorf("starting gossip membership: %w", err)
+		}
+	}
+	if s.cache != nil {
+		if err := s.startCacheListener(config.Cache.Address); err != nil {
+			return fmt.Errorf("starting result cache: %w", err)
+		}
+		if s.membership != nil {
+			go s.runCacheRebalance()
+		}
+	}
+	if s.jobLog != nil {
+		if err := s.jobLog.Start(); err != nil {
+			return fmt.Errorf("starting the job queue: %w", err)
+		}
+		go s.runJobs()
+	}
+
+	// joining the cluster, a coordinator accepts workers before accepting clients
+	switch config.Cluster.Role {
+	case RoleCoordinator:
+		if err := s.startClusterListener(config.Cluster.Address); err != nil {
+			return fmt.Errorf("starting cluster listener: %w", err)
+		}
+		if s.batches != nil {
+			go s.runBatchDelivery()
+		}
+	case RoleWorker:
+		go s.joinCluster()
+		if s.batches != nil {
+			go s.runBatchRecovery()
+		}
+	}
+	if config.Registry.Address != "" {
+		left := make(chan struct{})
+		s.mu.Lock()
+		s.left = left
+		s.mu.Unlock()
+		go func() {
+			defer close(left)
+			s.registerWithRegistry()
+		}()
+	}
+
+	// opening every listener before accepting, so a bad address fails the startup
+	configs := listenerConfigs(*config)
+	listeners := make([]net.Listener, 0, len(configs))
+	for _, lc := range configs {
+		listener, err := openListener(lc)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return fmt.Errorf("starting listener %s: %w", lc.name(), err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	// accepting connections on all listeners, sharing the same semaphore
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		go func(listener net.Listener, lc ListenerConfig) {
+			errs <- s.ServeListener(listener, lc)
+		}(listener, configs[i])
+	}
+
+	// every loop returns ErrServerClosed after a shutdown, anything else is reported first
+	var result error
+	for range listeners {
+		if err := <-errs; result == nil || errors.Is(result, ErrServerClosed) {
+			result = err
+		}
+	}
+	return result
+}
+
+// Serve accepts connections on a listener created by the caller, without authentication
+func (s *Server) Serve(listener net.Listener) error {
+	return s.ServeListener(listener, ListenerConfig{
+		Network: listener.Addr().Network(),
+		Address: listener.Addr().String(),
+	})
+}
+
+// ServeListener accepts connections on listener with the settings of lc until the server shuts down
+func (s *Server) ServeListener(listener net.Listener, lc ListenerConfig) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+
+	s.state.setListener(lc.name(), true, nil)
+	s.logger.Info("Server listening", "listener", lc.name())
+	err := s.serveListener(listener, lc)
+	s.state.setListener(lc.name(), false, err)
+	if s.state.draining.Load() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for the open ones to finish their
+// requests; when ctx expires the remaining connections are closed
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	listeners := s.listeners
+	closers := s.closers
+	left := s.left
+	s.mu.Unlock()
+
+	s.logger.Info("Shutting down, draining connections")
+
+	// readiness turns false before the listeners are closed
+	s.state.draining.Store(true)
+	close(s.done)
+	// leaving the election right away lets another replica take over while this one drains
+	if s.election != nil {
+		s.election.Stop()
+	}
+	if s.jobLog != nil {
+		s.jobLog.Stop()
+	}
+	// the others learn right away that the server left instead of suspecting it
+	if s.membership != nil {
+		s.membership.Leave()
+	}
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	// paused accept loops have to run to notice their listener is closed
+	s.gate.open()
+
+	// idle connections are woken up, busy ones close after their current response
+	s.connections.interruptIdle()
+	var err error
+	if !s.connections.waitContext(ctx) {
+		s.logger.Warn("Shutdown timeout expired, closing remaining connections")
+		s.connections.closeAll()
+		s.connections.wait(time.Second)
+		err = ctx.Err()
+	}
+	// the locks are left once no task can hold them anymore, the other servers see
+	// the refused connections and stop waiting for this one
+	if s.mutex != nil {
+		s.mutex.Stop()
+	}
+
+	// the registry hears the server is leaving before the process exits
+	if left != nil {
+		select {
+		case <-left:
+		case <-ctx.Done():
+		}
+	}
+
+	for _, closer := range closers {
+		closer.Close()
+	}
+	s.logger.Info("Server stopped")
+	s.closeResources()
+	return err
+}
+
+// closeResources closes the files opened by New
+func (s *Server) closeResources() {
+	s.tracer.Close()
+	s.audit.Close()
+	if s.batches != nil {
+		s.batches.log.Close()
+	}
+	if s.logCloser != nil {
+		s.logCloser.Close()
+	}
+}
+
+// addCloser registers a listener closed by Shutdown
+func (s *Server) addCloser(closer io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closers = append(s.closers, closer)
+}
+
+// isTimeout reports whether err is a deadline expiring
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// peerClosed reports whether the other side closed the connection, waiting at most 1ms for data
+func peerClosed(conn net.Conn, reader *bufio.Reader) bool {
+	// an expired deadline fails before reading, a short one lets the read report EOF
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := reader.Peek(1)
+	return err != nil && !isTimeout(err)
+}
+
+// watchClose watches for the client closing the connection while a task runs, without
+// consuming a request it may send meanwhile; the returned function stops the watch and
+// reports whether the client closed it
+func watchClose(conn net.Conn, reader *bufio.Reader) func() bool {
+	closed := make(chan bool, 1)
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		_, err := reader.Peek(1)
+		closed <- err != nil && !isTimeout(err)
+	}()
+	return func() bool {
+		// an expired deadline wakes the waiting read
+		conn.SetReadDeadline(time.Now())
+		return <-closed
+	}
+}
+
+// sendResponse encodes and writes a response to the client
+func sendResponse(conn net.Conn, response GenericResponse, timeout time.Duration) error {
+	responseJson, _ := json.Marshal(response)
+
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := conn.Write(append(responseJson, '\n'))
+	return err
+}
+
+// writeResponse sends a response on a client connection, a client that does not read
+// it within the timeout is disconnected
+func (s *Server) writeResponse(conn net.Conn, logger *slog.Logger, response GenericResponse, timeout time.Duration) error {
+	err := sendResponse(conn, response, timeout)
+	if isTimeout(err) {
+		logger.Warn("Closing slow connection, responses are not read", "reason", slowWriteTimeout)
+		s.metrics.observeSlowClose(slowWriteTimeout)
+		conn.Close()
+	}
+	return err
+}
+
+// sendErrorResponse sends an error response to the client
+func (s *Server) sendErrorResponse(conn net.Conn, logger *slog.Logger, code string, errorMsg string, timeout time.Duration) {
+	s.metrics.observeError(code)
+	response := GenericResponse{Status: "error", Error: errorMsg, Code: code}
+	if err := s.writeResponse(conn, logger, response, timeout); err != nil && !isTimeout(err) {
+		logger.Warn("Error while sending error response", "error", err)
+	}
+}
+
+// handleConnection processes each client connection
+func (s *Server) handleConnection(connection net.Conn, listenerConfig ListenerConfig) {
+	connID := fmt.Sprintf("c%d", s.lastConnectionID.Add(1))
+	connLogger := s.logger.With("conn_id", connID, "remote", connection.RemoteAddr().String(), "listener", listenerConfig.name())
+	logger := connLogger
+
+	s.metrics.connectionsTotal.Add(1)
+	s.metrics.activeConnections.Add(1)
+	defer func() {
+		connection.Close()
+		s.metrics.releaseSlot(s.semaphore) // releasing the semaphore slot
+		s.metrics.activeConnections.Add(-1)
+		logger.Info("Connection closed")
+	}()
+	setKeepAlive(connection, s.activeConfig().TCPKeepAliveSeconds)
+	setWriteBuffer(connection, s.activeConfig().SlowClients.WriteBufferBytes)
+	connection = frameConn{Conn: countingConn{Conn: connection, metrics: s.metrics}, mu: new(sync.Mutex)}
+	logger.Info("New connection")
+
+	// registering the connection so a shutdown can reach it
+	info := &connectionInfo{id: connID, conn: connection, listener: listenerConfig.name(), connectedAt: time.Now()}
+	info.lastActivity.Store(info.connectedAt.UnixNano())
+	s.connections.add(info)
+	defer s.connections.remove(connID)
+
+	// setting timeout duration, it is refreshed for every request in case the configuration is reloaded
+	config := s.activeConfig()
+	timeoutDuration := time.Duration(config.ConnectionIdleTimeoutSeconds) * time.Second
+	writeTimeout := config.SlowClients.writeTimeout()
+
+	// stops the heartbeat goroutine, started when the client sends its first ping
+	stopHeartbeats := make(chan struct{})
+	defer close(stopHeartbeats)
+
+	// sending the welcome message
+	connection.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := connection.Write([]byte(config.WelcomeMessage + "\n"))
+	if err != nil {
+		logger.Warn("Error while sending welcome message", "error", err)
+		return
+	}
+
+	reader := bufio.NewReader(connection)
+
+	// set by the "auth" operation to the idempotency scope of the accepted token; connections
+	// on listeners without auth are trusted, which is checked on every request so a reload
+	// that turns RequireAuth on or off applies to them
+	var tokenScope string
+
+	// set by the "hello" operation, the session keeps the responses this connection could not deliver
+	var sessionID string
+	var sessionClientID int
+	defer func() {
+		if sessionID != "" {
+			s.sessions.detach(sessionID, connID)
+		}
+	}()
+
+	// main loop to handle multiple requests per connection
+	for requestNumber := 1; ; requestNumber++ {
+		// setting read deadline
+		info.busy.Store(false)
+		config = s.activeConfig()
+		timeoutDuration = time.Duration(config.ConnectionIdleTimeoutSeconds) * time.Second
+		writeTimeout = config.SlowClients.writeTimeout()
+		readTimeout := timeoutDuration
+		if info.heartbeats.Load() {
+			// a client answering pings is not idle, it is dead after missing enough of them
+			readTimeout = config.Heartbeat.deadline()
+		}
+		connection.SetReadDeadline(time.Now().Add(readTimeout))
+
+		// a draining server does not wait for more requests
+		if s.state.draining.Load() {
+			logger.Info("Closing connection, server is shutting down")
+			break
+		}
+
+		// reading the request
+		requestLine, err := readRequest(connection, reader, config.SlowClients, config.MaxMessageSize)
+		if err != nil {
+			if reason := slowCloseReason(err); reason != "" {
+				logger.Warn("Closing slow connection", "reason", reason, "error", err)
+				s.metrics.observeSlowClose(reason)
+				if reason == tooLarge {
+					s.sendErrorResponse(connection, logger, errMessageTooLarge, "Request larger than MaxMessageSize", writeTimeout)
+				}
+			} else if s.state.draining.Load() {
+				logger.Info("Closing connection, server is shutting down")
+			} else if info.kicked.Load() {
+				logger.Info("Connection closed by admin")
+			} else if isTimeout(err) && info.heartbeats.Load() {
+				logger.Warn("Closing dead connection, pings were not answered")
+				s.metrics.deadConnections.Add(1)
+			} else if err != io.EOF {
+				logger.Warn("Error reading request", "error", err)
+			}
+			break
+		}
+		info.busy.Store(true)
+
+		received := time.Now()
+		info.requests.Add(1)
+		info.lastActivity.Store(received.UnixNano())
+
+		// every line logged for this request carries its id
+		requestID := fmt.Sprintf("%s-r%d", connID, requestNumber)
+		requestLogger := logger.With("request_id", requestID)
+		if config.Logging.Payloads {
+			requestLogger.Debug("Received request", payload(config.Logging, "payload", requestLine))
+		}
+
+		// decoding the request
+		var req GenericRequest
+		if err := json.Unmarshal(requestLine, &req); err != nil {
+			requestLogger.Warn("Error decoding JSON", "error", err)
+			s.sendErrorResponse(connection, requestLogger, errInvalidJSON, "Invalid JSON", writeTimeout)
+			continue
+		}
+		decoded := time.Now()
+		authenticated := tokenScope != "" || !s.activeListenerConfig(listenerConfig).RequireAuth
+
+		// a request forwarded by the coordinator is a message of the channel between them,
+		// accounted for once the connection is authenticated
+		var channelTask uint64
+
+		// handling connection-level operations
+		switch req.Op {
+		case "":
+		case "auth":
+			if !s.activeListenerConfig(listenerConfig).checkToken(req.AuthToken) {
+				requestLogger.Warn("Rejected auth token")
+				s.sendErrorResponse(connection, requestLogger, errInvalidToken, "Invalid auth token", writeTimeout)
+				continue
+			}
+			tokenScope = secretScope("token", req.AuthToken)
+			requestLogger.Info("Connection authenticated")
+			if err := s.writeResponse(connection, requestLogger, GenericResponse{Status: "success"}, writeTimeout); err != nil {
+				requestLogger.Warn("Error while sending response", "error", err)
+				return
+			}
+			continue
+		case "ping":
+			// the client supports heartbeats, the server starts pinging it
+			if !info.heartbeats.Swap(true) {
+				go s.sendHeartbeats(connection, info, stopHeartbeats)
+			}
+			if err := s.writeResponse(connection, requestLogger, pongFrame, writeTimeout); err != nil {
+				requestLogger.Warn("Error while sending response", "error", err)
+				return
+			}
+			continue
+		case "pong":
+			// answer to a server ping, receiving it already refreshed the deadline
+			continue
+		case "hello":
+			if !authenticated {
+				s.sendErrorResponse(connection, requestLogger, errAuthRequired, "Authentication required", writeTimeout)
+				continue
+			}
+			if sessionID != "" && sessionID != req.SessionID {
+				s.sessions.detach(sessionID, connID)
+			}
+			hello := s.sessions.hello(req.SessionID, connID, func() {
+				info.kicked.Store(true)
+				connection.Close()
+			})
+			sessionID, sessionClientID = hello.SessionID, hello.ClientID
+			logger = connLogger.With("session_id", sessionID)
+			requestLogger.Info("Session started", "session_id", sessionID, "client_id", sessionClientID, "resumed", hello.Resumed, "pending", len(hello.Pending))
+			result, _ := json.Marshal(hello)
+			if err := s.writeResponse(connection, requestLogger, GenericResponse{Status: "success", Result: result, RequestID: req.RequestID}, writeTimeout); err != nil {
+				requestLogger.Warn("Error while sending response", "error", err)
+				return
+			}
+			continue
+		case "submit_batch", "batch_status", "prepare_batch", "commit_batch", "abort_batch":
+			if !authenticated {
+				s.sendErrorResponse(connection, requestLogger, errAuthRequired, "Authentication required", writeTimeout)
+				continue
+			}
+			if sessionID == "" {
+				channelTask = s.receiveRequest(req, requestLine)
+			}
+			response := s.handleBatchRequest(req)
+			if response.Status == "error" {
+				s.metrics.observeError(response.Code)
+			}
+			if err := s.writeChannelResponse(connection, requestLogger, req, channelTask, response, writeTimeout); err != nil {
+				requestLogger.Warn("Error while sending response", "error", err)
+				return
+			}
+			continue
+		case "submit_job", "job_status":
+			if !authenticated {
+				s.sendErrorResponse(connection, requestLogger, errAuthRequired, "Authentication required", writeTimeout)
+				continue
+			}
+			if sessionID != "" {
+				req.ClientID = sessionClientID
+			}
+			response := s.handleJobRequest(req)
+			if response.Status == "error" {
+				s.metrics.observeError(response.Code)
+			}
+			if err := s.writeResponse(connection, requestLogger, response, writeTimeout); err != nil {
+				requestLogger.Warn("Error while sending response", "error", err)
+				return
+			}
+			continue
+		case "snapshot_marker":
+			if !authenticated {
+				s.sendErrorResponse(connection, requestLogger, errAuthRequired, "Authentication required", writeTimeout)
+				continue
+			}
+			response := s.handleMarkerRequest(req)
+			if response.Status == "error" {
+				s.metrics.observeError(response.Code)
+			}
+			if err := s.writeResponse(connection, requestLogger, response, writeTimeout); err != nil {
+				requestLogger.Warn("Error while sending response", "error", err)
+				return
+			}
+			continue
+		case "health":
+			report, _ := json.Marshal(s.healthReport())
+			if err := s.writeResponse(connection, requestLogger, GenericResponse{Status: "success", Result: report}, writeTimeout); err != nil {
+				requestLogger.Warn("Error while sending response", "error", err)
+				return
+			}
+			continue
+		default:
+			requestLogger.Warn("Unknown operation", "op", req.Op)
+			s.sendErrorResponse(connection, requestLogger, errUnknownOp, "Unknown operation", writeTimeout)
+			continue
+		}
+
+		if !authenticated {
+			s.sendErrorResponse(connection, requestLogger, errAuthRequired, "Authentication required", writeTimeout)
+			continue
+		}
+
+		// the identity assigned by the server replaces the one sent by the client
+		if sessionID != "" {
+			req.ClientID = sessionClientID
+		} else {
+			channelTask = s.receiveRequest(req, requestLine)
+		}
+		requestLogger = requestLogger.With("task", req.TaskNumber, "client_id", req.ClientID)
+		info.clientID.Store(int64(req.ClientID))
+
+		// tracing the request if the client sent a trace context
+		start := time.Now()
+		requestSpan := s.tracer.startRequest(req, received)
+		if requestSpan != nil {
+			requestSpan.setAttribute("request_id", requestID)
+			requestSpan.setAttribute("task", req.TaskNumber)
+			requestSpan.setAttribute("client_id", req.ClientID)
+			requestLogger = requestLogger.With("trace_id", requestSpan.traceID)
+
+			decodeSpan := requestSpan.child("decode", received)
+			decodeSpan.end = decoded
+			decodeSpan.finish(s.tracer)
+			queueSpan := requestSpan.child("queue", decoded)
+			queueSpan.end = start
+			queueSpan.finish(s.tracer)
+		}
+
+		// retries are recognized within the scope of the client: its session, its auth token
+		// or the connection; a coordinator or proxy adds the scope of the client it forwards for
+		scope := "conn/" + connID
+		if sessionID != "" {
+			scope = secretScope("session", sessionID)
+		} else if tokenScope != "" {
+			scope = tokenScope
+		}
+		if req.ForwardedScope != "" {
+			scope += "/" + req.ForwardedScope
+		}
+
+		// handling the task through the middlewares
+		taskRequest := &Request{
+			GenericRequest: req,
+			ID:             requestID,
+			Conn:           ConnInfo{ID: connID, Remote: info.conn.RemoteAddr().String(), Listener: info.listener, ConnectedAt: info.connectedAt},
+			Scope:          scope,
+			Logger:         requestLogger,
+		}
+		// the execute span is the parent of the spans of a worker the task is forwarded to
+		var executeSpan *span
+		if requestSpan != nil {
+			executeSpan = requestSpan.child(fmt.Sprintf("execute task %d", req.TaskNumber), start)
+			taskRequest.TraceID, taskRequest.SpanID = executeSpan.traceID, executeSpan.spanID
+		}
+		// a session client that disconnects during the task gets the response when it resumes
+		var clientClosed func() bool
+		if sessionID != "" {
+			clientClosed = watchClose(connection, reader)
+		}
+		results, err := s.execute(taskRequest)
+		duration := time.Since(start)
+		s.metrics.observeRequest(s.taskLabel(req.TaskNumber), duration)
+		if executeSpan != nil {
+			executeSpan.end = start.Add(duration)
+			if err != nil {
+				executeSpan.err = err.Error()
+			}
+			executeSpan.finish(s.tracer)
+		}
+
+		// recording the execution in the audit log
+		record := auditRecord{
+			Time:        start,
+			ConnID:      connID,
+			RequestID:   requestID,
+			Remote:      connection.RemoteAddr().String(),
+			ClientID:    req.ClientID,
+			Task:        req.TaskNumber,
+			InputSHA256: hashInput(req.Input),
+			DurationMs:  float64(duration.Microseconds()) / 1000,
+			Status:      "success",
+			Replayed:    taskRequest.Replayed,
+		}
+		// building the response
+		response := GenericResponse{
+			Status: "success",
+			Result: results,
+		}
+		if err != nil {
+			code, message := errorResponse(err)
+			record.Status, record.ErrorCode = "error", code
+			s.metrics.observeError(code)
+			response = GenericResponse{Status: "error", Error: message, Code: code}
+		}
+		s.audit.record(record)
+		if requestSpan != nil {
+			response.TraceID = requestSpan.traceID
+		}
+		response.RequestID = req.RequestID
+
+		if clientClosed != nil && clientClosed() {
+			requestLogger.Info("Client disconnected, keeping the response for the session")
+			s.sessions.addPending(sessionID, response, config.Sessions.MaxPending)
+			if requestSpan != nil {
+				requestSpan.err = response.Error
+				requestSpan.finish(s.tracer)
+			}
+			break
+		}
+
+		// setting write deadline and sending response
+		encodeStart := time.Now()
+		err = s.writeChannelResponse(connection, requestLogger, req, channelTask, response, writeTimeout)
+		if err != nil && sessionID != "" {
+			s.sessions.addPending(sessionID, response, config.Sessions.MaxPending)
+		}
+		if requestSpan != nil {
+			encodeSpan := requestSpan.child("encode", encodeStart)
+			if err != nil {
+				encodeSpan.err = err.Error()
+			}
+			encodeSpan.finish(s.tracer)
+			requestSpan.err = response.Error
+			requestSpan.finish(s.tracer)
+		}
+		if err != nil {
+			requestLogger.Warn("Error while sending response", "error", err)
+			break
+		}
+	}
+}
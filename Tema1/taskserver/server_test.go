@@ -0,0 +1,105 @@
+package taskserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer serves a new server on an ephemeral port whose listener requires token
+func startServer(t *testing.T, token string) string {
+	t.Helper()
+	server, err := New(Config{Host: "127.0.0.1", Port: "0"}, WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := ListenerConfig{Network: "tcp", Address: listener.Addr().String(), RequireAuth: true, AuthTokens: []string{token}}
+	served := make(chan error, 1)
+	go func() { served <- server.ServeListener(listener, lc) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ServeListener returned %v, expected ErrServerClosed", err)
+		}
+	})
+	return listener.Addr().String()
+}
+
+// client sends requests on one connection, past the welcome message
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t *testing.T, address string) *client {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &client{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	if _, err := c.reader.ReadString('\n'); err != nil {
+		t.Fatalf("reading the welcome message: %v", err)
+	}
+	return c
+}
+
+func (c *client) call(req GenericRequest) GenericResponse {
+	c.t.Helper()
+	encoded, _ := json.Marshal(req)
+	if _, err := c.conn.Write(append(encoded, '\n')); err != nil {
+		c.t.Fatal(err)
+	}
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var response GenericResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		c.t.Fatalf("decoding %q: %v", line, err)
+	}
+	return response
+}
+
+func TestServeOnEphemeralPort(t *testing.T) {
+	c := dial(t, startServer(t, "secret"))
+	task := GenericRequest{TaskNumber: 2, Input: json.RawMessage(`["abd4g5", "1sdf6fd", "fd2fdsf5"]`)}
+
+	if response := c.call(task); response.Code != errAuthRequired {
+		t.Errorf("task before auth got %+v, expected %s", response, errAuthRequired)
+	}
+	if response := c.call(GenericRequest{Op: "auth", AuthToken: "wrong"}); response.Code != errInvalidToken {
+		t.Errorf("wrong token got %+v, expected %s", response, errInvalidToken)
+	}
+	if response := c.call(GenericRequest{Op: "auth", AuthToken: "secret"}); response.Status != "success" {
+		t.Fatalf("auth got %+v", response)
+	}
+
+	response := c.call(task)
+	if response.Status != "success" || string(response.Result) != "2" {
+		t.Errorf("task 2 got %+v, expected the result 2", response)
+	}
+
+	response = c.call(GenericRequest{Op: "health"})
+	var health map[string]any
+	if response.Status != "success" || json.Unmarshal(response.Result, &health) != nil {
+		t.Errorf("health got %+v", response)
+	}
+}
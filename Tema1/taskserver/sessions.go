@@ -0,0 +1,140 @@
+package taskserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// session configuration
+//
+// A client sends {"op":"hello"} to get a session id and a client id assigned by the
+// server, the client id of its later requests is replaced by the assigned one. After
+// reconnecting it sends {"op":"hello","session_id":...} to resume the session and
+// receives the responses that could not be delivered on the previous connection.
+type SessionConfig struct {
+	TTLSeconds int `json:"TTLSeconds"` // how long a session survives without a connection
+	MaxPending int `json:"MaxPending"` // undelivered responses kept per session, the oldest are dropped
+}
+
+// result of the "hello" operation
+type helloResult struct {
+	SessionID string            `json:"session_id"`
+	ClientID  int               `json:"client_id"`
+	Resumed   bool              `json:"resumed"`           // false if the requested session expired
+	Pending   []GenericResponse `json:"pending,omitempty"` // responses completed while disconnected
+}
+
+// session is a client identity that outlives its connections
+type session struct {
+	id       string
+	clientID int
+
+	// guarded by the store mutex
+	connID     string // attached connection, empty while disconnected
+	detachedAt time.Time
+	pending    []GenericResponse
+	kick       func() // closes the attached connection
+}
+
+// sessionStore keeps the sessions of the server
+type sessionStore struct {
+	mu           sync.Mutex
+	sessions     map[string]*session
+	lastClientID int
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session)}
+}
+
+// hello attaches a connection to the requested session, or to a new one if it does not exist;
+// a connection still attached to the resumed session is closed
+func (st *sessionStore) hello(sessionID, connID string, kick func()) helloResult {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.sessions[sessionID]
+	if !ok {
+		st.lastClientID++
+		sess = &session{id: newSessionID(), clientID: st.lastClientID}
+		st.sessions[sess.id] = sess
+	} else if sess.connID != "" && sess.connID != connID {
+		sess.kick()
+	}
+	sess.connID, sess.kick = connID, kick
+
+	result := helloResult{SessionID: sess.id, ClientID: sess.clientID, Resumed: ok, Pending: sess.pending}
+	sess.pending = nil
+	return result
+}
+
+// detach marks the session as disconnected, unless another connection resumed it
+func (st *sessionStore) detach(sessionID, connID string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if sess, ok := st.sessions[sessionID]; ok && sess.connID == connID {
+		sess.connID, sess.kick = "", nil
+		sess.detachedAt = time.Now()
+	}
+}
+
+// addPending keeps a response that could not be delivered until the client resumes
+func (st *sessionStore) addPending(sessionID string, response GenericResponse, maxPending int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, ok := st.sessions[sessionID]
+	if !ok {
+		return
+	}
+	sess.pending = append(sess.pending, response)
+	if len(sess.pending) > maxPending {
+		sess.pending = sess.pending[len(sess.pending)-maxPending:]
+	}
+}
+
+// expire removes the sessions disconnected for longer than ttl, it returns how many were removed
+func (st *sessionStore) expire(ttl time.Duration) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	removed := 0
+	for id, sess := range st.sessions {
+		if sess.connID == "" && time.Since(sess.detachedAt) > ttl {
+			delete(st.sessions, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// count returns the number of sessions
+func (st *sessionStore) count() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+// expireSessions removes the expired sessions until the server shuts down
+func (s *Server) expireSessions() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			ttl := time.Duration(s.activeConfig().Sessions.TTLSeconds) * time.Second
+			if removed := s.sessions.expire(ttl); removed > 0 {
+				s.logger.Debug("Sessions expired", "count", removed)
+			}
+		}
+	}
+}
+
+// newSessionID returns a random session id
+func newSessionID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,109 @@
+package taskserver
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"time"
+)
+
+// limits protecting the connection slots from clients that send or read too slowly
+type SlowClientConfig struct {
+	RequestReadTimeoutSeconds int `json:"RequestReadTimeoutSeconds"` // time to receive a whole request once its first byte arrived
+	MinReadBytesPerSecond     int `json:"MinReadBytesPerSecond"`     // slowest accepted transfer rate of a request
+	WriteTimeoutSeconds       int `json:"WriteTimeoutSeconds"`       // time to hand a response to the client
+	WriteBufferBytes          int `json:"WriteBufferBytes"`          // socket send buffer, 0 for the OS default
+}
+
+func (c SlowClientConfig) writeTimeout() time.Duration {
+	return time.Duration(c.WriteTimeoutSeconds) * time.Second
+}
+
+// the transfer rate is checked this often, and only after the first check
+const minRateWindow = time.Second
+
+// reasons a connection is closed for being slow, used as metric labels
+const (
+	slowReadTimeout  = "read_timeout"
+	slowMinRate      = "min_rate"
+	slowWriteTimeout = "write_timeout"
+	tooLarge         = "too_large"
+)
+
+var (
+	errRequestTooSlow  = errors.New("request not received within the request read timeout")
+	errTransferTooSlow = errors.New("request transfer rate below the minimum")
+	errRequestTooLarge = errors.New("request larger than MaxMessageSize")
+)
+
+// slowCloseReason returns the metric label of an error returned by readRequest, empty for other errors
+func slowCloseReason(err error) string {
+	switch {
+	case errors.Is(err, errRequestTooSlow):
+		return slowReadTimeout
+	case errors.Is(err, errTransferTooSlow):
+		return slowMinRate
+	case errors.Is(err, errRequestTooLarge):
+		return tooLarge
+	}
+	return ""
+}
+
+// readRequest reads one request line; the caller sets the deadline for the first byte,
+// after it arrives the whole line must come within the request read timeout, at the
+// minimum rate and within maxSize bytes
+func readRequest(conn net.Conn, reader *bufio.Reader, limits SlowClientConfig, maxSize int) ([]byte, error) {
+	// waiting for the first byte, this is where idle connections spend their time
+	if _, err := reader.Peek(1); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	deadline := start.Add(time.Duration(limits.RequestReadTimeoutSeconds) * time.Second)
+	var line []byte
+	for {
+		conn.SetReadDeadline(earliest(deadline, time.Now().Add(minRateWindow)))
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		// the newline is not part of the size limit
+		if len(line) > maxSize+1 {
+			return nil, errRequestTooLarge
+		}
+		if err == nil {
+			return line, nil
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if !isTimeout(err) {
+			return nil, err
+		}
+
+		// the short deadline expired, checking the overall limits
+		now := time.Now()
+		if !now.Before(deadline) {
+			return nil, errRequestTooSlow
+		}
+		elapsed := now.Sub(start)
+		if float64(len(line)) < float64(limits.MinReadBytesPerSecond)*elapsed.Seconds() {
+			return nil, errTransferTooSlow
+		}
+	}
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// setWriteBuffer bounds the data queued in the kernel for a client that does not read
+func setWriteBuffer(conn net.Conn, size int) {
+	if size <= 0 {
+		return
+	}
+	if tcpConn, ok := rawConn(conn).(*net.TCPConn); ok {
+		tcpConn.SetWriteBuffer(size)
+	}
+}
@@ -0,0 +1,626 @@
+package taskserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// consistent snapshot configuration, used by the cluster nodes
+//
+// The "snapshot" admin operation of a coordinator takes a Chandy–Lamport snapshot of
+// the cluster. The coordinator records its state and sends a marker to every worker; a
+// worker records its state when the marker, or a request sent after it, arrives and
+// sends a marker back. The requests and responses that were travelling between two
+// nodes are recorded with the channel they were on, and the coordinator writes the
+// states of all the nodes to Dir as snapshot-<id>.json.
+type SnapshotConfig struct {
+	Dir            string `json:"Dir"`            // coordinator: where the snapshots are written
+	TimeoutSeconds int    `json:"TimeoutSeconds"` // a snapshot still missing parts after this long is written without them
+}
+
+// channelTag is carried by the messages between a coordinator and its workers, Snapshot
+// is the last snapshot the sender recorded its state for
+type channelTag struct {
+	From     string `json:"from"`
+	Snapshot uint64 `json:"snapshot"`
+	Token    string `json:"token,omitempty"` // Cluster.Token, on the requests of the coordinator
+}
+
+// snapshotMarker is sent on a channel right after the sender recorded its state. The
+// pooled connections do not keep the messages of a channel in order, so the marker
+// counts the messages it should follow instead: Sent messages tagged with Epoch were
+// sent on the channel before it.
+type snapshotMarker struct {
+	Token    string `json:"token,omitempty"` // Cluster.Token
+	From     string `json:"from"`
+	Snapshot uint64 `json:"snapshot"`
+	Epoch    uint64 `json:"epoch"`
+	Sent     uint64 `json:"sent"`
+}
+
+// channelMessage is a message recorded in transit
+type channelMessage struct {
+	Kind    string          `json:"kind"` // request or response
+	Message json.RawMessage `json:"message"`
+}
+
+// channelSnapshot is the state of a channel, the messages sent before the marker and
+// received after the receiver recorded its state
+type channelSnapshot struct {
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	Complete bool             `json:"complete"` // false when the marker or some of the messages never arrived
+	Messages []channelMessage `json:"messages"`
+}
+
+// inFlightTask is a request between the coordinator and a worker that was not answered
+// yet: forwarded on the coordinator, being executed on the worker
+type inFlightTask struct {
+	Peer       string    `json:"peer"`
+	Op         string    `json:"op,omitempty"`
+	TaskNumber int       `json:"task"`
+	Since      time.Time `json:"since"`
+}
+
+// nodeSnapshot is the state a node recorded, with its incoming channels
+type nodeSnapshot struct {
+	SnapshotID uint64            `json:"snapshot_id"`
+	NodeID     string            `json:"node_id"`
+	Role       string            `json:"role"`
+	RecordedAt time.Time         `json:"recorded_at"`
+	InFlight   []inFlightTask    `json:"in_flight"`
+	Workers    []workerSummary   `json:"workers,omitempty"`
+	Jobs       []Job             `json:"pending_jobs,omitempty"` // replicated job queue
+	Batches    batchesStatus     `json:"batches"`
+	Counters   map[string]int64  `json:"counters"`
+	Channels   []channelSnapshot `json:"channels"`
+}
+
+// clusterSnapshot is the combined snapshot written by the coordinator
+type clusterSnapshot struct {
+	ID          uint64         `json:"snapshot_id"`
+	StartedAt   time.Time      `json:"started_at"`
+	CompletedAt time.Time      `json:"completed_at"`
+	Complete    bool           `json:"complete"` // every node recorded its state and every channel is complete
+	InTransit   int            `json:"in_transit"`
+	Nodes       []nodeSnapshot `json:"nodes"`
+	Missing     []string       `json:"missing,omitempty"` // workers whose state did not arrive
+}
+
+// snapshotResult is returned by the "snapshot" admin operation
+type snapshotResult struct {
+	File       string   `json:"file"`
+	SnapshotID uint64   `json:"snapshot_id"`
+	Complete   bool     `json:"complete"`
+	Nodes      int      `json:"nodes"`
+	InTransit  int      `json:"in_transit"`
+	Missing    []string `json:"missing,omitempty"`
+}
+
+// snapshotter keeps the channel counters of a cluster node and the snapshot it is taking
+type snapshotter struct {
+	// sending or receiving a message holds it for reading and recording the state holds
+	// it for writing, so every message is either part of the state or in transit
+	events sync.RWMutex
+
+	mu       sync.Mutex
+	recorded uint64                       // last snapshot the state was recorded for
+	sent     map[string]uint64            // by receiver, messages sent since recorded
+	received map[string]map[uint64]uint64 // by sender and tag
+	inFlight map[uint64]*inFlightTask
+	lastTask uint64
+	current  *localSnapshot
+
+	// worker: node id of the coordinator it registered with, the only sender it accepts
+	coordinator string
+
+	// coordinator: the states sent by the workers for the snapshot being taken
+	collecting *snapshotCollection
+}
+
+// localSnapshot is the part of a snapshot recorded by this node
+type localSnapshot struct {
+	state    nodeSnapshot
+	channels map[string]*recordingChannel // incoming, by sender
+	finished chan struct{}                // closed when every channel is complete or given up
+	closed   bool
+}
+
+// recordingChannel is an incoming channel whose messages are being recorded
+type recordingChannel struct {
+	messages []channelMessage
+	marker   *snapshotMarker
+	complete bool
+}
+
+// snapshotCollection gathers the states of the workers on the coordinator
+type snapshotCollection struct {
+	id       uint64
+	expected map[string]bool
+	states   map[string]nodeSnapshot
+	arrived  chan struct{} // closed when every expected state arrived
+}
+
+func newSnapshotter() *snapshotter {
+	return &snapshotter{
+		sent:     make(map[string]uint64),
+		received: make(map[string]map[uint64]uint64),
+		inFlight: make(map[uint64]*inFlightTask),
+	}
+}
+
+// finish closes the snapshot, called with mu held
+func (l *localSnapshot) finish() {
+	if !l.closed {
+		l.closed = true
+		close(l.finished)
+	}
+}
+
+// count counts a message from a peer and records it if it is in transit, called
+// with mu held
+func (sn *snapshotter) count(tag *channelTag, kind string, message []byte) {
+	byTag, ok := sn.received[tag.From]
+	if !ok {
+		byTag = make(map[uint64]uint64)
+		sn.received[tag.From] = byTag
+	}
+	byTag[tag.Snapshot]++
+
+	local := sn.current
+	if local == nil || local.closed || tag.Snapshot >= local.state.SnapshotID {
+		return
+	}
+	channel, ok := local.channels[tag.From]
+	if !ok || channel.complete {
+		return
+	}
+	channel.messages = append(channel.messages, channelMessage{Kind: kind, Message: append(json.RawMessage(nil), message...)})
+	sn.checkChannel(local, tag.From)
+}
+
+// checkChannel completes a channel once its marker and every message sent before it
+// arrived, and the snapshot once every channel is complete; called with mu held
+func (sn *snapshotter) checkChannel(local *localSnapshot, from string) {
+	channel := local.channels[from]
+	if channel.complete || channel.marker == nil || sn.received[from][channel.marker.Epoch] < channel.marker.Sent {
+		return
+	}
+	channel.complete = true
+	for _, channel := range local.channels {
+		if !channel.complete {
+			return
+		}
+	}
+	local.finish()
+}
+
+// receiveOnChannel accounts for a message received from a peer, recording the state
+// first if the peer sent it after recording a snapshot this node did not record yet;
+// apply updates the state with the message, it runs with mu held
+func (s *Server) receiveOnChannel(tag *channelTag, kind string, message []byte, apply func()) {
+	sn := s.snapshots
+	for {
+		sn.events.RLock()
+		sn.mu.Lock()
+		// only the snapshots it starts are recorded by the coordinator
+		if tag.Snapshot <= sn.recorded || s.coordinator != nil {
+			sn.count(tag, kind, message)
+			apply()
+			sn.mu.Unlock()
+			sn.events.RUnlock()
+			return
+		}
+		// the marker of the sender is still on its way, the message must not be part of the state
+		sn.mu.Unlock()
+		sn.events.RUnlock()
+		s.recordSnapshot(tag.Snapshot, tag.From)
+	}
+}
+
+// setCoordinator records the node id the coordinator answered the registration with
+func (sn *snapshotter) setCoordinator(id string) {
+	sn.mu.Lock()
+	sn.coordinator = id
+	sn.mu.Unlock()
+}
+
+// fromCoordinator reports whether a tag was sent by the coordinator this worker
+// registered with; without a Cluster.Token any client can pass for it
+func (s *Server) fromCoordinator(from, token string) bool {
+	sn := s.snapshots
+	if sn == nil || s.coordinator != nil || !s.checkClusterToken(token) {
+		return false
+	}
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return sn.coordinator != "" && from == sn.coordinator
+}
+
+// receiveRequest accounts for a request forwarded by the coordinator and returns the id
+// of the in-flight task until it is answered, 0 for the requests of other clients
+func (s *Server) receiveRequest(req GenericRequest, line []byte) uint64 {
+	if req.Channel == nil || !s.fromCoordinator(req.Channel.From, req.Channel.Token) {
+		return 0
+	}
+	sn := s.snapshots
+	var id uint64
+	s.receiveOnChannel(req.Channel, "request", line, func() {
+		sn.lastTask++
+		id = sn.lastTask
+		sn.inFlight[id] = &inFlightTask{Peer: req.Channel.From, Op: req.Op, TaskNumber: req.TaskNumber, Since: time.Now()}
+	})
+	return id
+}
+
+// writeChannelResponse sends the response to a request, tagged when the request was
+// received on the channel from the coordinator as task
+func (s *Server) writeChannelResponse(conn net.Conn, logger *slog.Logger, req GenericRequest, task uint64, response GenericResponse, timeout time.Duration) error {
+	if task == 0 {
+		return s.writeResponse(conn, logger, response, timeout)
+	}
+	sn := s.snapshots
+	to := req.Channel.From
+	sn.events.RLock()
+	defer sn.events.RUnlock()
+	sn.mu.Lock()
+	response.Channel = &channelTag{From: s.activeConfig().Cluster.NodeID, Snapshot: sn.recorded}
+	sn.sent[to]++
+	delete(sn.inFlight, task)
+	sn.mu.Unlock()
+
+	err := s.writeResponse(conn, logger, response, timeout)
+	if err != nil {
+		sn.mu.Lock()
+		sn.sent[to]--
+		sn.mu.Unlock()
+	}
+	return err
+}
+
+// forwardToWorker forwards a request to a worker, tagged for the snapshots
+func (s *Server) forwardToWorker(worker *workerNode, req GenericRequest, timeout time.Duration) (response GenericResponse, sent bool, err error) {
+	sn := s.snapshots
+	if sn == nil {
+		return worker.forward(req, timeout)
+	}
+	wc, err := worker.conn(timeout)
+	if err != nil {
+		return response, false, err
+	}
+
+	sn.events.RLock()
+	sn.mu.Lock()
+	config := s.activeConfig().Cluster
+	req.Channel = &channelTag{From: config.NodeID, Snapshot: sn.recorded, Token: config.Token}
+	sn.sent[worker.id]++
+	sn.lastTask++
+	task := sn.lastTask
+	sn.inFlight[task] = &inFlightTask{Peer: worker.id, Op: req.Op, TaskNumber: req.TaskNumber, Since: time.Now()}
+	sn.mu.Unlock()
+	err = wc.send(req, timeout)
+	if err != nil {
+		sn.mu.Lock()
+		sn.sent[worker.id]--
+		delete(sn.inFlight, task)
+		sn.mu.Unlock()
+	}
+	sn.events.RUnlock()
+	if err != nil {
+		return response, false, err
+	}
+
+	response, err = worker.receive(wc)
+	if err != nil || response.Channel == nil {
+		// the worker crashed or timed out, a late response is lost with the connection
+		sn.events.RLock()
+		sn.mu.Lock()
+		delete(sn.inFlight, task)
+		sn.mu.Unlock()
+		sn.events.RUnlock()
+		return response, true, err
+	}
+	encoded, _ := json.Marshal(response)
+	s.receiveOnChannel(response.Channel, "response", encoded, func() {
+		delete(sn.inFlight, task)
+	})
+	return response, true, nil
+}
+
+// recordSnapshot records the state of the node for a snapshot and sends the markers on
+// the outgoing channels; from is the peer whose message made the node record it, empty
+// on the coordinator starting the snapshot. It returns nil if the state was already
+// recorded.
+func (s *Server) recordSnapshot(id uint64, from string) *localSnapshot {
+	sn := s.snapshots
+	config := s.activeConfig()
+	nodeID := config.Cluster.NodeID
+	if s.coordinator != nil && from != "" {
+		return nil
+	}
+
+	// the peers at the other end of the channels
+	peers := make(map[string]string)
+	if s.coordinator != nil {
+		for _, worker := range s.clusterWorkers() {
+			peers[worker.ID] = worker.Address
+		}
+	} else {
+		peers[from] = config.Cluster.CoordinatorAddress
+	}
+
+	sn.events.Lock()
+	sn.mu.Lock()
+	if id <= sn.recorded {
+		sn.mu.Unlock()
+		sn.events.Unlock()
+		return nil
+	}
+	if sn.current != nil {
+		// a newer snapshot replaces the one still waiting for its channels
+		sn.current.finish()
+	}
+	epoch := sn.recorded
+	local := &localSnapshot{
+		state:    s.localState(id, time.Now()),
+		channels: make(map[string]*recordingChannel, len(peers)),
+		finished: make(chan struct{}),
+	}
+	markers := make(map[string]snapshotMarker, len(peers))
+	for peer := range peers {
+		local.channels[peer] = &recordingChannel{}
+		markers[peer] = snapshotMarker{Token: config.Cluster.Token, From: nodeID, Snapshot: id, Epoch: epoch, Sent: sn.sent[peer]}
+	}
+	if len(peers) == 0 {
+		local.finish()
+	}
+	sn.recorded, sn.current = id, local
+	sn.sent = make(map[string]uint64)
+	// messages of older epochs can no longer complete a channel
+	for _, byTag := range sn.received {
+		for tag := range byTag {
+			if tag < epoch {
+				delete(byTag, tag)
+			}
+		}
+	}
+	sn.mu.Unlock()
+	sn.events.Unlock()
+	s.logger.Info("Recorded the state for a snapshot", "snapshot_id", id)
+
+	for peer, address := range peers {
+		go s.sendMarker(peer, address, markers[peer])
+	}
+	go s.completeSnapshot(local)
+	return local
+}
+
+// sendMarker sends a marker to a worker on its task address, or to the coordinator on
+// its cluster address; the channel stays incomplete on the other side if it fails
+func (s *Server) sendMarker(peer, address string, marker snapshotMarker) {
+	var err error
+	if s.coordinator != nil {
+		input, _ := json.Marshal(marker)
+		var response GenericResponse
+		response, _, err = s.coordinator.node(peer, address).forward(GenericRequest{Op: "snapshot_marker", Input: input}, 5*time.Second)
+		if err == nil && response.Status != "success" {
+			err = fmt.Errorf("%s: %s", response.Code, response.Error)
+		}
+	} else {
+		_, err = s.callCoordinator(clusterMessage{Op: "snapshot_marker", Marker: &marker})
+	}
+	if err != nil {
+		s.logger.Warn("Error sending a snapshot marker", "snapshot_id", marker.Snapshot, "peer", peer, "error", err)
+	}
+}
+
+// receiveMarker records the state if the marker is the first news of its snapshot and
+// closes the channel it came on once the messages sent before it arrived
+func (s *Server) receiveMarker(marker snapshotMarker) {
+	sn := s.snapshots
+	s.recordSnapshot(marker.Snapshot, marker.From)
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	local := sn.current
+	if local == nil || local.closed || local.state.SnapshotID != marker.Snapshot {
+		return
+	}
+	channel, ok := local.channels[marker.From]
+	if !ok {
+		return
+	}
+	channel.marker = &marker
+	sn.checkChannel(local, marker.From)
+}
+
+// handleMarkerRequest receives a marker sent by the coordinator to this worker
+func (s *Server) handleMarkerRequest(req GenericRequest) GenericResponse {
+	var marker snapshotMarker
+	switch {
+	case s.snapshots == nil || s.coordinator != nil:
+		return GenericResponse{Status: "error", Error: "Not a cluster worker", Code: errUnknownOp, RequestID: req.RequestID}
+	case json.Unmarshal(req.Input, &marker) != nil || marker.From == "" || marker.Snapshot == 0:
+		return GenericResponse{Status: "error", Error: "Invalid snapshot marker", Code: errInvalidJSON, RequestID: req.RequestID}
+	case !s.fromCoordinator(marker.From, marker.Token):
+		return GenericResponse{Status: "error", Error: "Invalid cluster token or coordinator", Code: errInvalidToken, RequestID: req.RequestID}
+	}
+	s.receiveMarker(marker)
+	return GenericResponse{Status: "success", RequestID: req.RequestID}
+}
+
+// completeSnapshot waits for the incoming channels, giving up on them after half of
+// the timeout so a worker reports its state before the coordinator stops waiting, and
+// hands the recorded state to the coordinator
+func (s *Server) completeSnapshot(local *localSnapshot) {
+	sn := s.snapshots
+	timeout := time.Duration(s.activeConfig().Snapshots.TimeoutSeconds) * time.Second / 2
+	select {
+	case <-local.finished:
+	case <-time.After(timeout):
+	case <-s.done:
+		return
+	}
+
+	sn.mu.Lock()
+	local.finish()
+	state := local.state
+	nodeID := s.activeConfig().Cluster.NodeID
+	state.Channels = make([]channelSnapshot, 0, len(local.channels))
+	for from, channel := range local.channels {
+		messages := channel.messages
+		if messages == nil {
+			messages = []channelMessage{}
+		}
+		state.Channels = append(state.Channels, channelSnapshot{From: from, To: nodeID, Complete: channel.complete, Messages: messages})
+	}
+	sn.mu.Unlock()
+	sort.Slice(state.Channels, func(i, j int) bool { return state.Channels[i].From < state.Channels[j].From })
+
+	if s.coordinator != nil {
+		sn.collect(state)
+		return
+	}
+	if _, err := s.callCoordinator(clusterMessage{Op: "snapshot_state", State: &state}); err != nil {
+		s.logger.Warn("Error sending the snapshot state to the coordinator", "snapshot_id", state.SnapshotID, "error", err)
+	}
+}
+
+// collect keeps a state recorded for the snapshot the coordinator is taking
+func (sn *snapshotter) collect(state nodeSnapshot) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	c := sn.collecting
+	if c == nil || c.id != state.SnapshotID || !c.expected[state.NodeID] {
+		return
+	}
+	if _, ok := c.states[state.NodeID]; ok {
+		return
+	}
+	c.states[state.NodeID] = state
+	if len(c.states) == len(c.expected) {
+		close(c.arrived)
+	}
+}
+
+// localState returns the state of the node, called while no message is being sent or received
+func (s *Server) localState(id uint64, now time.Time) nodeSnapshot {
+	sn := s.snapshots
+	config := s.activeConfig()
+	state := nodeSnapshot{
+		SnapshotID: id,
+		NodeID:     config.Cluster.NodeID,
+		Role:       config.Cluster.Role,
+		RecordedAt: now,
+		InFlight:   make([]inFlightTask, 0, len(sn.inFlight)),
+		Workers:    s.clusterWorkers(),
+		Batches:    s.batchesStatus(),
+		Counters:   s.metrics.counters(),
+	}
+	for _, task := range sn.inFlight {
+		state.InFlight = append(state.InFlight, *task)
+	}
+	sort.Slice(state.InFlight, func(i, j int) bool { return state.InFlight[i].Since.Before(state.InFlight[j].Since) })
+	if s.jobLog != nil {
+		state.Jobs = s.jobs.pending()
+	}
+	return state
+}
+
+// takeSnapshot starts a snapshot on the coordinator, waits for the states of the
+// workers and writes the combined snapshot to Snapshots.Dir
+func (s *Server) takeSnapshot() (snapshotResult, error) {
+	sn := s.snapshots
+	config := s.activeConfig()
+	started := time.Now()
+
+	expected := map[string]bool{config.Cluster.NodeID: true}
+	for _, worker := range s.clusterWorkers() {
+		expected[worker.ID] = true
+	}
+	sn.mu.Lock()
+	if sn.collecting != nil {
+		sn.mu.Unlock()
+		return snapshotResult{}, &TaskError{Code: errSnapshotInProgress, Message: "A snapshot is already being taken"}
+	}
+	id := uint64(started.UnixNano())
+	if id <= sn.recorded {
+		id = sn.recorded + 1
+	}
+	c := &snapshotCollection{id: id, expected: expected, states: make(map[string]nodeSnapshot), arrived: make(chan struct{})}
+	sn.collecting = c
+	sn.mu.Unlock()
+	defer func() {
+		sn.mu.Lock()
+		sn.collecting = nil
+		sn.mu.Unlock()
+	}()
+
+	s.recordSnapshot(id, "")
+	select {
+	case <-c.arrived:
+	case <-time.After(time.Duration(config.Snapshots.TimeoutSeconds) * time.Second):
+	case <-s.done:
+		return snapshotResult{}, ErrServerClosed
+	}
+
+	snapshot := clusterSnapshot{ID: id, StartedAt: started, CompletedAt: time.Now(), Complete: true, Nodes: []nodeSnapshot{}}
+	sn.mu.Lock()
+	for nodeID := range c.expected {
+		state, ok := c.states[nodeID]
+		if !ok {
+			snapshot.Missing = append(snapshot.Missing, nodeID)
+			snapshot.Complete = false
+			continue
+		}
+		for _, channel := range state.Channels {
+			snapshot.InTransit += len(channel.Messages)
+			snapshot.Complete = snapshot.Complete && channel.Complete
+		}
+		snapshot.Nodes = append(snapshot.Nodes, state)
+	}
+	sn.mu.Unlock()
+	sort.Strings(snapshot.Missing)
+	sort.Slice(snapshot.Nodes, func(i, j int) bool { return snapshot.Nodes[i].NodeID < snapshot.Nodes[j].NodeID })
+
+	file, err := writeSnapshot(config.Snapshots.Dir, snapshot)
+	if err != nil {
+		return snapshotResult{}, err
+	}
+	s.metrics.snapshotsTaken.Add(1)
+	if !snapshot.Complete {
+		s.metrics.snapshotsIncomplete.Add(1)
+	}
+	s.logger.Info("Snapshot written", "snapshot_id", id, "file", file, "complete", snapshot.Complete, "in_transit", snapshot.InTransit)
+	return snapshotResult{
+		File:       file,
+		SnapshotID: id,
+		Complete:   snapshot.Complete,
+		Nodes:      len(snapshot.Nodes),
+		InTransit:  snapshot.InTransit,
+		Missing:    snapshot.Missing,
+	}, nil
+}
+
+// writeSnapshot writes the snapshot to a new file of the directory
+func writeSnapshot(dir string, snapshot clusterSnapshot) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	encoded, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("snapshot-%d.json", snapshot.ID))
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, append(encoded, '\n'), 0o644); err != nil {
+		return "", err
+	}
+	return path, os.Rename(temp, path)
+}
@@ -0,0 +1,230 @@
+package taskserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TaskHandler executes a task on the raw JSON input, the returned value is encoded as the result
+type TaskHandler func(input json.RawMessage) (any, error)
+
+// typedTask adapts a task function to a TaskHandler, decoding the input into its parameter type
+func typedTask[In any, Out any](taskNumber int, task func(In) Out) TaskHandler {
+	return func(input json.RawMessage) (any, error) {
+		var inputs In
+		if err := json.Unmarshal(input, &inputs); err != nil {
+			return nil, fmt.Errorf("invalid input format for task %d", taskNumber)
+		}
+		return task(inputs), nil
+	}
+}
+
+// defaultTasks returns the tasks every server starts with
+func defaultTasks() map[int]TaskHandler {
+	return map[int]TaskHandler{
+		1: typedTask(1, task1),
+		2: typedTask(2, task2),
+		3: typedTask(3, task3),
+		4: typedTask(4, task4),
+		5: typedTask(5, task5),
+		6: typedTask(6, task6),
+		7: typedTask(7, task7),
+	}
+}
+
+// RegisterTask adds a task or replaces an existing one, it is safe to call while the server runs
+func (s *Server) RegisterTask(taskNumber int, handler TaskHandler) {
+	s.tasksMu.Lock()
+	defer s.tasksMu.Unlock()
+	s.tasks[taskNumber] = handler
+}
+
+// taskLabel returns the metrics label of a task number
+func (s *Server) taskLabel(taskNumber int) string {
+	s.tasksMu.RLock()
+	defer s.tasksMu.RUnlock()
+	if _, ok := s.tasks[taskNumber]; !ok {
+		return unknownTask
+	}
+	return strconv.Itoa(taskNumber)
+}
+
+// handleTask calls the handler registered for the task number and encodes its result
+func (s *Server) handleTask(taskNumber int, input json.RawMessage) (result json.RawMessage, err error) {
+	s.tasksMu.RLock()
+	handler, ok := s.tasks[taskNumber]
+	exclusive := s.exclusive[taskNumber]
+	s.tasksMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown task number: %d", taskNumber)
+	}
+	if exclusive {
+		unlock, err := s.lockExclusiveTask(taskNumber)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	// a task panicking on unexpected input must not take the server down
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("task %d failed: %v", taskNumber, r)
+		}
+	}()
+
+	results, err := handler(input)
+	if err != nil {
+		return nil, err
+	}
+	resultsJson, err := json.Marshal(results)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding results to JSON")
+	}
+	return json.RawMessage(resultsJson), nil
+}
+
+func task1(input []string) []string {
+	// casa, masa, trei, tanc, 4321 -> cmtt4, aara3, ssen2, aaic1
+	words := input
+	words_len := len([]rune(words[0]))
+	results := make([]string, 0, words_len)
+	// selecting characters by index from each word
+	for i := 0; i < words_len; i++ {
+		var sb strings.Builder
+		for _, word := range words {
+			r := []rune(word)
+			sb.WriteRune(r[i])
+		}
+		results = append(results, sb.String())
+
+	}
+	return results
+}
+
+func task2(input []string) int {
+	// abd4g5, 1sdf6fd, fd2fdsf5 -> 2 patrate perfecte (16, 25)
+	count := 0
+	// extracting the digits
+	for _, word := range input {
+		var sb strings.Builder
+		for _, ch := range word {
+			if unicode.IsDigit(ch) {
+				sb.WriteRune(ch)
+			}
+		}
+		if sb.Len() > 0 {
+			// convert to integer and check perfect square
+			num, err := strconv.Atoi(sb.String())
+			if err == nil {
+				sqrt := math.Sqrt(float64(num))
+				if sqrt == math.Trunc(sqrt) {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+func task3(input []int) int {
+	// 12, 13, 14 => 21 + 31 + 41 = 93
+	sum := 0
+	// reversing and summing
+	for _, num := range input {
+		s := strconv.Itoa(num)
+		var sb strings.Builder
+		r := []rune(s)
+		for i := len(r) - 1; i >= 0; i-- {
+			sb.WriteRune(r[i])
+		}
+		num, _ := strconv.Atoi(sb.String())
+		sum += num
+	}
+	return sum
+}
+
+func task4(input []int) int {
+	average := 0
+	count := 0
+	min_bound := input[0]
+	max_bound := input[1]
+	// calculating average of numbers whose sum of digits is within bounds
+	for i := 3; i < len(input); i++ {
+		sum := 0
+		s := strconv.Itoa(input[i])
+		r := []rune(s)
+		for j := len(r) - 1; j >= 0; j-- {
+			digit, _ := strconv.Atoi(string(r[j]))
+			sum += digit
+		}
+		if sum >= min_bound && sum <= max_bound {
+			average += input[i]
+			count++
+		}
+	}
+	if count > 0 {
+		average /= count
+	}
+	return average
+}
+
+func task5(input []string) []int {
+	// 2dasdas, 12, dasdas, 1010, 101 => 10, 5 (1010=10, 101=5)
+	results := make([]int, 0)
+	for _, word := range input {
+		// checking if the word is a binary number
+		num, err := strconv.ParseInt(word, 2, 64)
+		if err == nil {
+			results = append(results, int(num))
+		}
+
+	}
+	return results
+}
+
+// for uppercase, check if upper, convert to lower, do the same and convert back
+func task6(input []string) []string {
+	// LEFT, 3, abcdef, salut, ceva => xyzabc, pxirq, zbsx
+	// extracting direction and number of steps
+	direction := input[0]
+	steps, _ := strconv.Atoi(input[1])
+	results := make([]string, 0)
+	for i := 2; i < len(input); i++ {
+		var sb strings.Builder
+		// building the shifted string
+		for _, ch := range input[i] {
+			var shifted rune
+			base := int(ch)
+			switch direction {
+			case "LEFT":
+				shifted = rune((base-97-steps+26)%26 + 97)
+			case "RIGHT":
+				shifted = rune((base-97+steps)%26 + 97)
+			}
+			sb.WriteRune(shifted)
+		}
+		results = append(results, sb.String())
+	}
+	return results
+}
+
+func task7(input string) string {
+	// using regex to extract the number and the letter
+	// pattern used: first group, digits, second group, single letter
+	re := regexp.MustCompile(`(\d+)(\p{L})`)
+	var sb strings.Builder
+	matches := re.FindAllStringSubmatch(input, -1)
+	for _, match := range matches {
+		// match example : ["1G","1","G"] first is full match, second is first group, third is second group
+		count, _ := strconv.Atoi(match[1]) // number of repetitions
+		letter := match[2]                 // the letter to repeat
+		sb.WriteString(strings.Repeat(letter, count))
+	}
+	return sb.String()
+}
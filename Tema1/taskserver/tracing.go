@@ -0,0 +1,302 @@
+package taskserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tracing configuration, spans are exported only when File is set
+type TracingConfig struct {
+	File                 string `json:"File"`                 // OTLP JSON lines file
+	ServiceName          string `json:"ServiceName"`          // service.name resource attribute
+	TraceAllRequests     bool   `json:"TraceAllRequests"`     // start a trace for requests that carry none
+	FlushIntervalSeconds int    `json:"FlushIntervalSeconds"` // how often buffered spans are written
+}
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// span is a timed operation that is part of a trace
+type span struct {
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        string
+}
+
+// child starts a span whose parent is s
+func (s *span) child(name string, start time.Time) *span {
+	return &span{
+		traceID:  s.traceID,
+		spanID:   newSpanID(),
+		parentID: s.spanID,
+		name:     name,
+		kind:     spanKindInternal,
+		start:    start,
+	}
+}
+
+// setAttribute attaches a string attribute to the span
+func (s *span) setAttribute(key string, value any) {
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = fmt.Sprint(value)
+}
+
+// finish ends the span and hands it to the tracer
+func (s *span) finish(t *tracer) {
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+	t.export(s)
+}
+
+// tracer buffers finished spans and writes them to a file in batches
+type tracer struct {
+	config TracingConfig
+	spans  chan *span
+	done   chan struct{}
+	logger *slog.Logger
+
+	mu     sync.Mutex // guards closed, a handler still running after Close must not send on spans
+	closed bool
+}
+
+// newTracer starts the background exporter, nil if tracing is disabled
+func newTracer(config TracingConfig, logger *slog.Logger) (*tracer, error) {
+	if config.File == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "tema1-server"
+	}
+	interval := time.Duration(config.FlushIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	t := &tracer{config: config, spans: make(chan *span, 1024), done: make(chan struct{}), logger: logger}
+	go t.run(file, interval)
+	return t, nil
+}
+
+// startRequest returns the server span of a request, or nil if the request is not traced
+func (t *tracer) startRequest(req GenericRequest, start time.Time) *span {
+	if t == nil {
+		return nil
+	}
+	traceID, parentID := req.TraceID, req.SpanID
+	if !validID(traceID, 32) {
+		if !t.config.TraceAllRequests {
+			return nil
+		}
+		traceID, parentID = newTraceID(), ""
+	}
+	if !validID(parentID, 16) {
+		parentID = ""
+	}
+	return &span{
+		traceID:  traceID,
+		spanID:   newSpanID(),
+		parentID: parentID,
+		name:     "request",
+		kind:     spanKindServer,
+		start:    start,
+	}
+}
+
+// export queues a finished span, dropping it if the exporter is behind
+func (t *tracer) export(s *span) {
+	if t == nil || s == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		t.logger.Debug("Dropping span, exporter queue is full", "trace_id", s.traceID)
+	}
+}
+
+// Close flushes the remaining spans and stops the exporter
+func (t *tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.mu.Unlock()
+	<-t.done
+	return nil
+}
+
+// run writes batches of spans until the tracer is closed
+func (t *tracer) run(file *os.File, interval time.Duration) {
+	defer close(t.done)
+	defer file.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, 256)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		line, _ := json.Marshal(t.encode(batch))
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			t.logger.Error("Error writing spans", "file", t.config.File, "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) == cap(batch) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// OTLP JSON encoding, every line of the file is one ExportTraceServiceRequest
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// encode converts a batch of spans to the OTLP JSON structure
+func (t *tracer) encode(batch []*span) otlpExport {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	scope.Scope.Name = "tema1"
+	for _, s := range batch {
+		encoded := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		for _, key := range sortedKeys(s.attributes) {
+			encoded.Attributes = append(encoded.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: s.attributes[key]}})
+		}
+		if s.err != "" {
+			encoded.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		scope.Spans = append(scope.Spans, encoded)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: t.config.ServiceName}}}
+	return otlpExport{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+// newTraceID returns a random 16 byte trace id in hex
+func newTraceID() string {
+	return randomHex(16)
+}
+
+// newSpanID returns a random 8 byte span id in hex
+func newSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validID reports whether id is a non-zero lowercase hex id of the given length
+func validID(id string, length int) bool {
+	if len(id) != length {
+		return false
+	}
+	decoded, err := hex.DecodeString(id)
+	if err != nil || id != hex.EncodeToString(decoded) {
+		return false
+	}
+	for _, b := range decoded {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package taskserver
+
+import "net"
+
+// listenPrivate creates a unix socket, the platform has no umask to restrict it
+func listenPrivate(address string) (net.Listener, error) {
+	return net.Listen("unix", address)
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package taskserver
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the umask changes, the umask is shared by the whole process
+var umaskMu sync.Mutex
+
+// listenPrivate creates a unix socket only its owner can connect to, until it is chmoded
+func listenPrivate(address string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	previous := syscall.Umask(0o177)
+	defer syscall.Umask(previous)
+	return net.Listen("unix", address)
+}